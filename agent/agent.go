@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"llm-mcp-rag-simple/apierr"
 	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/usage"
 	"llm-mcp-rag-simple/utils"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -13,7 +16,7 @@ import (
 
 type Agent struct {
 	name            string
-	chatClient      types.ChatClient
+	newChatClient   ChatClientFactory // 为每个对话创建独立的聊天客户端
 	embeddingClient types.EmbeddingRetriever
 	vectorStore     types.VectorStore
 	mcpClients      map[string]types.MCPClient
@@ -21,6 +24,22 @@ type Agent struct {
 	context         string
 	maxRetries      int //最大重试数
 	timeout         time.Duration
+	generation      types.GenerationOptions // 默认生成参数
+	vision          bool                    // 模型支持图片输入，工具返回的图片会发送给模型
+	toolResults     ToolResultLimits        // 工具结果大小限制
+	policies        map[string]ToolPolicy   // 各MCP服务的工具审批策略
+	approve         ApprovalFunc            // 需要确认的工具调用的审批回调
+	resources       map[string]bool         // 已导入知识库的mcp资源，键为 resourceKey
+	watching        map[string]bool         // 已注册资源更新回调的mcp服务
+	ingestMu        sync.Mutex              // 串行导入资源，避免并发更新产生重复内容
+	sampling        SamplingConfig          // mcp服务模型采样配置
+	usage           *usage.Meter            // 进程内累计用量
+	prices          usage.PriceTable
+	budget          usage.Budget
+	samplePolicies  map[string]ApprovalPolicy
+	elicit          types.ElicitationHandler
+	inflight        map[string]map[*inflightCall]bool // 各mcp服务正在执行的工具调用
+	toolNames       *toolNameRegistry                 // 模型侧工具名与 (服务, 工具) 的映射
 	mu              sync.RWMutex
 }
 
@@ -30,9 +49,27 @@ type AgentConfig struct {
 	Context      string
 	MaxRetries   int
 	Timeout      time.Duration
+	Generation   types.GenerationOptions
+	Vision       bool             // 模型是否支持图片输入
+	ToolResults  ToolResultLimits // 工具结果大小限制与溢出存储
+	Approve      ApprovalFunc     // 工具调用审批回调，策略为 ask 时调用
+	Sampling     SamplingConfig   // mcp服务请求模型采样时使用的模型、token上限与审批回调
+	Prices       usage.PriceTable // 模型价格表，用于计算费用
+	Budget       usage.Budget     // 进程内硬性用量预算，超出后拒绝查询
+	// mcp服务请求用户输入（elicitation）时调用，为nil时不声明该能力
+	Elicit types.ElicitationHandler
 }
 
-func NewAgent(config AgentConfig, chatClient types.ChatClient, embeddingClient types.EmbeddingRetriever, vectorStore types.VectorStore) *Agent {
+// 单次查询选项
+type QueryOptions struct {
+	Generation types.GenerationOptions // 覆盖默认生成参数中已设置的字段
+	Images     []types.ContentPart     // 随查询发送的图片，可用 chat.LoadImage 创建
+}
+
+// 创建聊天客户端，每个对话持有一个独立实例
+type ChatClientFactory func() types.ChatClient
+
+func NewAgent(config AgentConfig, newChatClient ChatClientFactory, embeddingClient types.EmbeddingRetriever, vectorStore types.VectorStore) *Agent {
 	if config.MaxRetries <= 0 {
 		config.MaxRetries = 3
 	}
@@ -45,7 +82,7 @@ func NewAgent(config AgentConfig, chatClient types.ChatClient, embeddingClient t
 
 	agent := &Agent{
 		name:            config.Name,
-		chatClient:      chatClient,
+		newChatClient:   newChatClient,
 		embeddingClient: embeddingClient,
 		vectorStore:     vectorStore,
 		mcpClients:      make(map[string]types.MCPClient),
@@ -53,14 +90,21 @@ func NewAgent(config AgentConfig, chatClient types.ChatClient, embeddingClient t
 		context:         config.Context,
 		maxRetries:      config.MaxRetries,
 		timeout:         config.Timeout,
-	}
-
-	//设置系统提示词和上下文
-	if config.SystemPrompt != "" {
-		chatClient.SetSystemPrompt(config.SystemPrompt)
-	}
-	if config.Context != "" {
-		chatClient.SetContext(config.Context)
+		generation:      config.Generation,
+		vision:          config.Vision,
+		toolResults:     config.ToolResults,
+		policies:        make(map[string]ToolPolicy),
+		approve:         config.Approve,
+		resources:       make(map[string]bool),
+		watching:        make(map[string]bool),
+		sampling:        config.Sampling,
+		usage:           usage.NewMeter(),
+		prices:          config.Prices,
+		budget:          config.Budget,
+		samplePolicies:  make(map[string]ApprovalPolicy),
+		elicit:          config.Elicit,
+		inflight:        make(map[string]map[*inflightCall]bool),
+		toolNames:       newToolNameRegistry(),
 	}
 	return agent
 }
@@ -69,10 +113,21 @@ func NewAgent(config AgentConfig, chatClient types.ChatClient, embeddingClient t
 func (a *Agent) AddMCPClient(name string, client types.MCPClient) error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
+	//内置工具使用 agent 命名空间，同名服务的工具会与内置工具混淆
+	if name == builtinServer {
+		return fmt.Errorf("mcp Client名称【%s】为内置工具保留", name)
+	}
 	//避免重复添加
 	if _, exists := a.mcpClients[name]; exists {
 		return fmt.Errorf("该mcp Client：【%s】 已存在\n", name)
 	}
+	//支持采样的客户端使用Agent的聊天模型处理采样请求，需在初始化前设置
+	if sampler, ok := client.(types.MCPSamplingClient); ok {
+		sampler.SetSamplingHandler(a.sample)
+	}
+	if elicitor, ok := client.(types.MCPElicitationClient); ok && a.elicit != nil {
+		elicitor.SetElicitationHandler(a.elicitInput)
+	}
 	//初始化
 	ctx := context.Background()
 	if err := client.Init(ctx); err != nil {
@@ -106,13 +161,25 @@ func (a *Agent) GetMCPClient() []string {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
 
-	names := make([]string, len(a.mcpClients))
+	names := make([]string, 0, len(a.mcpClients))
 	for name := range a.mcpClients {
 		names = append(names, name)
 	}
+	sort.Strings(names)
 	return names
 }
 
+// 返回指定mcp client的连接状态
+func (a *Agent) MCPClientStatus(name string) (types.MCPClientStatus, bool) {
+	a.mu.RLock()
+	client, ok := a.mcpClients[name]
+	a.mu.RUnlock()
+	if !ok {
+		return types.MCPClientStatus{}, false
+	}
+	return client.Status(), true
+}
+
 // 向知识库添加文档
 func (a *Agent) AddKnowledge(ctx context.Context, documents []string) error {
 	if len(documents) == 0 {
@@ -120,6 +187,7 @@ func (a *Agent) AddKnowledge(ctx context.Context, documents []string) error {
 	}
 
 	utils.LogInfo(fmt.Sprintf("正在将 %d 个文档添加到知识库\n", len(documents)))
+	ctx = usage.WithMeter(ctx, a.usage)
 
 	type result struct {
 		index int
@@ -159,77 +227,105 @@ func (a *Agent) AddKnowledge(ctx context.Context, documents []string) error {
 	return nil
 }
 
-// 用户查询处理
-func (a *Agent) Query(ctx context.Context, query string) (*types.ChatResponse, error) {
+// 用户查询处理，查询在指定对话中进行，不同对话可并发查询
+// opts 为 nil 时使用默认选项
+func (a *Agent) Query(ctx context.Context, conv *Conversation, query string, opts *QueryOptions) (*types.ChatResponse, error) {
+	return a.query(ctx, conv, query, opts, nil)
+}
+
+// 执行查询；prelude 为查询前追加到对话历史的消息（如mcp提示词渲染出的消息），
+// 与查询在同一锁内写入，查询失败时一并撤销
+func (a *Agent) query(ctx context.Context, conv *Conversation, query string, opts *QueryOptions, prelude []types.ChatMessage) (*types.ChatResponse, error) {
+	if conv == nil {
+		return nil, fmt.Errorf("对话不能为空")
+	}
 	if strings.TrimSpace(query) == "" {
 		return nil, fmt.Errorf("查询内容不能为空")
 	}
 
+	if err := a.checkBudget(nil); err != nil {
+		return nil, err
+	}
+
 	utils.LogInfo(fmt.Sprintf("正在查询:%s\n", query))
-	queryCtx, cancel := context.WithTimeout(ctx, a.timeout)
+	//等待用户审批的时间不计入超时
+	queryCtx, cancel := withPausableTimeout(ctx, a.timeout)
 	defer cancel()
+	//本次查询的用量，结束后计入对话与进程用量
+	meter := usage.NewMeter()
+	queryCtx = usage.WithMeter(queryCtx, meter)
+	defer a.recordUsage(conv, meter)
 
-	//检索相关文档（RAG）
-	relevantDocs, err := a.retrieveRelevantDocuments(queryCtx, query)
-	if err != nil {
-		utils.LogWarn(fmt.Sprintf("检索相关文档失败：%v", err))
-		//检索失败继续处理，只是没有RAG增强
-	}
-	//增强查询，相关文档作为上下文
-	enhancedQuery := a.buildEnhancedQuery(query, relevantDocs)
+	enhancedQuery := a.enhanceQuery(queryCtx, query)
 	//获取所有可用工具
 	tools := a.getAllTools()
+	generation, images := a.queryOptions(opts)
 
-	//重试查询
-	var response *types.ChatResponse
-	var lastErr error
+	//同一对话内的查询串行执行，聊天客户端不是并发安全的
+	conv.mu.Lock()
+	defer conv.mu.Unlock()
+	conv.chatClient.SetTools(tools)
 
-	for attempt := 1; attempt <= a.maxRetries; attempt++ {
-		response, lastErr = a.processQueryWithTools(queryCtx, enhancedQuery, tools)
-		if lastErr == nil {
-			break
-		}
-		utils.LogWarn(fmt.Sprintf("查询尝试%d失败:%v \n", attempt, lastErr))
-		if attempt < a.maxRetries {
-			//时间间隔attempt秒，避免频繁重试
-			time.Sleep(time.Duration(attempt) * time.Second)
-		}
+	//查询失败时恢复对话历史，避免留下用户消息和不完整的工具调用
+	snapshot := conv.chatClient.GetMessageHistory()
+	if len(prelude) > 0 {
+		conv.chatClient.SetMessageHistory(append(append([]types.ChatMessage(nil), snapshot...), prelude...))
 	}
-	if lastErr != nil {
-		return nil, fmt.Errorf("经过%d次尝试后查询失败:%w", a.maxRetries, lastErr)
+	response, err := a.processQueryWithTools(queryCtx, conv.chatClient, enhancedQuery, images, generation)
+	if err != nil {
+		conv.chatClient.SetMessageHistory(snapshot)
+		return nil, err
 	}
 
+	queryUsage := a.prices.Total(meter)
+	response.Usage = &queryUsage
 	utils.LogInfo(fmt.Sprintf("处理请求成功"))
 	return response, nil
 }
 
-// 返回聊天消失历史
-func (a *Agent) GetMessageHistory() []types.ChatMessage {
-	return a.chatClient.GetMessageHistory()
+// 合并默认生成参数与单次查询选项，返回生成参数与随查询发送的图片；
+// 工具选择中的 client.tool 转换为模型侧名称
+func (a *Agent) queryOptions(opts *QueryOptions) (types.GenerationOptions, []types.ContentPart) {
+	generation := a.generation
+	var images []types.ContentPart
+	if opts != nil {
+		generation = generation.Merge(opts.Generation)
+		images = opts.Images
+	}
+	generation.ToolChoice = a.toolChoiceName(generation.ToolChoice)
+	return generation, images
 }
 
-// 清除对话历史
-func (a *Agent) ClearHistory() {
-	a.chatClient.ClearHistory()
-	utils.LogInfo(fmt.Sprintf("对话历史已清除"))
+// 返回进程内累计用量与按模型的明细
+func (a *Agent) Usage() (types.Usage, []usage.ModelUsage) {
+	return a.prices.Total(a.usage), a.prices.Report(a.usage)
 }
 
-// 更新系统提示词
+// 检查进程累计用量（含进行中查询的用量）是否超出预算
+func (a *Agent) checkBudget(inflight *usage.Meter) error {
+	return a.budget.Check(a.prices.Total(a.usage, inflight))
+}
+
+// 将查询用量计入对话与进程用量
+func (a *Agent) recordUsage(conv *Conversation, meter *usage.Meter) {
+	conv.usage.Merge(meter)
+	a.usage.Merge(meter)
+}
+
+// 更新新建对话使用的系统提示词，已有对话不受影响
 func (a *Agent) SetSystemPrompt(prompt string) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	a.systemPrompt = prompt
-	a.chatClient.SetSystemPrompt(prompt)
 
 	utils.LogInfo(fmt.Sprintf("系统提示词已更新"))
 }
 
-// 更新上下文信息
+// 更新新建对话使用的上下文信息，已有对话不受影响
 func (a *Agent) SetContext(context string) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	a.context = context
-	a.chatClient.SetContext(context)
 
 	utils.LogInfo(fmt.Sprintf("上下文信息已更新"))
 }
@@ -253,6 +349,16 @@ func (a *Agent) Close() error {
 	return nil
 }
 
+// 检索相关文档（RAG）并将其作为上下文加入查询
+func (a *Agent) enhanceQuery(ctx context.Context, query string) string {
+	relevantDocs, err := a.retrieveRelevantDocuments(ctx, query)
+	if err != nil {
+		utils.LogWarn(fmt.Sprintf("检索相关文档失败：%v", err))
+		//检索失败继续处理，只是没有RAG增强
+	}
+	return a.buildEnhancedQuery(query, relevantDocs)
+}
+
 // 查询检索相关文档
 func (a *Agent) retrieveRelevantDocuments(ctx context.Context, query string) ([]string, error) {
 	if a.vectorStore.Size() == 0 {
@@ -285,60 +391,71 @@ func (a *Agent) buildEnhancedQuery(query string, relevantDocs []string) string {
 	return builder.String()
 }
 
-// 获取所有可用mcp工具
+// 获取所有可用mcp工具，每次查询时重新读取，服务端工具列表变化后在下一轮生效
 func (a *Agent) getAllTools() []types.Tool {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
 
+	//按客户端名称排序，保证工具顺序稳定
+	names := make([]string, 0, len(a.mcpClients))
+	for name := range a.mcpClients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 	var allTools []types.Tool
-	for clientName, client := range a.mcpClients {
+	for _, clientName := range names {
+		client := a.mcpClients[clientName]
+		//重连失败的服务不再向模型暴露工具
+		if client.Status().State == types.MCPStateFailed {
+			continue
+		}
 		tools := client.GetTools()
 		for _, tool := range tools {
-			tool.Name = fmt.Sprintf("%S.%S", clientName, tool.Name)
+			tool.Name = a.toolNames.name(toolRef{Server: clientName, Tool: tool.Name})
 			allTools = append(allTools, tool)
 		}
 	}
-	return allTools
+	return append(allTools, a.builtinTools()...)
 }
 
-// 处理查询并执行工具调用
-func (a *Agent) processQueryWithTools(ctx context.Context, query string, tools []types.Tool) (*types.ChatResponse, error) {
-	response, err := a.chatClient.Chat(ctx, query)
+// 处理查询并执行工具调用，重试只针对失败的模型请求，已执行的工具不会重复执行
+func (a *Agent) processQueryWithTools(ctx context.Context, chatClient types.ChatClient, query string, images []types.ContentPart, generation types.GenerationOptions) (*types.ChatResponse, error) {
+	response, err := a.chatWithRetry(ctx, chatClient, query, images, generation)
 	if err != nil {
 		return nil, fmt.Errorf("获取对话响应失败：%w", err)
 	}
 	//检查是否请求调用工具
 	if len(response.ToolCalls) > 0 {
 		utils.LogDebug(fmt.Sprintf("调用%d个工具\n", len(response.ToolCalls)))
+		images = nil
 		for _, toolCall := range response.ToolCalls {
 			result, err := a.executeToolCall(ctx, toolCall)
 			if err != nil {
 				utils.LogError(fmt.Sprintf("调用工具失败：%v\n", err))
 				//错误信息，让模型根据错误调整
-				result = &types.MCPToolResult{
-					Content: []struct {
-						Type string `json:"type"`
-						Text string `json:"text"`
-					}{
-						{
-							Type: "text",
-							Text: fmt.Sprintf("调用工具失败：%v", err),
-						},
-					},
-				}
+				result = types.NewTextToolResult(fmt.Sprintf("调用工具失败：%v", err), true)
 			}
 
-			//将执行结果添加到对话历史中
-			var resultText string
-			if result != nil && len(result.Content) > 0 {
-				resultText = result.Content[0].Text
-			} else {
-				resultText = "没有结果"
+			//将执行结果的所有内容添加到对话历史中
+			resultText, resultImages := renderToolResult(result, a.vision)
+			//超长结果截断，避免撑爆上下文窗口
+			if tool, _ := a.toolNames.resolve(toolCall.Function.Name); tool != readToolResultTool {
+				resultText = a.limitToolResult(tool, resultText)
 			}
-			a.chatClient.AppendToolResult(toolCall.ID, resultText)
+			chatClient.AppendToolResult(toolCall.ID, resultText)
+			images = append(images, resultImages...)
+		}
+		if err := a.checkBudget(usage.FromContext(ctx)); err != nil {
+			return nil, err
 		}
-		//最终回复
-		finalResponse, err := a.chatClient.Chat(ctx, "")
+		//最终回复，不再强制调用工具
+		generation.ToolChoice = ""
+		//工具消息只能包含文本，图片通过一条用户消息发送
+		prompt := ""
+		if len(images) > 0 {
+			prompt = "以上是工具返回的图片，请结合图片内容回答。"
+		}
+		finalResponse, err := a.chatWithRetry(ctx, chatClient, prompt, images, generation)
 		if err != nil {
 			return nil, fmt.Errorf("获取工具调用最终回复失败：%w", err)
 		}
@@ -347,14 +464,46 @@ func (a *Agent) processQueryWithTools(ctx context.Context, query string, tools [
 	return response, nil
 }
 
+// 发送一次对话请求，只重试限流、超时与服务端错误；重试前恢复本次请求之前的对话历史
+func (a *Agent) chatWithRetry(ctx context.Context, chatClient types.ChatClient, prompt string, images []types.ContentPart, generation types.GenerationOptions) (*types.ChatResponse, error) {
+	snapshot := chatClient.GetMessageHistory()
+	var lastErr error
+	for attempt := 1; attempt <= a.maxRetries; attempt++ {
+		chatClient.AttachParts(images)
+		response, err := chatClient.Chat(ctx, prompt, generation)
+		if err == nil {
+			return response, nil
+		}
+		lastErr = err
+		chatClient.SetMessageHistory(snapshot)
+		if !apierr.Retryable(err) {
+			return nil, fmt.Errorf("查询失败（%s）:%w", apierr.KindOf(err), err)
+		}
+		utils.LogWarn(fmt.Sprintf("查询尝试%d失败:%v \n", attempt, err))
+		if attempt < a.maxRetries {
+			wait := apierr.Backoff(err, attempt, time.Second, 30*time.Second)
+			utils.LogInfo(fmt.Sprintf("%v后重试", wait))
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("等待重试时查询已取消:%w", err)
+			}
+		}
+	}
+	return nil, fmt.Errorf("经过%d次尝试后查询失败:%w", a.maxRetries, lastErr)
+}
+
 // 执行单个工具调用
 func (a *Agent) executeToolCall(ctx context.Context, toolCall types.ToolCall) (*types.MCPToolResult, error) {
-	parts := strings.SplitN(toolCall.Function.Name, ".", 2)
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("工具名称格式错误：%s", toolCall.Function.Name)
+	tool, ok := a.toolNames.resolve(toolCall.Function.Name)
+	if !ok {
+		return nil, fmt.Errorf("未知的工具：%s", toolCall.Function.Name)
 	}
-	clientName := parts[0]
-	toolName := parts[1]
+	if tool == readToolResultTool && a.toolResults.SpillDir != "" {
+		return a.readToolResult(toolCall.Function.Arguments)
+	}
+	clientName := tool.Server
+	toolName := tool.Tool
 
 	a.mu.RLock()
 	client, exists := a.mcpClients[clientName]
@@ -363,18 +512,25 @@ func (a *Agent) executeToolCall(ctx context.Context, toolCall types.ToolCall) (*
 		return nil, fmt.Errorf("mcp client不存在：%s", clientName)
 	}
 
-	utils.LogDebug(fmt.Sprintf("执行工具：%s.%s", clientName, toolName))
+	utils.LogDebug(fmt.Sprintf("执行工具：%s", tool))
 	var arguments map[string]interface{}
 
 	if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &arguments); err != nil {
 		return nil, fmt.Errorf("解析工具参数失败：%w", err)
 	}
 
-	//执行工具
+	//有副作用的工具需要按策略审批
+	if err := a.checkApproval(ctx, ApprovalRequest{Server: clientName, Tool: toolName, Arguments: arguments}); err != nil {
+		return nil, err
+	}
+
+	//执行工具，调用期间服务可能请求采样或用户输入
+	untrack := a.trackToolCall(ctx, clientName)
 	result, err := client.CallTool(ctx, toolName, arguments)
+	untrack()
 	if err != nil {
-		return nil, fmt.Errorf("执行工具%s失败：%w", toolCall.Function.Name, err)
+		return nil, fmt.Errorf("执行工具%s失败：%w", tool, err)
 	}
-	utils.LogDebug(fmt.Sprintf("工具%s执行成功\n", toolCall.Function.Name))
+	utils.LogDebug(fmt.Sprintf("工具%s执行成功\n", tool))
 	return result, nil
 }
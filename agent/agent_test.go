@@ -0,0 +1,1092 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"llm-mcp-rag-simple/cassette"
+	"llm-mcp-rag-simple/chat"
+	"llm-mcp-rag-simple/embedding"
+	"llm-mcp-rag-simple/fakeopenai"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/usage"
+	"llm-mcp-rag-simple/vectorstore"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录调用参数的MCP客户端
+type fakeMCPClient struct {
+	tools  []types.Tool
+	result *types.MCPToolResult // 不为nil时作为固定结果返回
+	calls  []map[string]interface{}
+}
+
+func (c *fakeMCPClient) Init(ctx context.Context) error { return nil }
+func (c *fakeMCPClient) Close() error                   { return nil }
+func (c *fakeMCPClient) GetTools() []types.Tool         { return c.tools }
+
+func (c *fakeMCPClient) Status() types.MCPClientStatus {
+	return types.MCPClientStatus{State: types.MCPStateReady, Tools: len(c.tools)}
+}
+
+func (c *fakeMCPClient) CallTool(ctx context.Context, name string, params map[string]interface{}) (*types.MCPToolResult, error) {
+	c.calls = append(c.calls, params)
+	if c.result != nil {
+		return c.result, nil
+	}
+	return types.NewTextToolResult(fmt.Sprintf("%s=%v", name, params["a"].(float64)+params["b"].(float64)), false), nil
+}
+
+func newTestAgent(t *testing.T, server *fakeopenai.Server, config AgentConfig) *Agent {
+	t.Helper()
+	store := vectorstore.NewInMemoryVectorStore()
+	retriever := embedding.NewRetriever("embed-test", server.URL, "test-key", store)
+	newChatClient := func() types.ChatClient {
+		return chat.NewOpenAIClient("test-key", server.URL, "gpt-test", nil, "", "")
+	}
+	return NewAgent(config, newChatClient, retriever, store)
+}
+
+func TestAgentQueryWithRAG(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{SystemPrompt: "你是助手"})
+	ctx := context.Background()
+	if err := agent.AddKnowledge(ctx, []string{"北京是中国的首都"}); err != nil {
+		t.Fatalf("AddKnowledge失败：%v", err)
+	}
+
+	server.Enqueue(fakeopenai.Reply{
+		Content: "北京",
+		Usage:   &openai.Usage{PromptTokens: 20, CompletionTokens: 2},
+		Check: func(req openai.ChatCompletionRequest) error {
+			last := req.Messages[len(req.Messages)-1]
+			if !strings.Contains(last.Content, "北京是中国的首都") || !strings.Contains(last.Content, "中国的首都是哪里") {
+				return fmt.Errorf("查询未包含检索到的文档：%q", last.Content)
+			}
+			if req.Messages[0].Content != "你是助手" {
+				return fmt.Errorf("缺少系统提示词")
+			}
+			return nil
+		},
+	})
+
+	conv := agent.NewConversation()
+	response, err := agent.Query(ctx, conv, "中国的首都是哪里", nil)
+	if err != nil {
+		t.Fatalf("Query失败：%v", err)
+	}
+	if response.Content != "北京" {
+		t.Errorf("回复内容错误：%q", response.Content)
+	}
+	if response.Usage == nil || response.Usage.PromptTokens != 20 || response.Usage.EmbeddingTokens == 0 {
+		t.Errorf("查询用量错误：%+v", response.Usage)
+	}
+	if total, _ := agent.Usage(); total.CompletionTokens != 2 {
+		t.Errorf("进程用量错误：%+v", total)
+	}
+}
+
+// 回放 testdata/cassettes 中记录的完整查询：检索、工具调用与最终回复，不访问网络
+func TestAgentQueryReplaysCassette(t *testing.T) {
+	recorder, err := cassette.New(filepath.Join("testdata", "cassettes", "query_rag_tool.json"), cassette.ModeReplay)
+	if err != nil {
+		t.Fatalf("加载cassette失败：%v", err)
+	}
+	const baseURL = "http://cassette.invalid/v1"
+	store := vectorstore.NewInMemoryVectorStore()
+	retriever := embedding.NewRetriever("text-embedding-3-small", baseURL, "test-key", store)
+	retriever.SetHTTPTransport(recorder)
+	agent := NewAgent(AgentConfig{SystemPrompt: "你是一个会使用工具的助手"}, func() types.ChatClient {
+		client := chat.NewOpenAIClient("test-key", baseURL, "gpt-4o-mini", nil, "", "")
+		client.SetHTTPTransport(recorder)
+		return client
+	}, retriever, store)
+	calc := &fakeMCPClient{tools: []types.Tool{{
+		Name:        "add",
+		Description: "两数相加",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"a": map[string]interface{}{"type": "number"},
+				"b": map[string]interface{}{"type": "number"},
+			},
+			"required": []string{"a", "b"},
+		},
+	}}}
+	if err := agent.AddMCPClient("calc", calc); err != nil {
+		t.Fatalf("AddMCPClient失败：%v", err)
+	}
+	ctx := context.Background()
+	if err := agent.AddKnowledge(ctx, []string{"小明有3个苹果", "小红有4个苹果"}); err != nil {
+		t.Fatalf("AddKnowledge失败：%v", err)
+	}
+
+	conv := agent.NewConversation()
+	response, err := agent.Query(ctx, conv, "小明和小红一共有几个苹果？", nil)
+	if err != nil {
+		t.Fatalf("Query失败：%v", err)
+	}
+	if response.Content != "小明和小红一共有7个苹果。" {
+		t.Errorf("回复内容错误：%q", response.Content)
+	}
+	if len(calc.calls) != 1 || calc.calls[0]["a"] != float64(3) || calc.calls[0]["b"] != float64(4) {
+		t.Errorf("工具调用错误：%v", calc.calls)
+	}
+	history := conv.GetMessageHistory()
+	if last := history[len(history)-1]; last.Role != "assistant" || last.Content != response.Content {
+		t.Errorf("最终回复未写入对话历史：%+v", last)
+	}
+}
+
+func TestAgentQueryExecutesToolCalls(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{})
+	calc := &fakeMCPClient{tools: []types.Tool{{
+		Name:        "add",
+		Description: "加法",
+		InputSchema: map[string]interface{}{"type": "object"},
+	}}}
+	if err := agent.AddMCPClient("calc", calc); err != nil {
+		t.Fatalf("AddMCPClient失败：%v", err)
+	}
+
+	server.Enqueue(
+		fakeopenai.Reply{
+			ToolCalls: []fakeopenai.ToolCall{{ID: "call_1", Name: "calc__add", Arguments: `{"a":1,"b":2}`}},
+			Check: func(req openai.ChatCompletionRequest) error {
+				if len(req.Tools) != 1 || req.Tools[0].Function.Name != "calc__add" {
+					return fmt.Errorf("工具列表错误：%+v", req.Tools)
+				}
+				return nil
+			},
+		},
+		fakeopenai.Reply{
+			Content: "结果是3",
+			Check: func(req openai.ChatCompletionRequest) error {
+				last := req.Messages[len(req.Messages)-1]
+				if last.Role != openai.ChatMessageRoleTool || last.ToolCallID != "call_1" || last.Content != "add=3" {
+					return fmt.Errorf("工具结果未写回对话：%+v", last)
+				}
+				return nil
+			},
+		},
+	)
+
+	conv := agent.NewConversation()
+	response, err := agent.Query(context.Background(), conv, "1加2等于几", nil)
+	if err != nil {
+		t.Fatalf("Query失败：%v", err)
+	}
+	if response.Content != "结果是3" {
+		t.Errorf("回复内容错误：%q", response.Content)
+	}
+	if len(calc.calls) != 1 {
+		t.Errorf("期望调用工具1次，实际为%d", len(calc.calls))
+	}
+	if server.Pending() != 0 {
+		t.Errorf("仍有%d条回复未使用", server.Pending())
+	}
+}
+
+func TestAgentQueryRetriesRetryableErrors(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{MaxRetries: 2, Timeout: 10 * time.Second})
+	server.Enqueue(
+		fakeopenai.Reply{StatusCode: http.StatusServiceUnavailable, Error: "overloaded", Header: map[string]string{"Retry-After": "1"}},
+		fakeopenai.Reply{
+			Content: "ok",
+			Check: func(req openai.ChatCompletionRequest) error {
+				//重试前恢复历史，不应重复追加用户消息
+				if len(req.Messages) != 1 {
+					return fmt.Errorf("重试时消息数错误：%d", len(req.Messages))
+				}
+				return nil
+			},
+		},
+	)
+
+	conv := agent.NewConversation()
+	response, err := agent.Query(context.Background(), conv, "hi", nil)
+	if err != nil {
+		t.Fatalf("Query失败：%v", err)
+	}
+	if response.Content != "ok" {
+		t.Errorf("回复内容错误：%q", response.Content)
+	}
+	if len(server.ChatRequests()) != 2 {
+		t.Errorf("期望2次请求，实际为%d", len(server.ChatRequests()))
+	}
+}
+
+func TestAgentQueryRetryDoesNotRepeatToolCalls(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{MaxRetries: 2, Timeout: 10 * time.Second})
+	calc := &fakeMCPClient{tools: []types.Tool{{Name: "add", InputSchema: map[string]interface{}{"type": "object"}}}}
+	if err := agent.AddMCPClient("calc", calc); err != nil {
+		t.Fatalf("AddMCPClient失败：%v", err)
+	}
+	server.Enqueue(
+		fakeopenai.Reply{ToolCalls: []fakeopenai.ToolCall{{ID: "call_1", Name: "calc__add", Arguments: `{"a":1,"b":2}`}}},
+		//工具执行后的最终回复失败，只重试这一次请求
+		fakeopenai.Reply{StatusCode: http.StatusServiceUnavailable, Error: "overloaded", Header: map[string]string{"Retry-After": "1"}},
+		fakeopenai.Reply{
+			Content: "结果是3",
+			Check: func(req openai.ChatCompletionRequest) error {
+				if len(req.Messages) != 3 || req.Messages[2].Role != openai.ChatMessageRoleTool || req.Messages[2].Content != "add=3" {
+					return fmt.Errorf("重试时应保留已执行的工具结果：%+v", req.Messages)
+				}
+				return nil
+			},
+		},
+	)
+
+	conv := agent.NewConversation()
+	response, err := agent.Query(context.Background(), conv, "1加2等于几", nil)
+	if err != nil {
+		t.Fatalf("Query失败：%v", err)
+	}
+	if response.Content != "结果是3" {
+		t.Errorf("回复内容错误：%q", response.Content)
+	}
+	if len(calc.calls) != 1 {
+		t.Errorf("工具应只执行1次，实际为%d次", len(calc.calls))
+	}
+	if len(server.ChatRequests()) != 3 {
+		t.Errorf("期望3次请求，实际为%d", len(server.ChatRequests()))
+	}
+}
+
+func TestAgentQueryDoesNotRetryBadRequest(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{MaxRetries: 3})
+	server.Enqueue(fakeopenai.Reply{StatusCode: http.StatusBadRequest, Error: "invalid"})
+
+	conv := agent.NewConversation()
+	if _, err := agent.Query(context.Background(), conv, "hi", nil); err == nil {
+		t.Fatalf("期望查询失败")
+	}
+	if len(server.ChatRequests()) != 1 {
+		t.Errorf("请求错误不应重试，实际请求%d次", len(server.ChatRequests()))
+	}
+	if history := conv.GetMessageHistory(); len(history) != 0 {
+		t.Errorf("失败后应恢复对话历史：%+v", history)
+	}
+}
+
+func TestAgentQueryRejectsOverBudget(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{Budget: usage.Budget{MaxTokens: 10}})
+	server.Enqueue(fakeopenai.Reply{Content: "ok", Usage: &openai.Usage{PromptTokens: 8, CompletionTokens: 4}})
+
+	conv := agent.NewConversation()
+	if _, err := agent.Query(context.Background(), conv, "hi", nil); err != nil {
+		t.Fatalf("首次查询失败：%v", err)
+	}
+	if _, err := agent.Query(context.Background(), conv, "hi again", nil); err == nil {
+		t.Errorf("超出预算后应拒绝查询")
+	}
+	if len(server.ChatRequests()) != 1 {
+		t.Errorf("超出预算后不应发送请求")
+	}
+}
+
+// 所有调用到齐后才一起返回的MCP客户端，保证并发查询同时处于工具调用阶段
+type barrierMCPClient struct {
+	fakeMCPClient
+	mu      sync.Mutex
+	arrived int
+	want    int
+	release chan struct{}
+}
+
+func (c *barrierMCPClient) CallTool(ctx context.Context, name string, params map[string]interface{}) (*types.MCPToolResult, error) {
+	c.mu.Lock()
+	c.arrived++
+	if c.arrived == c.want {
+		close(c.release)
+	}
+	c.mu.Unlock()
+	select {
+	case <-c.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return types.NewTextToolResult(fmt.Sprintf("%s=%v", name, params["a"].(float64)+params["b"].(float64)), false), nil
+}
+
+// 不同对话的查询并发执行，共享知识库、工具名称与用量统计；配合 go test -race 运行
+func TestAgentParallelQueries(t *testing.T) {
+	const n = 8
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{Timeout: 10 * time.Second})
+	if err := agent.AddKnowledge(context.Background(), []string{"加法满足交换律"}); err != nil {
+		t.Fatalf("AddKnowledge失败：%v", err)
+	}
+	calc := &barrierMCPClient{
+		fakeMCPClient: fakeMCPClient{tools: []types.Tool{{Name: "add", InputSchema: map[string]interface{}{"type": "object"}}}},
+		want:          n,
+		release:       make(chan struct{}),
+	}
+	if err := agent.AddMCPClient("calc", calc); err != nil {
+		t.Fatalf("AddMCPClient失败：%v", err)
+	}
+	//所有查询都在工具调用处等待，因此前n个请求均为首次请求
+	for i := 0; i < n; i++ {
+		server.Enqueue(fakeopenai.Reply{
+			ToolCalls: []fakeopenai.ToolCall{{ID: "call_1", Name: "calc__add", Arguments: `{"a":1,"b":2}`}},
+			Usage:     &openai.Usage{PromptTokens: 10, CompletionTokens: 1},
+		})
+	}
+	for i := 0; i < n; i++ {
+		server.Enqueue(fakeopenai.Reply{
+			Content: "结果是3",
+			Usage:   &openai.Usage{PromptTokens: 10, CompletionTokens: 1},
+		})
+	}
+
+	conversations := make([]*Conversation, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range conversations {
+		conversations[i] = agent.NewConversation()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = agent.Query(context.Background(), conversations[i], fmt.Sprintf("问题%d：1加2等于几", i), nil)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, conv := range conversations {
+		if errs[i] != nil {
+			t.Errorf("第%d个查询失败：%v", i, errs[i])
+			continue
+		}
+		history := conv.GetMessageHistory()
+		if len(history) != 4 {
+			t.Errorf("第%d个对话历史错误：%+v", i, history)
+			continue
+		}
+		//每个对话只包含自己的问题与工具结果
+		if !strings.Contains(history[0].Content, fmt.Sprintf("问题%d：", i)) || history[2].Content != "add=3" || history[3].Content != "结果是3" {
+			t.Errorf("第%d个对话历史错误：%+v", i, history)
+		}
+		if total, _ := conv.Usage(); total.CompletionTokens != 2 {
+			t.Errorf("第%d个对话用量错误：%+v", i, total)
+		}
+	}
+	if total, _ := agent.Usage(); total.CompletionTokens != 2*n {
+		t.Errorf("进程用量错误：%+v", total)
+	}
+	if server.Pending() != 0 {
+		t.Errorf("还有%d个回复未使用", server.Pending())
+	}
+}
+
+func TestAgentForwardsAllToolResultParts(t *testing.T) {
+	mixed := &types.MCPToolResult{Content: []types.MCPContent{
+		{Type: types.MCPContentText, Text: "截图如下"},
+		{Type: types.MCPContentImage, Data: "iVBORw0KGgo=", MIMEType: "image/png"},
+		{Type: types.MCPContentAudio, Data: "AAAA", MIMEType: "audio/wav"},
+		{Type: types.MCPContentResourceLink, URI: "file:///tmp/report.pdf", Name: "report"},
+		{Type: types.MCPContentResource, URI: "file:///tmp/notes.txt", Text: "笔记内容"},
+	}}
+
+	for _, vision := range []bool{true, false} {
+		t.Run(fmt.Sprintf("vision=%v", vision), func(t *testing.T) {
+			server := fakeopenai.NewServer(t)
+			agent := newTestAgent(t, server, AgentConfig{Vision: vision})
+			screen := &fakeMCPClient{
+				tools:  []types.Tool{{Name: "capture", InputSchema: map[string]interface{}{"type": "object"}}},
+				result: mixed,
+			}
+			if err := agent.AddMCPClient("screen", screen); err != nil {
+				t.Fatalf("AddMCPClient失败：%v", err)
+			}
+			server.Enqueue(
+				fakeopenai.Reply{ToolCalls: []fakeopenai.ToolCall{{ID: "call_1", Name: "screen__capture", Arguments: `{}`}}},
+				fakeopenai.Reply{
+					Content: "完成",
+					Check: func(req openai.ChatCompletionRequest) error {
+						var tool openai.ChatCompletionMessage
+						for _, msg := range req.Messages {
+							if msg.Role == openai.ChatMessageRoleTool {
+								tool = msg
+							}
+						}
+						for _, want := range []string{"截图如下", "audio/wav", "file:///tmp/report.pdf", "笔记内容"} {
+							if !strings.Contains(tool.Content, want) {
+								return fmt.Errorf("工具结果缺少%q：%q", want, tool.Content)
+							}
+						}
+						last := req.Messages[len(req.Messages)-1]
+						hasImage := len(last.MultiContent) == 2 && last.MultiContent[1].ImageURL != nil &&
+							last.MultiContent[1].ImageURL.URL == "data:image/png;base64,iVBORw0KGgo="
+						if hasImage != vision {
+							return fmt.Errorf("图片转发错误（vision=%v）：%+v", vision, last)
+						}
+						return nil
+					},
+				},
+			)
+			if _, err := agent.Query(context.Background(), agent.NewConversation(), "截个图", nil); err != nil {
+				t.Fatalf("Query失败：%v", err)
+			}
+		})
+	}
+}
+
+func TestAgentTruncatesLargeToolResults(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	spillDir := t.TempDir()
+	agent := newTestAgent(t, server, AgentConfig{ToolResults: ToolResultLimits{
+		MaxChars: 1000,
+		PerTool:  map[string]int{"logs.dump": 20},
+		SpillDir: spillDir,
+	}})
+	full := "开头" + strings.Repeat("中", 100) + "结尾"
+	logs := &fakeMCPClient{
+		tools:  []types.Tool{{Name: "dump", InputSchema: map[string]interface{}{"type": "object"}}},
+		result: types.NewTextToolResult(full, false),
+	}
+	if err := agent.AddMCPClient("logs", logs); err != nil {
+		t.Fatalf("AddMCPClient失败：%v", err)
+	}
+
+	var handle string
+	server.Enqueue(
+		fakeopenai.Reply{
+			ToolCalls: []fakeopenai.ToolCall{{ID: "call_1", Name: "logs__dump", Arguments: `{}`}},
+			Check: func(req openai.ChatCompletionRequest) error {
+				for _, tool := range req.Tools {
+					if tool.Function.Name == "agent__read_tool_result" {
+						return nil
+					}
+				}
+				return fmt.Errorf("配置溢出目录后应提供%s工具", readToolResultTool)
+			},
+		},
+		fakeopenai.Reply{
+			Content: "日志很长",
+			Check: func(req openai.ChatCompletionRequest) error {
+				result := req.Messages[len(req.Messages)-1].Content
+				if !strings.HasPrefix(result, "开头") || !strings.Contains(result, "结尾") || !strings.Contains(result, "已截断") {
+					return fmt.Errorf("截断结果错误：%q", result)
+				}
+				if strings.Contains(result, full) {
+					return fmt.Errorf("结果未被截断")
+				}
+				fields := strings.Fields(result[strings.Index(result, "句柄为"):])
+				if len(fields) < 2 {
+					return fmt.Errorf("缺少句柄：%q", result)
+				}
+				handle = fields[1]
+				return nil
+			},
+		},
+	)
+	if _, err := agent.Query(context.Background(), agent.NewConversation(), "看看日志", nil); err != nil {
+		t.Fatalf("Query失败：%v", err)
+	}
+
+	result, err := agent.readToolResult(fmt.Sprintf(`{"handle":%q,"offset":0,"length":5000}`, handle))
+	if err != nil {
+		t.Fatalf("读取完整结果失败：%v", err)
+	}
+	if !strings.HasSuffix(result.Content[0].Text, full) {
+		t.Errorf("完整结果错误：%q", result.Content[0].Text)
+	}
+	if _, err := agent.readToolResult(`{"handle":"../secret"}`); err == nil {
+		t.Errorf("应拒绝非法句柄")
+	}
+}
+
+func TestAgentToolApprovalPolicy(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   ToolPolicy
+		approved bool
+		calls    int
+		asked    int
+	}{
+		{name: "allow", policy: ToolPolicy{}, calls: 1},
+		{name: "deny", policy: ToolPolicy{Tools: map[string]ApprovalPolicy{"add": ApprovalDeny}}, calls: 0},
+		{name: "ask-approved", policy: ToolPolicy{Default: ApprovalAsk}, approved: true, calls: 1, asked: 1},
+		{name: "ask-rejected", policy: ToolPolicy{Default: ApprovalAsk}, approved: false, calls: 0, asked: 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := fakeopenai.NewServer(t)
+			asked := 0
+			agent := newTestAgent(t, server, AgentConfig{
+				Approve: func(ctx context.Context, request ApprovalRequest) (bool, error) {
+					asked++
+					if request.Server != "calc" || request.Tool != "add" || request.Arguments["a"] != float64(1) {
+						t.Errorf("审批请求错误：%+v", request)
+					}
+					return tc.approved, nil
+				},
+			})
+			calc := &fakeMCPClient{tools: []types.Tool{{Name: "add", InputSchema: map[string]interface{}{"type": "object"}}}}
+			if err := agent.AddMCPClient("calc", calc); err != nil {
+				t.Fatalf("AddMCPClient失败：%v", err)
+			}
+			agent.SetToolPolicy("calc", tc.policy)
+			server.Enqueue(
+				fakeopenai.Reply{ToolCalls: []fakeopenai.ToolCall{{ID: "call_1", Name: "calc__add", Arguments: `{"a":1,"b":2}`}}},
+				fakeopenai.Reply{Content: "done"},
+			)
+			if _, err := agent.Query(context.Background(), agent.NewConversation(), "1+2", nil); err != nil {
+				t.Fatalf("Query失败：%v", err)
+			}
+			if len(calc.calls) != tc.calls || asked != tc.asked {
+				t.Errorf("期望执行%d次、审批%d次，实际为%d次、%d次", tc.calls, tc.asked, len(calc.calls), asked)
+			}
+		})
+	}
+}
+
+func TestAgentApprovalWaitExcludedFromTimeout(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{
+		Timeout: 200 * time.Millisecond,
+		Approve: func(ctx context.Context, request ApprovalRequest) (bool, error) {
+			//用户思考的时间超过查询超时
+			select {
+			case <-time.After(400 * time.Millisecond):
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < 0 {
+				t.Errorf("等待审批期间查询已超时")
+			}
+			return true, nil
+		},
+	})
+	calc := &fakeMCPClient{tools: []types.Tool{{Name: "add", InputSchema: map[string]interface{}{"type": "object"}}}}
+	if err := agent.AddMCPClient("calc", calc); err != nil {
+		t.Fatalf("AddMCPClient失败：%v", err)
+	}
+	agent.SetToolPolicy("calc", ToolPolicy{Default: ApprovalAsk})
+	server.Enqueue(
+		fakeopenai.Reply{ToolCalls: []fakeopenai.ToolCall{{ID: "call_1", Name: "calc__add", Arguments: `{"a":1,"b":2}`}}},
+		fakeopenai.Reply{Content: "结果是3"},
+	)
+	response, err := agent.Query(context.Background(), agent.NewConversation(), "1+2", nil)
+	if err != nil {
+		t.Fatalf("审批等待不应计入超时：%v", err)
+	}
+	if response.Content != "结果是3" || len(calc.calls) != 1 {
+		t.Errorf("审批后应执行工具并返回回复：%q，调用%d次", response.Content, len(calc.calls))
+	}
+}
+
+// 工具执行期间向宿主请求用户输入或模型采样的MCP客户端，
+// 与真实服务一样，请求使用与工具调用无关的context
+type promptingMCPClient struct {
+	fakeMCPClient
+	elicit types.ElicitationHandler
+	sample types.SamplingHandler
+}
+
+func (c *promptingMCPClient) SetElicitationHandler(handler types.ElicitationHandler) {
+	c.elicit = handler
+}
+
+func (c *promptingMCPClient) SetSamplingHandler(handler types.SamplingHandler) {
+	c.sample = handler
+}
+
+func (c *promptingMCPClient) CallTool(ctx context.Context, name string, params map[string]interface{}) (*types.MCPToolResult, error) {
+	c.calls = append(c.calls, params)
+	if name == "ask" {
+		result, err := c.elicit(context.Background(), types.ElicitationRequest{Server: "form", Message: "请输入姓名"})
+		if err != nil {
+			return nil, err
+		}
+		return types.NewTextToolResult(fmt.Sprint(result.Content["name"]), false), nil
+	}
+	result, err := c.sample(context.Background(), types.SamplingRequest{Server: "form", Messages: []types.ChatMessage{{Role: "user", Content: "写一句诗"}}})
+	if err != nil {
+		return nil, err
+	}
+	return types.NewTextToolResult(result.Content, false), nil
+}
+
+// 用户思考的时间超过查询超时
+func slowUser(ctx context.Context) error {
+	select {
+	case <-time.After(400 * time.Millisecond):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+func TestAgentUserPromptsExcludedFromTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		tool    string
+		replies []fakeopenai.Reply
+	}{
+		{"填写表单", "ask", nil},
+		{"确认模型采样", "poem", []fakeopenai.Reply{{Content: "床前明月光"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakeopenai.NewServer(t)
+			agent := newTestAgent(t, server, AgentConfig{
+				Timeout: 200 * time.Millisecond,
+				Elicit: func(ctx context.Context, request types.ElicitationRequest) (*types.ElicitationResult, error) {
+					if err := slowUser(ctx); err != nil {
+						return nil, err
+					}
+					return &types.ElicitationResult{Action: types.ElicitAccept, Content: map[string]interface{}{"name": "张三"}}, nil
+				},
+				Sampling: SamplingConfig{Approve: func(ctx context.Context, request types.SamplingRequest) (bool, error) {
+					return slowUser(ctx) == nil, nil
+				}},
+			})
+			form := &promptingMCPClient{fakeMCPClient: fakeMCPClient{tools: []types.Tool{{Name: tt.tool, InputSchema: map[string]interface{}{"type": "object"}}}}}
+			if err := agent.AddMCPClient("form", form); err != nil {
+				t.Fatalf("AddMCPClient失败：%v", err)
+			}
+			server.Enqueue(fakeopenai.Reply{ToolCalls: []fakeopenai.ToolCall{{ID: "call_1", Name: "form__" + tt.tool, Arguments: `{}`}}})
+			server.Enqueue(tt.replies...)
+			server.Enqueue(fakeopenai.Reply{Content: "完成"})
+
+			response, err := agent.Query(context.Background(), agent.NewConversation(), "开始", nil)
+			if err != nil {
+				t.Fatalf("等待用户操作不应计入超时：%v", err)
+			}
+			if response.Content != "完成" {
+				t.Errorf("回复错误：%q", response.Content)
+			}
+			if len(agent.inflight["form"]) != 0 {
+				t.Errorf("工具调用结束后应移除记录")
+			}
+		})
+	}
+}
+
+func TestAgentUserPromptCanceledWithQuery(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	promptErr := make(chan error, 1)
+	agent := newTestAgent(t, server, AgentConfig{
+		Timeout: time.Minute,
+		Elicit: func(promptCtx context.Context, request types.ElicitationRequest) (*types.ElicitationResult, error) {
+			//用户取消查询后，尚未完成的输入提示随之结束
+			cancel()
+			select {
+			case <-promptCtx.Done():
+				promptErr <- promptCtx.Err()
+			case <-time.After(5 * time.Second):
+				promptErr <- nil
+			}
+			return nil, promptCtx.Err()
+		},
+	})
+	form := &promptingMCPClient{fakeMCPClient: fakeMCPClient{tools: []types.Tool{{Name: "ask", InputSchema: map[string]interface{}{"type": "object"}}}}}
+	if err := agent.AddMCPClient("form", form); err != nil {
+		t.Fatalf("AddMCPClient失败：%v", err)
+	}
+	server.Enqueue(fakeopenai.Reply{ToolCalls: []fakeopenai.ToolCall{{ID: "call_1", Name: "form__ask", Arguments: `{}`}}})
+	if _, err := agent.Query(ctx, agent.NewConversation(), "开始", nil); err == nil {
+		t.Fatal("查询取消后应返回错误")
+	}
+	if err := <-promptErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("查询取消后输入提示应被取消：%v", err)
+	}
+}
+
+func TestPausableTimeout(t *testing.T) {
+	ctx, cancel := withPausableTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	resume := pauseTimeout(ctx)
+	time.Sleep(100 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Fatalf("暂停期间不应超时：%v", ctx.Err())
+	}
+	resume()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("恢复计时后应超时")
+	}
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Errorf("超时错误应为DeadlineExceeded：%v", ctx.Err())
+	}
+
+	parent, cancelParent := context.WithCancel(context.Background())
+	child, cancelChild := withPausableTimeout(parent, time.Minute)
+	defer cancelChild()
+	cancelParent()
+	<-child.Done()
+	if !errors.Is(child.Err(), context.Canceled) {
+		t.Errorf("父context取消后应返回Canceled：%v", child.Err())
+	}
+}
+
+func TestAgentPicksUpToolListChanges(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{})
+	calc := &fakeMCPClient{tools: []types.Tool{{Name: "add", InputSchema: map[string]interface{}{"type": "object"}}}}
+	if err := agent.AddMCPClient("calc", calc); err != nil {
+		t.Fatalf("AddMCPClient失败：%v", err)
+	}
+	expectTools := func(want ...string) fakeopenai.Reply {
+		return fakeopenai.Reply{
+			Content: "好的",
+			Check: func(req openai.ChatCompletionRequest) error {
+				var got []string
+				for _, tool := range req.Tools {
+					got = append(got, tool.Function.Name)
+				}
+				if strings.Join(got, ",") != strings.Join(want, ",") {
+					return fmt.Errorf("工具列表错误：%v", got)
+				}
+				return nil
+			},
+		}
+	}
+
+	conv := agent.NewConversation()
+	server.Enqueue(expectTools("calc__add"))
+	if _, err := agent.Query(context.Background(), conv, "第一轮", nil); err != nil {
+		t.Fatalf("Query失败：%v", err)
+	}
+	//服务端工具列表变化后，下一轮使用新的工具列表
+	calc.tools = []types.Tool{{Name: "sub", InputSchema: map[string]interface{}{"type": "object"}}}
+	server.Enqueue(expectTools("calc__sub"))
+	if _, err := agent.Query(context.Background(), conv, "第二轮", nil); err != nil {
+		t.Fatalf("Query失败：%v", err)
+	}
+}
+
+// 提供资源的fake mcp客户端
+type fakeResourceClient struct {
+	fakeMCPClient
+	text      string
+	subscribe []string
+	updated   func(uri string)
+}
+
+func (c *fakeResourceClient) ListResources(ctx context.Context) ([]types.MCPResource, error) {
+	return []types.MCPResource{{URI: "docs://guide", Name: "guide"}}, nil
+}
+
+func (c *fakeResourceClient) ListResourceTemplates(ctx context.Context) ([]types.MCPResourceTemplate, error) {
+	return nil, nil
+}
+
+func (c *fakeResourceClient) ReadResource(ctx context.Context, uri string) ([]types.MCPContent, error) {
+	return []types.MCPContent{{Type: types.MCPContentResource, URI: uri, Text: c.text}}, nil
+}
+
+func (c *fakeResourceClient) Subscribe(ctx context.Context, uri string) error {
+	c.subscribe = append(c.subscribe, uri)
+	return nil
+}
+
+func (c *fakeResourceClient) Unsubscribe(ctx context.Context, uri string) error { return nil }
+func (c *fakeResourceClient) OnResourceUpdated(handler func(uri string))        { c.updated = handler }
+
+func TestAgentIngestResource(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{})
+	docs := &fakeResourceClient{text: "旧版说明"}
+	if err := agent.AddMCPClient("docs", docs); err != nil {
+		t.Fatalf("AddMCPClient失败：%v", err)
+	}
+	if err := agent.AddKnowledge(context.Background(), []string{"无关文档"}); err != nil {
+		t.Fatalf("AddKnowledge失败：%v", err)
+	}
+	if err := agent.IngestResource(context.Background(), "docs", "docs://guide"); err != nil {
+		t.Fatalf("IngestResource失败：%v", err)
+	}
+	if len(docs.subscribe) != 1 || docs.updated == nil {
+		t.Fatalf("未订阅资源更新：%v", docs.subscribe)
+	}
+
+	//资源更新后替换旧内容，其他文档保持不变
+	docs.text = "新版说明"
+	docs.updated("docs://guide")
+	store := agent.vectorStore.(*vectorstore.InMemoryVectorStore)
+	documents := strings.Join(store.GetAllDocuments(), "|")
+	if store.Size() != 2 || !strings.Contains(documents, "新版说明") || strings.Contains(documents, "旧版说明") || !strings.Contains(documents, "无关文档") {
+		t.Errorf("重新导入后的知识库错误：%s", documents)
+	}
+
+	if err := agent.IngestResource(context.Background(), "missing", "docs://guide"); err == nil {
+		t.Error("不存在的mcp client应返回错误")
+	}
+}
+
+// 提供提示词的fake mcp客户端
+type fakePromptClient struct {
+	fakeMCPClient
+	messages  []types.ChatMessage
+	arguments map[string]string
+}
+
+func (c *fakePromptClient) ListPrompts(ctx context.Context) ([]types.MCPPrompt, error) {
+	return []types.MCPPrompt{{Name: "review"}}, nil
+}
+
+func (c *fakePromptClient) GetPrompt(ctx context.Context, name string, arguments map[string]string) ([]types.ChatMessage, error) {
+	c.arguments = arguments
+	return c.messages, nil
+}
+
+func TestAgentRunPrompt(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{})
+	review := &fakePromptClient{messages: []types.ChatMessage{
+		{Role: "user", Content: "你是代码审查员"},
+		{Role: "assistant", Content: "好的"},
+		{Role: "user", Content: "请审查main.go"},
+	}}
+	if err := agent.AddMCPClient("review", review); err != nil {
+		t.Fatalf("AddMCPClient失败：%v", err)
+	}
+
+	server.Enqueue(fakeopenai.Reply{
+		Content: "没有问题",
+		Check: func(req openai.ChatCompletionRequest) error {
+			n := len(req.Messages)
+			if n < 3 || req.Messages[n-3].Content != "你是代码审查员" || req.Messages[n-2].Content != "好的" {
+				return fmt.Errorf("提示词消息未注入对话：%+v", req.Messages)
+			}
+			if !strings.Contains(req.Messages[n-1].Content, "请审查main.go") {
+				return fmt.Errorf("最后一条用户消息未作为查询发送：%q", req.Messages[n-1].Content)
+			}
+			return nil
+		},
+	})
+	conv := agent.NewConversation()
+	response, err := agent.RunPrompt(context.Background(), conv, "review", "review", map[string]string{"file": "main.go"}, nil)
+	if err != nil {
+		t.Fatalf("RunPrompt失败：%v", err)
+	}
+	if response == nil || response.Content != "没有问题" || review.arguments["file"] != "main.go" {
+		t.Errorf("运行提示词结果错误：%+v，参数%v", response, review.arguments)
+	}
+
+	//末尾不是用户消息时只注入，不发送查询
+	review.messages = []types.ChatMessage{{Role: "assistant", Content: "请提供文件"}}
+	before := len(conv.GetMessageHistory())
+	response, err = agent.RunPrompt(context.Background(), conv, "review", "review", nil, nil)
+	if err != nil || response != nil {
+		t.Fatalf("只注入消息时应返回nil：%+v，%v", response, err)
+	}
+	if len(conv.GetMessageHistory()) != before+1 {
+		t.Errorf("消息未注入对话历史")
+	}
+}
+
+// 提示词查询失败时只撤销本次注入的消息，不影响同一对话中随后完成的查询
+func TestAgentRunPromptFailureKeepsConcurrentQuery(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{})
+	review := &fakePromptClient{messages: []types.ChatMessage{
+		{Role: "user", Content: "你是代码审查员"},
+		{Role: "assistant", Content: "好的"},
+		{Role: "user", Content: "请审查main.go"},
+	}}
+	if err := agent.AddMCPClient("review", review); err != nil {
+		t.Fatalf("AddMCPClient失败：%v", err)
+	}
+	entered, release := make(chan struct{}), make(chan struct{})
+	server.Enqueue(
+		fakeopenai.Reply{
+			StatusCode: http.StatusBadRequest,
+			Error:      "invalid request",
+			Check: func(req openai.ChatCompletionRequest) error {
+				close(entered)
+				<-release
+				return nil
+			},
+		},
+		fakeopenai.Reply{Content: "4"},
+	)
+
+	conv := agent.NewConversation()
+	promptErr := make(chan error, 1)
+	go func() {
+		_, err := agent.RunPrompt(context.Background(), conv, "review", "review", nil, nil)
+		promptErr <- err
+	}()
+	<-entered
+	queryErr := make(chan error, 1)
+	go func() {
+		_, err := agent.Query(context.Background(), conv, "2+2等于几", nil)
+		queryErr <- err
+	}()
+	close(release)
+	if err := <-promptErr; err == nil {
+		t.Fatal("提示词查询应失败")
+	}
+	if err := <-queryErr; err != nil {
+		t.Fatalf("Query失败：%v", err)
+	}
+
+	var contents []string
+	for _, msg := range conv.GetMessageHistory() {
+		contents = append(contents, msg.Role+":"+msg.Content)
+	}
+	got := strings.Join(contents, "|")
+	if strings.Contains(got, "代码审查员") || !strings.Contains(got, "2+2等于几") || !strings.HasSuffix(got, "assistant:4") {
+		t.Errorf("对话历史错误：%s", got)
+	}
+}
+
+func TestAgentSampling(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	var miniCreated bool
+	agent := newTestAgent(t, server, AgentConfig{Sampling: SamplingConfig{
+		MaxTokens: 50,
+		Models: []SamplingModel{{Name: "gpt-mini", NewChatClient: func() types.ChatClient {
+			miniCreated = true
+			return chat.NewOpenAIClient("test-key", server.URL, "gpt-mini", nil, "", "")
+		}}},
+	}})
+	request := types.SamplingRequest{
+		Server:       "writer",
+		Messages:     []types.ChatMessage{{Role: "user", Content: "总结这段文字"}},
+		SystemPrompt: "你是摘要助手",
+		MaxTokens:    200,
+		ModelHints:   []string{"claude", "mini"},
+	}
+
+	//默认策略为 ask，未设置审批回调时拒绝
+	if _, err := agent.sample(context.Background(), request); err == nil {
+		t.Fatal("未设置审批回调时应拒绝采样")
+	}
+	agent.SetSamplingPolicy("writer", ApprovalDeny)
+	if _, err := agent.sample(context.Background(), request); err == nil {
+		t.Fatal("策略为 deny 时应拒绝采样")
+	}
+
+	agent.SetSamplingPolicy("writer", ApprovalAllow)
+	server.Enqueue(fakeopenai.Reply{
+		Content: "摘要",
+		Check: func(req openai.ChatCompletionRequest) error {
+			if req.Model != "gpt-mini" || req.MaxTokens != 50 || len(req.Tools) != 0 {
+				return fmt.Errorf("采样请求参数错误：model=%s max_tokens=%d tools=%d", req.Model, req.MaxTokens, len(req.Tools))
+			}
+			if len(req.Messages) != 2 || req.Messages[0].Content != "你是摘要助手" || req.Messages[1].Content != "总结这段文字" {
+				return fmt.Errorf("采样消息错误：%+v", req.Messages)
+			}
+			return nil
+		},
+	})
+	result, err := agent.sample(context.Background(), request)
+	if err != nil {
+		t.Fatalf("采样失败：%v", err)
+	}
+	if !miniCreated || result.Content != "摘要" || result.Model == "" || result.StopReason != "endTurn" {
+		t.Errorf("采样结果错误：%+v", result)
+	}
+
+	//达到token上限时如实返回结束原因
+	server.Enqueue(fakeopenai.Reply{Content: "摘", Finish: openai.FinishReasonLength})
+	result, err = agent.sample(context.Background(), request)
+	if err != nil {
+		t.Fatalf("采样失败：%v", err)
+	}
+	if result.StopReason != "maxTokens" {
+		t.Errorf("结束原因错误：%q", result.StopReason)
+	}
+	//无法对应的结束原因留空
+	server.Enqueue(fakeopenai.Reply{Content: "", Finish: openai.FinishReasonContentFilter})
+	if result, err = agent.sample(context.Background(), request); err != nil || result.StopReason != "" {
+		t.Errorf("结束原因应为空：%+v %v", result, err)
+	}
+}
+
+func TestToolNameRegistry(t *testing.T) {
+	valid := regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+	registry := newToolNameRegistry()
+	refs := []toolRef{
+		{Server: "calc", Tool: "add"},
+		{Server: "a__b", Tool: "c"},
+		{Server: "a", Tool: "b__c"},
+		{Server: "fs.v2", Tool: "read file"},
+		{Server: "fs_v2", Tool: "read_file"},
+		{Server: strings.Repeat("s", 40), Tool: strings.Repeat("t", 40)},
+		{Server: strings.Repeat("s", 40), Tool: strings.Repeat("t", 41)},
+	}
+	names := make(map[string]bool)
+	for _, ref := range refs {
+		name := registry.name(ref)
+		if !valid.MatchString(name) {
+			t.Errorf("%s 的工具名不合法：%q", ref, name)
+		}
+		if names[name] {
+			t.Errorf("%s 的工具名重复：%q", ref, name)
+		}
+		names[name] = true
+		if got, ok := registry.resolve(name); !ok || got != ref {
+			t.Errorf("%q 解析为 %v，期望 %v", name, got, ref)
+		}
+		if again := registry.name(ref); again != name {
+			t.Errorf("%s 的工具名不稳定：%q 与 %q", ref, name, again)
+		}
+	}
+	if name := registry.name(toolRef{Server: "calc", Tool: "add"}); name != "calc__add" {
+		t.Errorf("合法的短名称应保持可读：%q", name)
+	}
+	if _, ok := registry.resolve("calc.add"); ok {
+		t.Error("未分配的名称不应被解析")
+	}
+}
+
+func TestAgentReservesBuiltinNamespace(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{})
+	fake := &fakeMCPClient{tools: []types.Tool{{Name: "read_tool_result"}}}
+	if err := agent.AddMCPClient(builtinServer, fake); err == nil {
+		t.Fatalf("名称为%s的mcp服务应被拒绝", builtinServer)
+	}
+}
+
+func TestAgentMapsToolChoiceInAllQueries(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{Generation: types.GenerationOptions{ToolChoice: "calc.add"}})
+	calc := &fakeMCPClient{tools: []types.Tool{{Name: "add", InputSchema: map[string]interface{}{"type": "object"}}}}
+	if err := agent.AddMCPClient("calc", calc); err != nil {
+		t.Fatalf("AddMCPClient失败：%v", err)
+	}
+	checkChoice := func(req openai.ChatCompletionRequest) error {
+		data, _ := json.Marshal(req.ToolChoice)
+		if !strings.Contains(string(data), `"name":"calc__add"`) {
+			return fmt.Errorf("工具选择未转换为模型侧名称：%s", data)
+		}
+		return nil
+	}
+	server.Enqueue(
+		fakeopenai.Reply{Content: "好的", Check: checkChoice},
+		fakeopenai.Reply{Content: `{"answer":3}`, Check: checkChoice},
+	)
+	if _, err := agent.Query(context.Background(), agent.NewConversation(), "1+2", nil); err != nil {
+		t.Fatalf("Query失败：%v", err)
+	}
+	var out struct {
+		Answer int `json:"answer"`
+	}
+	if err := agent.QueryStructured(context.Background(), agent.NewConversation(), "1+2", &out, StructuredOutput{}, nil); err != nil {
+		t.Fatalf("QueryStructured失败：%v", err)
+	}
+	if out.Answer != 3 {
+		t.Errorf("结构化结果错误：%+v", out)
+	}
+}
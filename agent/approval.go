@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/utils"
+)
+
+// 工具调用审批策略
+type ApprovalPolicy string
+
+const (
+	ApprovalAllow ApprovalPolicy = "allow" // 直接执行
+	ApprovalAsk   ApprovalPolicy = "ask"   // 执行前请求确认
+	ApprovalDeny  ApprovalPolicy = "deny"  // 拒绝执行
+)
+
+// 一个MCP服务的审批策略
+type ToolPolicy struct {
+	Default ApprovalPolicy            // 为空时为 allow
+	Tools   map[string]ApprovalPolicy // 按工具名覆盖
+}
+
+// 返回指定工具的策略
+func (p ToolPolicy) For(tool string) ApprovalPolicy {
+	if policy, ok := p.Tools[tool]; ok && policy != "" {
+		return policy
+	}
+	if p.Default != "" {
+		return p.Default
+	}
+	return ApprovalAllow
+}
+
+// 待审批的工具调用
+type ApprovalRequest struct {
+	Server    string
+	Tool      string
+	Arguments map[string]interface{}
+}
+
+// 审批回调，返回 true 表示允许执行；未设置回调时需要确认的调用一律拒绝。
+// 等待回调的时间不计入查询超时，ctx 被取消时回调应返回 ctx.Err()
+type ApprovalFunc func(ctx context.Context, request ApprovalRequest) (bool, error)
+
+// 设置MCP服务的审批策略
+func (a *Agent) SetToolPolicy(server string, policy ToolPolicy) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.policies[server] = policy
+}
+
+// 设置审批回调，用于CLI之外的嵌入场景
+func (a *Agent) SetApprovalFunc(approve ApprovalFunc) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.approve = approve
+}
+
+// 根据策略决定是否执行工具调用
+func (a *Agent) checkApproval(ctx context.Context, request ApprovalRequest) error {
+	a.mu.RLock()
+	policy := a.policies[request.Server].For(request.Tool)
+	approve := a.approve
+	a.mu.RUnlock()
+
+	switch policy {
+	case ApprovalAllow:
+		return nil
+	case ApprovalDeny:
+		return fmt.Errorf("工具%s.%s已被策略禁止执行", request.Server, request.Tool)
+	}
+	if approve == nil {
+		return fmt.Errorf("工具%s.%s需要确认，但未设置审批回调", request.Server, request.Tool)
+	}
+	//等待用户确认期间暂停查询超时，用户取消查询时审批回调应尽快返回
+	resume := pauseTimeout(ctx)
+	approved, err := approve(ctx, request)
+	resume()
+	if err != nil {
+		return fmt.Errorf("请求审批失败：%w", err)
+	}
+	if !approved {
+		utils.LogInfo(fmt.Sprintf("用户拒绝执行工具%s.%s", request.Server, request.Tool))
+		return fmt.Errorf("用户拒绝执行工具%s.%s", request.Server, request.Tool)
+	}
+	return nil
+}
+
+// 将mcp服务的用户输入请求交给 elicitation 回调，等待用户填写期间暂停查询超时
+func (a *Agent) elicitInput(ctx context.Context, request types.ElicitationRequest) (*types.ElicitationResult, error) {
+	ctx, done := a.waitForUser(ctx, request.Server)
+	defer done()
+	return a.elicit(ctx, request)
+}
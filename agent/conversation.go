@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"fmt"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/usage"
+	"llm-mcp-rag-simple/utils"
+	"sync"
+)
+
+// 对话：持有独立的消息历史、系统提示词与上下文，
+// 与所属Agent共享检索器、向量存储和MCP客户端
+type Conversation struct {
+	chatClient   types.ChatClient
+	systemPrompt string
+	context      string
+	usage        *usage.Meter // 对话累计用量
+	prices       usage.PriceTable
+	mu           sync.Mutex // 串行化同一对话内的查询与历史操作
+}
+
+// 创建新对话，使用Agent当前的系统提示词和上下文
+func (a *Agent) NewConversation() *Conversation {
+	a.mu.RLock()
+	systemPrompt := a.systemPrompt
+	context := a.context
+	a.mu.RUnlock()
+
+	conv := &Conversation{
+		chatClient:   a.newChatClient(),
+		systemPrompt: systemPrompt,
+		context:      context,
+		usage:        usage.NewMeter(),
+		prices:       a.prices,
+	}
+	//设置系统提示词和上下文
+	if systemPrompt != "" {
+		conv.chatClient.SetSystemPrompt(systemPrompt)
+	}
+	if context != "" {
+		conv.chatClient.SetContext(context)
+	}
+	return conv
+}
+
+// 返回对话累计用量与按模型的明细
+func (c *Conversation) Usage() (types.Usage, []usage.ModelUsage) {
+	return c.prices.Total(c.usage), c.prices.Report(c.usage)
+}
+
+// 返回对话各模型的用量，用于随会话保存
+func (c *Conversation) UsageByModel() map[string]types.Usage {
+	return c.usage.ByModel()
+}
+
+// 恢复已保存的对话用量，nil 表示清零
+func (c *Conversation) LoadUsage(byModel map[string]types.Usage) {
+	c.usage.Reset(byModel)
+}
+
+// 返回聊天消息历史
+func (c *Conversation) GetMessageHistory() []types.ChatMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.chatClient.GetMessageHistory()
+}
+
+// 恢复已保存的对话历史
+func (c *Conversation) LoadHistory(messages []types.ChatMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chatClient.SetMessageHistory(messages)
+	utils.LogInfo(fmt.Sprintf("已恢复%d条历史消息", len(messages)))
+}
+
+// 在对话历史末尾追加消息，如mcp提示词渲染出的消息
+func (c *Conversation) AppendMessages(messages []types.ChatMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	history := c.chatClient.GetMessageHistory()
+	c.chatClient.SetMessageHistory(append(history, messages...))
+}
+
+// 清除对话历史
+func (c *Conversation) ClearHistory() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chatClient.ClearHistory()
+	utils.LogInfo(fmt.Sprintf("对话历史已清除"))
+}
+
+// 更新系统提示词
+func (c *Conversation) SetSystemPrompt(prompt string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.systemPrompt = prompt
+	c.chatClient.SetSystemPrompt(prompt)
+
+	utils.LogInfo(fmt.Sprintf("系统提示词已更新"))
+}
+
+// 更新上下文信息
+func (c *Conversation) SetContext(context string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.context = context
+	c.chatClient.SetContext(context)
+
+	utils.LogInfo(fmt.Sprintf("上下文信息已更新"))
+}
@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"llm-mcp-rag-simple/types"
+)
+
+// 返回记录服务日志的mcp客户端
+func (a *Agent) logClient(server string) (types.MCPLogClient, error) {
+	a.mu.RLock()
+	client, exists := a.mcpClients[server]
+	a.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("mcp client不存在：%s", server)
+	}
+	logs, ok := client.(types.MCPLogClient)
+	if !ok {
+		return nil, fmt.Errorf("mcp client【%s】不支持日志", server)
+	}
+	return logs, nil
+}
+
+// 返回mcp服务最近的日志，包括stderr输出、日志通知与工具调用进度
+func (a *Agent) MCPLogs(server string, limit int) ([]types.MCPLogEntry, error) {
+	client, err := a.logClient(server)
+	if err != nil {
+		return nil, err
+	}
+	return client.Logs(limit), nil
+}
+
+// 设置mcp服务发送日志通知的最低级别
+func (a *Agent) SetMCPLogLevel(ctx context.Context, server, level string) error {
+	client, err := a.logClient(server)
+	if err != nil {
+		return err
+	}
+	return client.SetLogLevel(ctx, level)
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"llm-mcp-rag-simple/types"
+	"strings"
+)
+
+// 返回支持提示词的mcp客户端
+func (a *Agent) promptClient(server string) (types.MCPPromptClient, error) {
+	a.mu.RLock()
+	client, exists := a.mcpClients[server]
+	a.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("mcp client不存在：%s", server)
+	}
+	prompts, ok := client.(types.MCPPromptClient)
+	if !ok {
+		return nil, fmt.Errorf("mcp client【%s】不支持提示词", server)
+	}
+	return prompts, nil
+}
+
+// 列出mcp服务提供的提示词模板
+func (a *Agent) ListPrompts(ctx context.Context, server string) ([]types.MCPPrompt, error) {
+	client, err := a.promptClient(server)
+	if err != nil {
+		return nil, err
+	}
+	return client.ListPrompts(ctx)
+}
+
+// 渲染mcp提示词并注入对话：末尾的用户消息作为查询发送，其余消息追加到对话历史。
+// 末尾不是用户消息时只追加消息，返回的响应为nil
+func (a *Agent) RunPrompt(ctx context.Context, conv *Conversation, server, name string, arguments map[string]string, opts *QueryOptions) (*types.ChatResponse, error) {
+	if conv == nil {
+		return nil, fmt.Errorf("对话不能为空")
+	}
+	client, err := a.promptClient(server)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := client.GetPrompt(ctx, name, arguments)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("提示词%s没有返回消息", name)
+	}
+
+	last := messages[len(messages)-1]
+	var texts []string
+	var images []types.ContentPart
+	if last.Role == "user" {
+		if last.Content != "" {
+			texts = append(texts, last.Content)
+		}
+		for _, part := range last.Parts {
+			switch part.Type {
+			case types.ContentPartText:
+				texts = append(texts, part.Text)
+			case types.ContentPartImage:
+				images = append(images, part)
+			}
+		}
+	}
+	query := strings.Join(texts, "\n")
+	if strings.TrimSpace(query) == "" {
+		conv.AppendMessages(messages)
+		return nil, nil
+	}
+
+	options := QueryOptions{}
+	if opts != nil {
+		options = *opts
+	}
+	options.Images = append(append([]types.ContentPart{}, options.Images...), images...)
+	//其余消息与查询在同一锁内写入，查询失败时一并撤销
+	return a.query(ctx, conv, query, &options, messages[:len(messages)-1])
+}
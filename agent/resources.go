@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/usage"
+	"llm-mcp-rag-simple/utils"
+	"strings"
+)
+
+// 导入知识库的mcp资源在向量元数据中的键，值为 resourceKey
+const resourceMetadataKey = "mcp_resource"
+
+func resourceKey(server, uri string) string {
+	return server + " " + uri
+}
+
+// 返回支持资源的mcp客户端
+func (a *Agent) resourceClient(server string) (types.MCPResourceClient, error) {
+	a.mu.RLock()
+	client, exists := a.mcpClients[server]
+	a.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("mcp client不存在：%s", server)
+	}
+	resources, ok := client.(types.MCPResourceClient)
+	if !ok {
+		return nil, fmt.Errorf("mcp client【%s】不支持资源", server)
+	}
+	return resources, nil
+}
+
+// 列出mcp服务提供的资源
+func (a *Agent) ListResources(ctx context.Context, server string) ([]types.MCPResource, error) {
+	client, err := a.resourceClient(server)
+	if err != nil {
+		return nil, err
+	}
+	return client.ListResources(ctx)
+}
+
+// 列出mcp服务提供的资源模板
+func (a *Agent) ListResourceTemplates(ctx context.Context, server string) ([]types.MCPResourceTemplate, error) {
+	client, err := a.resourceClient(server)
+	if err != nil {
+		return nil, err
+	}
+	return client.ListResourceTemplates(ctx)
+}
+
+// 读取mcp资源内容
+func (a *Agent) ReadResource(ctx context.Context, server, uri string) ([]types.MCPContent, error) {
+	client, err := a.resourceClient(server)
+	if err != nil {
+		return nil, err
+	}
+	return client.ReadResource(ctx, uri)
+}
+
+// 读取mcp资源并导入知识库，同时订阅资源更新，更新后自动重新导入
+func (a *Agent) IngestResource(ctx context.Context, server, uri string) error {
+	client, err := a.resourceClient(server)
+	if err != nil {
+		return err
+	}
+	if err := a.ingestResource(ctx, client, server, uri); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.resources[resourceKey(server, uri)] = true
+	register := !a.watching[server]
+	a.watching[server] = true
+	a.mu.Unlock()
+	if register {
+		client.OnResourceUpdated(func(uri string) {
+			a.onResourceUpdated(server, uri)
+		})
+	}
+	if err := client.Subscribe(ctx, uri); err != nil {
+		utils.LogWarn(fmt.Sprintf("订阅资源%s失败，资源更新后需手动重新导入：%v", uri, err))
+	}
+	return nil
+}
+
+// 将资源的文本内容替换进知识库
+func (a *Agent) ingestResource(ctx context.Context, client types.MCPResourceClient, server, uri string) error {
+	contents, err := client.ReadResource(ctx, uri)
+	if err != nil {
+		return err
+	}
+	var texts []string
+	for _, content := range contents {
+		if strings.TrimSpace(content.Text) != "" {
+			texts = append(texts, content.Text)
+		}
+	}
+	if len(texts) == 0 {
+		return fmt.Errorf("资源%s不包含文本内容", uri)
+	}
+
+	key := resourceKey(server, uri)
+	ctx = usage.WithMeter(ctx, a.usage)
+	a.ingestMu.Lock()
+	defer a.ingestMu.Unlock()
+	//先删除旧版本，避免更新后检索到过期内容
+	removed, err := a.vectorStore.DeleteByMetadata(ctx, resourceMetadataKey, key)
+	if err != nil {
+		return fmt.Errorf("删除资源%s的旧内容失败：%w", uri, err)
+	}
+	document := fmt.Sprintf("来源：%s\n%s", uri, strings.Join(texts, "\n"))
+	metadata := map[string]interface{}{resourceMetadataKey: key}
+	if _, err := a.embeddingClient.EmbedDocumentWithMetadata(ctx, document, metadata); err != nil {
+		return fmt.Errorf("导入资源%s失败：%w", uri, err)
+	}
+	utils.LogInfo(fmt.Sprintf("已将mcp client【%s】的资源%s导入知识库（替换%d条旧内容）", server, uri, removed))
+	return nil
+}
+
+// 已导入的资源更新后重新导入
+func (a *Agent) onResourceUpdated(server, uri string) {
+	a.mu.RLock()
+	ingested := a.resources[resourceKey(server, uri)]
+	a.mu.RUnlock()
+	if !ingested {
+		return
+	}
+	client, err := a.resourceClient(server)
+	if err != nil {
+		utils.LogWarn(fmt.Sprintf("重新导入资源%s失败：%v", uri, err))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+	if err := a.ingestResource(ctx, client, server, uri); err != nil {
+		utils.LogWarn(fmt.Sprintf("重新导入资源%s失败：%v", uri, err))
+	}
+}
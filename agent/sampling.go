@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/usage"
+	"llm-mcp-rag-simple/utils"
+	"strings"
+)
+
+// mcp服务模型采样（sampling/createMessage）配置
+type SamplingConfig struct {
+	MaxTokens int                  // 单次采样的输出token上限，0 表示只使用服务请求的值
+	Models    []SamplingModel      // 可按服务的模型偏好选择的模型，未匹配时使用默认聊天模型
+	Approve   SamplingApprovalFunc // 策略为 ask 时调用
+}
+
+// 可供采样使用的模型
+type SamplingModel struct {
+	Name          string // 模型名称，服务的模型偏好作为其子串匹配
+	NewChatClient ChatClientFactory
+}
+
+// 采样审批回调，返回 true 表示允许；未设置回调时需要确认的请求一律拒绝
+type SamplingApprovalFunc func(ctx context.Context, request types.SamplingRequest) (bool, error)
+
+// 设置mcp服务的采样策略，未设置时为 ask
+func (a *Agent) SetSamplingPolicy(server string, policy ApprovalPolicy) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.samplePolicies[server] = policy
+}
+
+// 设置采样审批回调
+func (a *Agent) SetSamplingApprovalFunc(approve SamplingApprovalFunc) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sampling.Approve = approve
+}
+
+// 使用Agent的聊天模型处理mcp服务的采样请求
+func (a *Agent) sample(ctx context.Context, request types.SamplingRequest) (*types.SamplingResult, error) {
+	a.mu.RLock()
+	policy := a.samplePolicies[request.Server]
+	config := a.sampling
+	a.mu.RUnlock()
+
+	switch policy {
+	case ApprovalAllow:
+	case ApprovalDeny:
+		return nil, fmt.Errorf("mcp服务%s不允许使用模型采样", request.Server)
+	default:
+		if config.Approve == nil {
+			return nil, fmt.Errorf("mcp服务%s的模型采样需要确认，但未设置审批回调", request.Server)
+		}
+		//等待用户确认期间暂停发起工具调用的查询超时
+		waitCtx, done := a.waitForUser(ctx, request.Server)
+		approved, err := config.Approve(waitCtx, request)
+		done()
+		if err != nil {
+			return nil, fmt.Errorf("请求审批失败：%w", err)
+		}
+		if !approved {
+			utils.LogInfo(fmt.Sprintf("用户拒绝了mcp服务%s的模型采样请求", request.Server))
+			return nil, fmt.Errorf("用户拒绝了模型采样请求")
+		}
+	}
+	if len(request.Messages) == 0 {
+		return nil, fmt.Errorf("采样请求没有消息")
+	}
+	if err := a.checkBudget(nil); err != nil {
+		return nil, err
+	}
+
+	name, newChatClient := a.samplingModel(config.Models, request.ModelHints)
+	maxTokens := request.MaxTokens
+	if config.MaxTokens > 0 && (maxTokens <= 0 || maxTokens > config.MaxTokens) {
+		maxTokens = config.MaxTokens
+	}
+	generation := types.GenerationOptions{
+		MaxTokens:   maxTokens,
+		Temperature: request.Temperature,
+		Stop:        request.StopSequences,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	ctx = usage.WithMeter(ctx, a.usage)
+	//独立的聊天客户端，不带工具，不影响任何对话的历史
+	chatClient := newChatClient()
+	chatClient.SetMessageHistory(request.Messages)
+	chatClient.SetSystemPrompt(request.SystemPrompt)
+	response, err := chatClient.Chat(ctx, "", generation)
+	if err != nil {
+		return nil, fmt.Errorf("模型采样失败：%w", err)
+	}
+	model := response.Model
+	if model == "" {
+		model = name
+	}
+	utils.LogInfo(fmt.Sprintf("已为mcp服务%s完成模型采样（模型：%s）", request.Server, model))
+	return &types.SamplingResult{Content: response.Content, Model: model, StopReason: samplingStopReason(response.FinishReason)}, nil
+}
+
+// 将服务商的结束原因转换为MCP采样的结束原因，无法对应时留空
+func samplingStopReason(finishReason string) string {
+	switch finishReason {
+	case "stop":
+		return "endTurn"
+	case "length":
+		return "maxTokens"
+	}
+	return ""
+}
+
+// 按偏好顺序匹配可用模型，均未匹配时使用默认聊天模型
+func (a *Agent) samplingModel(models []SamplingModel, hints []string) (string, ChatClientFactory) {
+	for _, hint := range hints {
+		hint = strings.ToLower(hint)
+		for _, model := range models {
+			if strings.Contains(strings.ToLower(model.Name), hint) {
+				return model.Name, model.NewChatClient
+			}
+		}
+	}
+	return "", a.newChatClient
+}
@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/jsonschema-go/jsonschema"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/usage"
+	"llm-mcp-rag-simple/utils"
+	"reflect"
+	"strings"
+)
+
+// 结构化输出选项
+type StructuredOutput struct {
+	Name        string                 // schema 名称，默认 response
+	Schema      map[string]interface{} // 为 nil 时根据 out 的类型推导
+	UseTool     bool                   // 服务端不支持 response_format 时，改为强制调用工具返回结果
+	MaxAttempts int                    // 校验失败时的最大尝试次数，默认 3
+}
+
+// 以结构化模式查询：要求模型按JSON Schema输出，校验失败时携带错误信息重试，
+// 成功后将结果解码到 out（必须为非nil指针）
+func (a *Agent) QueryStructured(ctx context.Context, conv *Conversation, query string, out interface{}, structured StructuredOutput, opts *QueryOptions) error {
+	if conv == nil {
+		return fmt.Errorf("对话不能为空")
+	}
+	if strings.TrimSpace(query) == "" {
+		return fmt.Errorf("查询内容不能为空")
+	}
+	outValue := reflect.ValueOf(out)
+	if outValue.Kind() != reflect.Pointer || outValue.IsNil() {
+		return fmt.Errorf("out 必须为非nil指针")
+	}
+	if structured.Name == "" {
+		structured.Name = "response"
+	}
+	if structured.MaxAttempts <= 0 {
+		structured.MaxAttempts = 3
+	}
+	schema, resolved, err := resolveSchema(structured.Schema, outValue.Type().Elem())
+	if err != nil {
+		return err
+	}
+
+	if err := a.checkBudget(nil); err != nil {
+		return err
+	}
+
+	utils.LogInfo(fmt.Sprintf("正在结构化查询:%s\n", query))
+	queryCtx, cancel := withPausableTimeout(ctx, a.timeout)
+	defer cancel()
+	meter := usage.NewMeter()
+	queryCtx = usage.WithMeter(queryCtx, meter)
+	defer a.recordUsage(conv, meter)
+
+	prompt := a.enhanceQuery(queryCtx, query)
+	tools := a.getAllTools()
+	generation, images := a.queryOptions(opts)
+
+	conv.mu.Lock()
+	defer conv.mu.Unlock()
+
+	//查询失败时恢复对话历史，避免留下用户消息、修正提示和不完整的工具调用
+	snapshot := conv.chatClient.GetMessageHistory()
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			conv.chatClient.SetMessageHistory(snapshot)
+		}
+	}()
+
+	for attempt := 1; attempt <= structured.MaxAttempts; attempt++ {
+		if err := a.checkBudget(meter); err != nil {
+			return err
+		}
+		var output string
+		//图片只随首次查询发送，后续为修正提示
+		if attempt > 1 {
+			images = nil
+		}
+		if structured.UseTool {
+			output, err = a.structuredByTool(queryCtx, conv.chatClient, prompt, images, generation, structured.Name, schema)
+		} else {
+			conv.chatClient.SetTools(tools)
+			gen := generation
+			gen.ResponseFormat = "json_schema"
+			gen.JSONSchema = &types.JSONSchemaFormat{Name: structured.Name, Schema: schema}
+			var response *types.ChatResponse
+			response, err = a.processQueryWithTools(queryCtx, conv.chatClient, prompt, images, gen)
+			if response != nil {
+				output = response.Content
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("结构化查询失败：%w", err)
+		}
+
+		data := []byte(stripCodeFence(output))
+		validationErr := validateJSON(resolved, data)
+		if validationErr == nil {
+			if err := json.Unmarshal(data, out); err != nil {
+				return fmt.Errorf("解码结构化结果失败：%w", err)
+			}
+			succeeded = true
+			utils.LogInfo(fmt.Sprintf("结构化查询成功"))
+			return nil
+		}
+		utils.LogWarn(fmt.Sprintf("结构化输出第%d次校验失败：%v", attempt, validationErr))
+		err = validationErr
+		prompt = fmt.Sprintf("上一次输出不符合要求的JSON Schema：%v\n请修正后只输出符合schema的JSON，不要包含其他内容。", validationErr)
+	}
+	return fmt.Errorf("经过%d次尝试后结构化输出仍未通过校验：%w", structured.MaxAttempts, err)
+}
+
+// 工具回退模式：把schema作为唯一工具的参数并强制调用，工具参数即结构化结果
+func (a *Agent) structuredByTool(ctx context.Context, chatClient types.ChatClient, prompt string, images []types.ContentPart, generation types.GenerationOptions, name string, schema map[string]interface{}) (string, error) {
+	chatClient.SetTools([]types.Tool{{
+		Name:        name,
+		Description: "以JSON格式返回最终结果",
+		InputSchema: schema,
+	}})
+	generation.ToolChoice = name
+	response, err := a.chatWithRetry(ctx, chatClient, prompt, images, generation)
+	if err != nil {
+		return "", fmt.Errorf("获取对话响应失败：%w", err)
+	}
+	output := response.Content
+	for _, toolCall := range response.ToolCalls {
+		//工具调用后必须跟随工具结果，否则下一轮请求会被拒绝
+		chatClient.AppendToolResult(toolCall.ID, "已收到结果")
+		if toolCall.Function.Name == name {
+			output = toolCall.Function.Arguments
+		}
+	}
+	return output, nil
+}
+
+// 解析schema：未提供时根据Go类型推导
+func resolveSchema(schemaMap map[string]interface{}, outType reflect.Type) (map[string]interface{}, *jsonschema.Resolved, error) {
+	var schema *jsonschema.Schema
+	if schemaMap == nil {
+		inferred, err := jsonschema.ForType(outType, &jsonschema.ForOptions{})
+		if err != nil {
+			return nil, nil, fmt.Errorf("根据类型推导JSON Schema失败：%w", err)
+		}
+		schema = inferred
+	} else {
+		data, err := json.Marshal(schemaMap)
+		if err != nil {
+			return nil, nil, fmt.Errorf("序列化JSON Schema失败：%w", err)
+		}
+		schema = &jsonschema.Schema{}
+		if err := json.Unmarshal(data, schema); err != nil {
+			return nil, nil, fmt.Errorf("解析JSON Schema失败：%w", err)
+		}
+	}
+	resolved, err := schema.Resolve(nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("解析JSON Schema失败：%w", err)
+	}
+	//统一转换为map，便于发送给模型
+	if schemaMap == nil {
+		data, err := json.Marshal(schema)
+		if err != nil {
+			return nil, nil, fmt.Errorf("序列化JSON Schema失败：%w", err)
+		}
+		if err := json.Unmarshal(data, &schemaMap); err != nil {
+			return nil, nil, fmt.Errorf("序列化JSON Schema失败：%w", err)
+		}
+	}
+	return schemaMap, resolved, nil
+}
+
+// 校验JSON文本是否符合schema
+func validateJSON(resolved *jsonschema.Resolved, data []byte) error {
+	var instance interface{}
+	if err := json.Unmarshal(data, &instance); err != nil {
+		return fmt.Errorf("输出不是合法的JSON：%w", err)
+	}
+	return resolved.Validate(instance)
+}
+
+// 去除模型可能包裹的 ```json 代码块
+func stripCodeFence(text string) string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "```") {
+		return text
+	}
+	text = strings.TrimPrefix(text, "```")
+	if newline := strings.Index(text, "\n"); newline >= 0 {
+		text = text[newline+1:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "```"))
+}
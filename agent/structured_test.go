@@ -0,0 +1,250 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"llm-mcp-rag-simple/fakeopenai"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type structuredAnswer struct {
+	Answer int    `json:"answer"`
+	Unit   string `json:"unit,omitempty"`
+}
+
+func TestQueryStructuredRetriesInvalidOutput(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{})
+	server.Enqueue(
+		fakeopenai.Reply{
+			Content: `{"answer":"三"}`,
+			Check: func(req openai.ChatCompletionRequest) error {
+				format := req.ResponseFormat
+				if format == nil || format.Type != openai.ChatCompletionResponseFormatTypeJSONSchema || format.JSONSchema == nil || format.JSONSchema.Name != "sum" {
+					return fmt.Errorf("期望json_schema输出格式，实际为%+v", format)
+				}
+				return nil
+			},
+		},
+		fakeopenai.Reply{
+			Content: "```json\n{\"answer\":3}\n```",
+			Check: func(req openai.ChatCompletionRequest) error {
+				last := req.Messages[len(req.Messages)-1]
+				if last.Role != openai.ChatMessageRoleUser || !strings.Contains(last.Content, "上一次输出不符合要求") {
+					return fmt.Errorf("期望携带校验错误的修正提示，实际为%q", last.Content)
+				}
+				return nil
+			},
+		},
+	)
+
+	conv := agent.NewConversation()
+	var out structuredAnswer
+	if err := agent.QueryStructured(context.Background(), conv, "1+2", &out, StructuredOutput{Name: "sum"}, nil); err != nil {
+		t.Fatalf("QueryStructured失败：%v", err)
+	}
+	if out.Answer != 3 {
+		t.Errorf("结构化结果错误：%+v", out)
+	}
+	if len(server.ChatRequests()) != 2 {
+		t.Errorf("期望2次请求，实际为%d", len(server.ChatRequests()))
+	}
+	//成功后保留完整的修正过程
+	if history := conv.GetMessageHistory(); len(history) != 4 {
+		t.Errorf("对话历史错误：%+v", history)
+	}
+}
+
+func TestQueryStructuredGivesUpAfterMaxAttempts(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{})
+	server.Enqueue(
+		fakeopenai.Reply{Content: "不是JSON"},
+		fakeopenai.Reply{Content: `{"unit":"个"}`},
+	)
+
+	conv := agent.NewConversation()
+	var out structuredAnswer
+	err := agent.QueryStructured(context.Background(), conv, "1+2", &out, StructuredOutput{MaxAttempts: 2}, nil)
+	if err == nil || !strings.Contains(err.Error(), "经过2次尝试") {
+		t.Fatalf("期望校验失败，实际为%v", err)
+	}
+	if len(server.ChatRequests()) != 2 {
+		t.Errorf("期望2次请求，实际为%d", len(server.ChatRequests()))
+	}
+	if history := conv.GetMessageHistory(); len(history) != 0 {
+		t.Errorf("失败后应恢复对话历史：%+v", history)
+	}
+}
+
+func TestQueryStructuredRestoresHistoryOnError(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{})
+	server.Enqueue(
+		fakeopenai.Reply{Content: "好的"},
+		fakeopenai.Reply{Content: `{"answer":"三"}`},
+		//修正请求失败时，之前的尝试也不应留在对话历史中
+		fakeopenai.Reply{StatusCode: http.StatusBadRequest, Error: "invalid"},
+	)
+
+	conv := agent.NewConversation()
+	if _, err := agent.Query(context.Background(), conv, "你好", nil); err != nil {
+		t.Fatalf("Query失败：%v", err)
+	}
+	before := conv.GetMessageHistory()
+	var out structuredAnswer
+	if err := agent.QueryStructured(context.Background(), conv, "1+2", &out, StructuredOutput{}, nil); err == nil {
+		t.Fatalf("期望查询失败")
+	}
+	if after := conv.GetMessageHistory(); !reflect.DeepEqual(after, before) {
+		t.Errorf("失败后应恢复对话历史：期望%+v，实际%+v", before, after)
+	}
+}
+
+func TestQueryStructuredRetriesRetryableErrors(t *testing.T) {
+	for _, useTool := range []bool{false, true} {
+		t.Run(fmt.Sprintf("UseTool=%v", useTool), func(t *testing.T) {
+			server := fakeopenai.NewServer(t)
+			agent := newTestAgent(t, server, AgentConfig{MaxRetries: 2, Timeout: 10 * time.Second})
+			reply := fakeopenai.Reply{Content: `{"answer":3}`}
+			if useTool {
+				reply = fakeopenai.Reply{ToolCalls: []fakeopenai.ToolCall{{ID: "call_1", Name: "response", Arguments: `{"answer":3}`}}}
+			}
+			reply.Check = func(req openai.ChatCompletionRequest) error {
+				//重试前恢复历史，不应重复追加用户消息
+				if len(req.Messages) != 1 {
+					return fmt.Errorf("重试时消息数错误：%d", len(req.Messages))
+				}
+				return nil
+			}
+			server.Enqueue(
+				fakeopenai.Reply{StatusCode: http.StatusServiceUnavailable, Error: "overloaded", Header: map[string]string{"Retry-After": "1"}},
+				reply,
+			)
+
+			var out structuredAnswer
+			err := agent.QueryStructured(context.Background(), agent.NewConversation(), "1+2", &out, StructuredOutput{UseTool: useTool}, nil)
+			if err != nil {
+				t.Fatalf("QueryStructured失败：%v", err)
+			}
+			if out.Answer != 3 {
+				t.Errorf("结构化结果错误：%+v", out)
+			}
+			if len(server.ChatRequests()) != 2 {
+				t.Errorf("期望2次请求，实际为%d", len(server.ChatRequests()))
+			}
+		})
+	}
+}
+
+func TestQueryStructuredUseTool(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	agent := newTestAgent(t, server, AgentConfig{})
+	server.Enqueue(fakeopenai.Reply{
+		ToolCalls: []fakeopenai.ToolCall{{ID: "call_1", Name: "sum", Arguments: `{"answer":3,"unit":"个"}`}},
+		Check: func(req openai.ChatCompletionRequest) error {
+			if req.ResponseFormat != nil {
+				return fmt.Errorf("工具回退模式不应发送response_format：%+v", req.ResponseFormat)
+			}
+			if len(req.Tools) != 1 || req.Tools[0].Function.Name != "sum" {
+				return fmt.Errorf("期望只提供结果工具，实际为%+v", req.Tools)
+			}
+			choice, ok := req.ToolChoice.(map[string]interface{})
+			if !ok || choice["type"] != "function" {
+				return fmt.Errorf("期望强制调用结果工具，实际为%+v", req.ToolChoice)
+			}
+			if function, _ := choice["function"].(map[string]interface{}); function["name"] != "sum" {
+				return fmt.Errorf("强制调用的工具错误：%+v", choice)
+			}
+			return nil
+		},
+	})
+
+	conv := agent.NewConversation()
+	var out structuredAnswer
+	if err := agent.QueryStructured(context.Background(), conv, "1+2", &out, StructuredOutput{Name: "sum", UseTool: true}, nil); err != nil {
+		t.Fatalf("QueryStructured失败：%v", err)
+	}
+	if out.Answer != 3 || out.Unit != "个" {
+		t.Errorf("结构化结果错误：%+v", out)
+	}
+	//工具调用后紧跟工具结果，下一轮请求才不会被拒绝
+	history := conv.GetMessageHistory()
+	if len(history) != 3 || history[2].Role != openai.ChatMessageRoleTool || history[2].ToolCallID != "call_1" {
+		t.Errorf("对话历史错误：%+v", history)
+	}
+}
+
+func TestResolveSchema(t *testing.T) {
+	outType := reflect.TypeOf(structuredAnswer{})
+
+	t.Run("根据类型推导", func(t *testing.T) {
+		schema, resolved, err := resolveSchema(nil, outType)
+		if err != nil {
+			t.Fatalf("resolveSchema失败：%v", err)
+		}
+		if schema["type"] != "object" {
+			t.Errorf("schema类型错误：%v", schema)
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		if _, ok := properties["answer"]; !ok {
+			t.Errorf("缺少answer字段：%v", schema)
+		}
+		if required := fmt.Sprint(schema["required"]); required != "[answer]" {
+			t.Errorf("omitempty字段不应必填：%v", required)
+		}
+		if err := validateJSON(resolved, []byte(`{"answer":3}`)); err != nil {
+			t.Errorf("合法输入校验失败：%v", err)
+		}
+		if err := validateJSON(resolved, []byte(`{"unit":"个"}`)); err == nil {
+			t.Errorf("缺少必填字段应校验失败")
+		}
+	})
+
+	t.Run("使用提供的schema", func(t *testing.T) {
+		provided := map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"answer": map[string]interface{}{"type": "integer", "minimum": 10}},
+		}
+		schema, resolved, err := resolveSchema(provided, outType)
+		if err != nil {
+			t.Fatalf("resolveSchema失败：%v", err)
+		}
+		if !reflect.DeepEqual(schema, provided) {
+			t.Errorf("应原样返回提供的schema：%v", schema)
+		}
+		if err := validateJSON(resolved, []byte(`{"answer":3}`)); err == nil {
+			t.Errorf("应按提供的schema校验")
+		}
+	})
+
+	t.Run("非法schema", func(t *testing.T) {
+		if _, _, err := resolveSchema(map[string]interface{}{"type": 5}, outType); err == nil {
+			t.Errorf("期望解析失败")
+		}
+	})
+}
+
+func TestStripCodeFence(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`{"a":1}`, `{"a":1}`},
+		{"  {\"a\":1}\n", `{"a":1}`},
+		{"```json\n{\"a\":1}\n```", `{"a":1}`},
+		{"```\n{\"a\":1}\n```", `{"a":1}`},
+		{"```json\n{\"a\":1}", `{"a":1}`},
+		{"\n```json\n{\n  \"a\": 1\n}\n```\n", "{\n  \"a\": 1\n}"},
+	}
+	for _, tt := range tests {
+		if got := stripCodeFence(tt.text); got != tt.want {
+			t.Errorf("stripCodeFence(%q)：期望%q，实际%q", tt.text, tt.want, got)
+		}
+	}
+}
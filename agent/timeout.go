@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 可暂停的查询超时：等待用户审批期间停止计时，超时后 Err 返回 context.DeadlineExceeded
+type pausableContext struct {
+	context.Context // 父context，提供值与取消
+	done            chan struct{}
+
+	mu        sync.Mutex
+	err       error
+	timer     *time.Timer
+	remaining time.Duration // 暂停时剩余的时间
+	started   time.Time     // 最近一次开始计时的时间
+	paused    int           // 嵌套暂停的次数
+}
+
+type pausableKey struct{}
+
+// 创建在 timeout 后超时的context，计时可通过 pauseTimeout 暂停
+func withPausableTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	c := &pausableContext{
+		Context:   parent,
+		done:      make(chan struct{}),
+		remaining: timeout,
+		started:   time.Now(),
+	}
+	c.timer = time.AfterFunc(timeout, func() { c.finish(context.DeadlineExceeded) })
+	go func() {
+		select {
+		case <-parent.Done():
+			c.finish(parent.Err())
+		case <-c.done:
+		}
+	}()
+	return c, func() { c.finish(context.Canceled) }
+}
+
+func (c *pausableContext) Deadline() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused > 0 || c.err != nil {
+		return c.Context.Deadline()
+	}
+	deadline := c.started.Add(c.remaining)
+	if parent, ok := c.Context.Deadline(); ok && parent.Before(deadline) {
+		return parent, true
+	}
+	return deadline, true
+}
+
+func (c *pausableContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *pausableContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *pausableContext) Value(key any) any {
+	if key == (pausableKey{}) {
+		return c
+	}
+	return c.Context.Value(key)
+}
+
+func (c *pausableContext) finish(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.timer.Stop()
+	close(c.done)
+}
+
+func (c *pausableContext) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused++
+	if c.paused == 1 && c.err == nil && c.timer.Stop() {
+		c.remaining -= time.Since(c.started)
+	}
+}
+
+func (c *pausableContext) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused--
+	if c.paused == 0 && c.err == nil {
+		c.started = time.Now()
+		c.timer = time.AfterFunc(c.remaining, func() { c.finish(context.DeadlineExceeded) })
+	}
+}
+
+// 暂停 ctx 所属查询的超时计时，返回恢复计时的函数；ctx 不是可暂停的查询context时无效果
+func pauseTimeout(ctx context.Context) func() {
+	c, ok := ctx.Value(pausableKey{}).(*pausableContext)
+	if !ok {
+		return func() {}
+	}
+	c.pause()
+	return c.resume
+}
+
+// 正在执行的工具调用，服务在调用期间发起的采样、输入请求据此找到发起调用的查询
+type inflightCall struct {
+	ctx context.Context
+}
+
+// 记录对 server 的工具调用，返回调用结束时移除记录的函数
+func (a *Agent) trackToolCall(ctx context.Context, server string) func() {
+	call := &inflightCall{ctx: ctx}
+	a.mu.Lock()
+	if a.inflight[server] == nil {
+		a.inflight[server] = make(map[*inflightCall]bool)
+	}
+	a.inflight[server][call] = true
+	a.mu.Unlock()
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.inflight[server], call)
+	}
+}
+
+// 服务在工具调用期间等待用户操作：暂停发起调用的查询超时，
+// 这些调用全部结束（如用户取消查询）时取消等待，避免过期的提示一直占用输入；
+// 返回等待使用的context与结束等待的函数
+func (a *Agent) waitForUser(ctx context.Context, server string) (context.Context, func()) {
+	a.mu.RLock()
+	calls := make([]context.Context, 0, len(a.inflight[server]))
+	for call := range a.inflight[server] {
+		calls = append(calls, call.ctx)
+	}
+	a.mu.RUnlock()
+	if len(calls) == 0 {
+		return ctx, func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	resumes := make([]func(), len(calls))
+	for i, call := range calls {
+		resumes[i] = pauseTimeout(call)
+	}
+	stop := make(chan struct{})
+	go func() {
+		for _, call := range calls {
+			select {
+			case <-call.Done():
+			case <-stop:
+				return
+			}
+		}
+		cancel()
+	}()
+	return ctx, func() {
+		close(stop)
+		cancel()
+		for _, resume := range resumes {
+			resume()
+		}
+	}
+}
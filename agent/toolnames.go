@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// OpenAI 等服务商要求工具名匹配 ^[a-zA-Z0-9_-]{1,64}$
+const maxToolNameLength = 64
+
+// 服务名与工具名之间的分隔符
+const toolNameSeparator = "__"
+
+// 内置工具的命名空间，不能用作mcp服务名
+const builtinServer = "agent"
+
+var invalidToolNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// 工具的来源：mcp服务名（内置工具为 agent）与服务内的工具名
+type toolRef struct {
+	Server string
+	Tool   string
+}
+
+// 工具全名 client.tool，用于日志、审批与 TOOL_RESULT_LIMITS 配置
+func (r toolRef) String() string {
+	return r.Server + "." + r.Tool
+}
+
+// 模型侧工具名与 (服务, 工具) 之间的双向映射。
+// 名称一经分配在进程内保持不变，对话历史中的工具调用在工具列表变化后仍能解析
+type toolNameRegistry struct {
+	mu     sync.Mutex
+	byName map[string]toolRef
+	byRef  map[toolRef]string
+}
+
+func newToolNameRegistry() *toolNameRegistry {
+	return &toolNameRegistry{
+		byName: make(map[string]toolRef),
+		byRef:  make(map[toolRef]string),
+	}
+}
+
+// 返回工具在模型侧的名称：通常为 server__tool；含非法字符、超长或与其他工具重名时
+// 截断并追加由服务名与工具名计算的哈希，保证合法且唯一
+func (r *toolNameRegistry) name(ref toolRef) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name, ok := r.byRef[ref]; ok {
+		return name
+	}
+
+	raw := ref.Server + toolNameSeparator + ref.Tool
+	name := invalidToolNameChars.ReplaceAllString(raw, "_")
+	if name != raw || len(name) > maxToolNameLength || r.taken(name, ref) {
+		name = hashedToolName(name, ref, "")
+	}
+	//哈希冲突时追加序号
+	for i := 2; r.taken(name, ref); i++ {
+		name = hashedToolName(raw, ref, fmt.Sprintf("%d", i))
+	}
+	r.byName[name] = ref
+	r.byRef[ref] = name
+	return name
+}
+
+// 将模型返回的工具名解析为 (服务, 工具)
+func (r *toolNameRegistry) resolve(name string) (toolRef, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ref, ok := r.byName[name]
+	return ref, ok
+}
+
+func (r *toolNameRegistry) taken(name string, ref toolRef) bool {
+	owner, ok := r.byName[name]
+	return ok && owner != ref
+}
+
+// 将工具选择中的 client.tool 转换为模型侧名称，auto、none、required 保持不变
+func (a *Agent) toolChoiceName(choice string) string {
+	server, tool, found := strings.Cut(choice, ".")
+	if !found {
+		return choice
+	}
+	return a.toolNames.name(toolRef{Server: server, Tool: tool})
+}
+
+// 保留名称前缀以便阅读，末尾为 _<哈希>[_序号]
+func hashedToolName(name string, ref toolRef, salt string) string {
+	name = invalidToolNameChars.ReplaceAllString(name, "_")
+	sum := sha256.Sum256([]byte(ref.Server + "\x00" + ref.Tool + "\x00" + salt))
+	suffix := "_" + hex.EncodeToString(sum[:4])
+	if salt != "" {
+		suffix += "_" + salt
+	}
+	if len(name) > maxToolNameLength-len(suffix) {
+		name = name[:maxToolNameLength-len(suffix)]
+	}
+	return name + suffix
+}
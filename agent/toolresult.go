@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"encoding/base64"
+	"fmt"
+	"llm-mcp-rag-simple/types"
+	"strings"
+)
+
+// 将工具结果转换为发送给模型的文本与图片：
+// 文本原样保留；支持图片输入时图片随后续消息发送，否则与音频、二进制资源一样以摘要代替
+func renderToolResult(result *types.MCPToolResult, vision bool) (string, []types.ContentPart) {
+	if result == nil || len(result.Content) == 0 {
+		return "没有结果", nil
+	}
+	var texts []string
+	var images []types.ContentPart
+	if result.IsError {
+		texts = append(texts, "工具返回错误：")
+	}
+	for _, content := range result.Content {
+		switch content.Type {
+		case types.MCPContentText:
+			texts = append(texts, content.Text)
+		case types.MCPContentImage:
+			if vision {
+				images = append(images, types.ContentPart{
+					Type:     types.ContentPartImage,
+					ImageURL: fmt.Sprintf("data:%s;base64,%s", content.MIMEType, content.Data),
+				})
+				texts = append(texts, fmt.Sprintf("[图片（%s），已随后续消息发送]", content.MIMEType))
+			} else {
+				texts = append(texts, fmt.Sprintf("[图片（%s，%s），当前模型不支持图片输入]", content.MIMEType, dataSize(content.Data)))
+			}
+		case types.MCPContentAudio:
+			texts = append(texts, fmt.Sprintf("[音频（%s，%s），未发送给模型]", content.MIMEType, dataSize(content.Data)))
+		case types.MCPContentResourceLink:
+			link := fmt.Sprintf("[资源链接：%s %s", content.Name, content.URI)
+			if content.MIMEType != "" {
+				link += fmt.Sprintf("（%s）", content.MIMEType)
+			}
+			if content.Description != "" {
+				link += " - " + content.Description
+			}
+			texts = append(texts, link+"]")
+		case types.MCPContentResource:
+			if content.Data == "" {
+				texts = append(texts, fmt.Sprintf("[资源：%s]\n%s", content.URI, content.Text))
+			} else {
+				texts = append(texts, fmt.Sprintf("[二进制资源：%s（%s，%s）]", content.URI, content.MIMEType, dataSize(content.Data)))
+			}
+		default:
+			texts = append(texts, fmt.Sprintf("[不支持的内容类型：%s]", content.Type))
+		}
+	}
+	return strings.Join(texts, "\n"), images
+}
+
+// base64数据解码后的大小
+func dataSize(data string) string {
+	size := base64.StdEncoding.DecodedLen(len(data))
+	if size < 1024 {
+		return fmt.Sprintf("%d字节", size)
+	}
+	return fmt.Sprintf("%.1fKB", float64(size)/1024)
+}
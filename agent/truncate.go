@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/utils"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 内置工具：分段读取被截断的完整工具结果
+var readToolResultTool = toolRef{Server: builtinServer, Tool: "read_tool_result"}
+
+var spillHandlePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// 工具结果大小限制，按字符（而非字节）计算
+type ToolResultLimits struct {
+	MaxChars int            // 默认上限，0 表示不限制
+	PerTool  map[string]int // 按工具全名（client.tool）或客户端名覆盖默认上限，0 表示不限制
+	SpillDir string         // 不为空时将完整结果保存到该目录，模型可通过 read_tool_result 工具分段读取
+}
+
+// 返回指定工具的结果上限，工具全名优先于客户端名
+func (l ToolResultLimits) limitFor(tool toolRef) int {
+	if limit, ok := l.PerTool[tool.String()]; ok {
+		return limit
+	}
+	if limit, ok := l.PerTool[tool.Server]; ok {
+		return limit
+	}
+	return l.MaxChars
+}
+
+// 超出上限时保留开头与结尾，并提示模型结果已被截断；配置了溢出目录时保存完整结果并给出句柄
+func (a *Agent) limitToolResult(tool toolRef, text string) string {
+	limit := a.toolResults.limitFor(tool)
+	runes := []rune(text)
+	if limit <= 0 || len(runes) <= limit {
+		return text
+	}
+	head := limit / 2
+	tail := limit - head
+	omitted := len(runes) - limit
+
+	var builder strings.Builder
+	builder.WriteString(string(runes[:head]))
+	builder.WriteString(fmt.Sprintf("\n\n...[省略%d字符]...\n\n", omitted))
+	builder.WriteString(string(runes[len(runes)-tail:]))
+	builder.WriteString(fmt.Sprintf("\n\n[注意：工具结果过长已截断，共%d字符，只保留了开头%d字符和结尾%d字符。", len(runes), head, tail))
+	if handle, err := a.spillToolResult(text); err != nil {
+		utils.LogWarn(fmt.Sprintf("保存完整工具结果失败：%v", err))
+	} else if handle != "" {
+		builder.WriteString(fmt.Sprintf("完整结果的句柄为 %s ，需要时可调用工具 %s 按字符偏移分段读取。", handle, a.toolNames.name(readToolResultTool)))
+	}
+	builder.WriteString("]")
+	utils.LogDebug(fmt.Sprintf("工具%s的结果从%d字符截断为%d字符", tool, len(runes), limit))
+	return builder.String()
+}
+
+// 保存完整工具结果，返回句柄；未配置溢出目录时返回空句柄
+func (a *Agent) spillToolResult(text string) (string, error) {
+	if a.toolResults.SpillDir == "" {
+		return "", nil
+	}
+	if err := os.MkdirAll(a.toolResults.SpillDir, 0o755); err != nil {
+		return "", err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	handle := fmt.Sprintf("%s-%s", time.Now().Format("20060102150405"), hex.EncodeToString(suffix))
+	if err := os.WriteFile(filepath.Join(a.toolResults.SpillDir, handle+".txt"), []byte(text), 0o644); err != nil {
+		return "", err
+	}
+	return handle, nil
+}
+
+// 内置工具的定义，只在配置了溢出目录时提供
+func (a *Agent) builtinTools() []types.Tool {
+	if a.toolResults.SpillDir == "" {
+		return nil
+	}
+	return []types.Tool{{
+		Name:        a.toolNames.name(readToolResultTool),
+		Description: "读取被截断的工具结果的完整内容。handle 为截断提示中给出的句柄，offset 为起始字符偏移，length 为读取的字符数",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"handle": map[string]interface{}{"type": "string"},
+				"offset": map[string]interface{}{"type": "integer", "minimum": 0},
+				"length": map[string]interface{}{"type": "integer", "minimum": 1},
+			},
+			"required": []string{"handle"},
+		},
+	}}
+}
+
+// 执行 read_tool_result：读取的长度不超过该工具的结果上限
+func (a *Agent) readToolResult(arguments string) (*types.MCPToolResult, error) {
+	var params struct {
+		Handle string `json:"handle"`
+		Offset int    `json:"offset"`
+		Length int    `json:"length"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &params); err != nil {
+		return nil, fmt.Errorf("解析工具参数失败：%w", err)
+	}
+	if !spillHandlePattern.MatchString(params.Handle) {
+		return nil, fmt.Errorf("无效的句柄：%s", params.Handle)
+	}
+	data, err := os.ReadFile(filepath.Join(a.toolResults.SpillDir, params.Handle+".txt"))
+	if err != nil {
+		return nil, fmt.Errorf("读取完整结果失败：%w", err)
+	}
+	runes := []rune(string(data))
+	limit := a.toolResults.limitFor(readToolResultTool)
+	if params.Length <= 0 || (limit > 0 && params.Length > limit) {
+		params.Length = limit
+	}
+	if params.Offset < 0 || params.Offset > len(runes) {
+		return nil, fmt.Errorf("偏移超出范围，完整结果共%d字符", len(runes))
+	}
+	end := len(runes)
+	if params.Length > 0 && params.Offset+params.Length < end {
+		end = params.Offset + params.Length
+	}
+	text := fmt.Sprintf("[第%d到%d字符，共%d字符]\n%s", params.Offset, end, len(runes), string(runes[params.Offset:end]))
+	return types.NewTextToolResult(text, false), nil
+}
@@ -0,0 +1,187 @@
+package apierr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 错误类别
+type Kind int
+
+const (
+	KindUnknown       Kind = iota
+	KindAuth               // 401/403，密钥无效或无权限
+	KindRateLimit          // 429，限流
+	KindTimeout            // 请求超时
+	KindBadRequest         // 4xx，请求参数错误
+	KindContextLength      // 上下文超出模型限制
+	KindServer             // 5xx，服务端错误
+	KindToolFailure        // MCP工具调用失败
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindAuth:
+		return "认证失败"
+	case KindRateLimit:
+		return "限流"
+	case KindTimeout:
+		return "超时"
+	case KindBadRequest:
+		return "请求错误"
+	case KindContextLength:
+		return "上下文超长"
+	case KindServer:
+		return "服务端错误"
+	case KindToolFailure:
+		return "工具调用失败"
+	default:
+		return "未知错误"
+	}
+}
+
+// 带类别的错误
+type Error struct {
+	Kind       Kind
+	Op         string        // 出错的操作，如 chat、embedding、mcp
+	StatusCode int           // HTTP状态码，非HTTP错误为0
+	RetryAfter time.Duration // 服务端要求的重试等待时间
+	Err        error
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode > 0 {
+		return fmt.Sprintf("%s %s（错误码：%d）：%v", e.Op, e.Kind, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("%s %s：%v", e.Op, e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func New(kind Kind, op string, err error) *Error {
+	return &Error{Kind: kind, Op: op, Err: err}
+}
+
+// 根据HTTP响应状态码创建错误，读取Retry-After头
+func FromResponse(op string, resp *http.Response, body []byte) *Error {
+	e := FromStatus(op, resp.StatusCode, string(body))
+	e.RetryAfter = ParseRetryAfter(resp.Header.Get("Retry-After"))
+	return e
+}
+
+// 根据HTTP状态码与响应内容创建错误
+func FromStatus(op string, status int, body string) *Error {
+	kind := KindUnknown
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		kind = KindAuth
+	case status == http.StatusTooManyRequests:
+		kind = KindRateLimit
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		kind = KindTimeout
+	case status >= 500:
+		kind = KindServer
+	case IsContextLengthMessage(body):
+		kind = KindContextLength
+	case status >= 400:
+		kind = KindBadRequest
+	}
+	return &Error{Kind: kind, Op: op, StatusCode: status, Err: errors.New(body)}
+}
+
+// 将网络层错误归类，无法归类时原样返回
+func Classify(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return New(KindTimeout, op, err)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return New(KindTimeout, op, err)
+	}
+	return err
+}
+
+// 返回错误类别
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return KindTimeout
+	}
+	return KindUnknown
+}
+
+// 限流、超时与服务端错误可以重试
+func Retryable(err error) bool {
+	switch KindOf(err) {
+	case KindRateLimit, KindTimeout, KindServer:
+		return true
+	}
+	return false
+}
+
+// 返回服务端要求的重试等待时间，未指定时为0
+func RetryAfter(err error) time.Duration {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.RetryAfter
+	}
+	return 0
+}
+
+// 解析Retry-After头，支持秒数与HTTP日期两种格式
+func ParseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// 计算第attempt次重试前的等待时间：指数退避，服务端指定Retry-After时优先使用
+func Backoff(err error, attempt int, base, max time.Duration) time.Duration {
+	if wait := RetryAfter(err); wait > 0 {
+		return wait
+	}
+	wait := base << (attempt - 1)
+	if wait <= 0 || wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// 上下文超长错误，不同服务商的返回格式不一致，按关键字识别
+func IsContextLengthMessage(message string) bool {
+	message = strings.ToLower(message)
+	for _, keyword := range []string{"context_length_exceeded", "maximum context length", "context window", "too many tokens"} {
+		if strings.Contains(message, keyword) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package apierr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"空值", "", 0, 0},
+		{"秒数", "7", 7 * time.Second, 7 * time.Second},
+		{"带空格的秒数", " 3 ", 3 * time.Second, 3 * time.Second},
+		{"零秒", "0", 0, 0},
+		{"负数", "-5", 0, 0},
+		{"HTTP日期", time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat), 28 * time.Second, 30 * time.Second},
+		{"过去的日期", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+		{"无法解析", "soon", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseRetryAfter(tt.value)
+			if got < tt.min || got > tt.max {
+				t.Errorf("ParseRetryAfter(%q)：期望%v~%v，实际%v", tt.value, tt.min, tt.max, got)
+			}
+		})
+	}
+}
+
+func TestFromStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   Kind
+	}{
+		{http.StatusUnauthorized, "invalid api key", KindAuth},
+		{http.StatusForbidden, "", KindAuth},
+		{http.StatusTooManyRequests, "rate limited", KindRateLimit},
+		{http.StatusRequestTimeout, "", KindTimeout},
+		{http.StatusGatewayTimeout, "", KindTimeout},
+		{http.StatusInternalServerError, "", KindServer},
+		{http.StatusServiceUnavailable, "maximum context length", KindServer},
+		{http.StatusBadRequest, `{"error":{"code":"context_length_exceeded"}}`, KindContextLength},
+		{http.StatusBadRequest, "This model's maximum context length is 8192 tokens", KindContextLength},
+		{http.StatusBadRequest, "invalid parameter", KindBadRequest},
+		{http.StatusNotFound, "model not found", KindBadRequest},
+		{http.StatusFound, "", KindUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d %s", tt.status, tt.body), func(t *testing.T) {
+			err := FromStatus("chat", tt.status, tt.body)
+			if err.Kind != tt.want {
+				t.Errorf("期望%s，实际%s", tt.want, err.Kind)
+			}
+			if err.StatusCode != tt.status || err.Op != "chat" {
+				t.Errorf("错误信息不完整：%+v", err)
+			}
+		})
+	}
+}
+
+func TestFromResponseReadsRetryAfter(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"12"}}}
+	err := FromResponse("embedding", resp, []byte("slow down"))
+	if err.Kind != KindRateLimit || err.RetryAfter != 12*time.Second {
+		t.Errorf("错误解析失败：%+v", err)
+	}
+	//包装后仍能读取类别与等待时间
+	wrapped := fmt.Errorf("请求失败：%w", err)
+	if KindOf(wrapped) != KindRateLimit || RetryAfter(wrapped) != 12*time.Second || !Retryable(wrapped) {
+		t.Errorf("包装后的错误信息丢失：%v", wrapped)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestClassify(t *testing.T) {
+	plain := errors.New("connection refused")
+	classified := New(KindAuth, "chat", errors.New("denied"))
+	tests := []struct {
+		name string
+		err  error
+		want Kind
+	}{
+		{"context超时", context.DeadlineExceeded, KindTimeout},
+		{"包装的context超时", fmt.Errorf("请求失败：%w", context.DeadlineExceeded), KindTimeout},
+		{"网络超时", &net.OpError{Op: "read", Err: timeoutError{}}, KindTimeout},
+		{"已归类的错误保持不变", fmt.Errorf("请求失败：%w", classified), KindAuth},
+		{"无法归类", plain, KindUnknown},
+		{"context取消", context.Canceled, KindUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Classify("chat", tt.err)
+			if got := KindOf(err); got != tt.want {
+				t.Errorf("期望%s，实际%s", tt.want, got)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("归类后应保留原始错误：%v", err)
+			}
+		})
+	}
+	if Classify("chat", nil) != nil {
+		t.Errorf("nil错误应返回nil")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		kind Kind
+		want bool
+	}{
+		{KindRateLimit, true},
+		{KindTimeout, true},
+		{KindServer, true},
+		{KindAuth, false},
+		{KindBadRequest, false},
+		{KindContextLength, false},
+		{KindToolFailure, false},
+		{KindUnknown, false},
+	}
+	for _, tt := range tests {
+		if got := Retryable(New(tt.kind, "chat", errors.New("x"))); got != tt.want {
+			t.Errorf("%s：期望%v，实际%v", tt.kind, tt.want, got)
+		}
+	}
+	if Retryable(errors.New("x")) || Retryable(nil) {
+		t.Errorf("未归类的错误不应重试")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	plain := New(KindServer, "chat", errors.New("x"))
+	withRetryAfter := &Error{Kind: KindRateLimit, RetryAfter: 90 * time.Second, Err: errors.New("x")}
+	tests := []struct {
+		name    string
+		err     error
+		attempt int
+		want    time.Duration
+	}{
+		{"首次重试", plain, 1, time.Second},
+		{"指数增长", plain, 3, 4 * time.Second},
+		{"不超过上限", plain, 10, 30 * time.Second},
+		{"移位溢出时使用上限", plain, 80, 30 * time.Second},
+		{"优先使用Retry-After", withRetryAfter, 1, 90 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Backoff(tt.err, tt.attempt, time.Second, 30*time.Second); got != tt.want {
+				t.Errorf("期望%v，实际%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	err := FromStatus("chat", http.StatusTooManyRequests, "slow down")
+	if got := err.Error(); got != "chat 限流（错误码：429）：slow down" {
+		t.Errorf("错误信息错误：%q", got)
+	}
+	if got := New(KindTimeout, "mcp", errors.New("deadline")).Error(); got != "mcp 超时：deadline" {
+		t.Errorf("错误信息错误：%q", got)
+	}
+}
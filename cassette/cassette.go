@@ -0,0 +1,247 @@
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 工作模式
+type Mode string
+
+const (
+	ModeRecord Mode = "record" // 转发真实请求并记录
+	ModeReplay Mode = "replay" // 只从文件回放，不访问网络
+)
+
+// 替换敏感信息的占位符
+const redacted = "[REDACTED]"
+
+// 一次请求与响应
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body,omitempty"`
+}
+
+type Response struct {
+	StatusCode int               `json:"statusCode"`
+	Header     map[string]string `json:"header,omitempty"`
+	Body       string            `json:"body"` // SSE流按原始文本完整保存
+}
+
+// 只保存回放需要的响应头，避免记录cookie、组织ID等信息
+var keptHeaders = []string{"Content-Type", "Retry-After"}
+
+// 记录/回放HTTP交互的RoundTripper，保存为JSON文件
+type Recorder struct {
+	mode         Mode
+	path         string
+	base         http.RoundTripper
+	secrets      []string
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+// 创建记录器；回放模式下从path加载已有记录
+func New(path string, mode Mode, secrets ...string) (*Recorder, error) {
+	r := &Recorder{
+		mode: mode,
+		path: path,
+		base: http.DefaultTransport,
+	}
+	for _, secret := range secrets {
+		if secret != "" {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+	switch mode {
+	case ModeRecord:
+	case ModeReplay:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("读取cassette失败：%w", err)
+		}
+		if err := json.Unmarshal(data, &r.interactions); err != nil {
+			return nil, fmt.Errorf("解析cassette失败：%w", err)
+		}
+		r.used = make([]bool, len(r.interactions))
+	default:
+		return nil, fmt.Errorf("无效的cassette模式：%s", mode)
+	}
+	return r, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.mode == ModeReplay {
+		return r.replay(req, body)
+	}
+	return r.record(req, body)
+}
+
+// 回放：优先匹配方法、路径与请求体都相同的记录，其次只匹配方法与路径，每条记录只使用一次
+func (r *Recorder) replay(req *http.Request, body string) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path := req.URL.RequestURI()
+	body = r.redact(body)
+	match := -1
+	for i, interaction := range r.interactions {
+		if r.used[i] || interaction.Request.Method != req.Method || requestURI(interaction.Request.URL) != r.redact(path) {
+			continue
+		}
+		if interaction.Request.Body == body {
+			match = i
+			break
+		}
+		if match < 0 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil, fmt.Errorf("cassette中没有匹配的请求：%s %s", req.Method, path)
+	}
+	r.used[match] = true
+
+	recorded := r.interactions[match].Response
+	header := make(http.Header)
+	for key, value := range recorded.Header {
+		header.Set(key, value)
+	}
+	return &http.Response{
+		StatusCode:    recorded.StatusCode,
+		Status:        fmt.Sprintf("%d %s", recorded.StatusCode, http.StatusText(recorded.StatusCode)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(recorded.Body)),
+		ContentLength: int64(len(recorded.Body)),
+		Request:       req,
+	}, nil
+}
+
+// 记录：转发请求，响应体在读取完毕（关闭）后写入文件，流式响应不受影响
+func (r *Recorder) record(req *http.Request, body string) (*http.Response, error) {
+	resp, err := r.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	interaction := Interaction{
+		Request: Request{
+			Method: req.Method,
+			URL:    r.redact(req.URL.String()),
+			Body:   r.redact(body),
+		},
+		Response: Response{
+			StatusCode: resp.StatusCode,
+			Header:     make(map[string]string),
+		},
+	}
+	for _, key := range keptHeaders {
+		if value := resp.Header.Get(key); value != "" {
+			interaction.Response.Header[key] = r.redact(value)
+		}
+	}
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		onClose: func(data []byte) {
+			interaction.Response.Body = r.redact(string(data))
+			r.add(interaction)
+		},
+	}
+	return resp, nil
+}
+
+func (r *Recorder) add(interaction Interaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interactions = append(r.interactions, interaction)
+	if err := r.save(); err != nil {
+		fmt.Printf("保存cassette失败：%v\n", err)
+	}
+}
+
+// 将记录写入文件
+func (r *Recorder) save() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(r.interactions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, data, 0o644)
+}
+
+// 替换文本中的密钥
+func (r *Recorder) redact(text string) string {
+	for _, secret := range r.secrets {
+		text = strings.ReplaceAll(text, secret, redacted)
+	}
+	return text
+}
+
+// 读取请求体并重新设置，使其可以继续发送
+func readRequestBody(req *http.Request) (string, error) {
+	if req.Body == nil {
+		return "", nil
+	}
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("读取请求体失败：%w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	return string(data), nil
+}
+
+// 记录中的URL只比较路径与查询参数，与服务地址无关
+func requestURI(rawURL string) string {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return rawURL
+	}
+	return req.URL.RequestURI()
+}
+
+// 边读边缓存响应体，关闭时回调完整内容
+type recordingBody struct {
+	io.ReadCloser
+	buf     bytes.Buffer
+	onClose func([]byte)
+	once    sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	//关闭前读完剩余内容，保证记录完整
+	io.Copy(&b.buf, b.ReadCloser)
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.onClose(b.buf.Bytes())
+	})
+	return err
+}
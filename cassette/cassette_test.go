@@ -0,0 +1,183 @@
+package cassette
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const secret = "sk-test-secret"
+
+func readCassette(t *testing.T, path string) []Interaction {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("读取cassette失败：%v", err)
+	}
+	var interactions []Interaction
+	if err := json.Unmarshal(data, &interactions); err != nil {
+		t.Fatalf("解析cassette失败：%v", err)
+	}
+	return interactions
+}
+
+func writeCassette(t *testing.T, interactions []Interaction) string {
+	t.Helper()
+	data, err := json.Marshal(interactions)
+	if err != nil {
+		t.Fatalf("序列化cassette失败：%v", err)
+	}
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("写入cassette失败：%v", err)
+	}
+	return path
+}
+
+func TestRecordRedactsSecrets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", secret)
+		w.Header().Set("Set-Cookie", "session="+secret)
+		fmt.Fprintf(w, `{"echo":%q,"auth":%q}`, string(body), r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "cassettes", "record.json")
+	recorder, err := New(path, ModeRecord, secret, "")
+	if err != nil {
+		t.Fatalf("创建记录器失败：%v", err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/chat?key="+secret, strings.NewReader(`{"api_key":"`+secret+`"}`))
+	req.Header.Set("Authorization", "Bearer "+secret)
+	resp, err := (&http.Client{Transport: recorder}).Do(req)
+	if err != nil {
+		t.Fatalf("请求失败：%v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), secret) {
+		t.Errorf("调用方应收到未经替换的响应：%s", body)
+	}
+
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), secret) {
+		t.Fatalf("cassette中包含密钥：%s", data)
+	}
+	interactions := readCassette(t, path)
+	if len(interactions) != 1 {
+		t.Fatalf("记录条数错误：%d", len(interactions))
+	}
+	recorded := interactions[0]
+	if !strings.HasSuffix(recorded.Request.URL, "/v1/chat?key="+redacted) {
+		t.Errorf("URL未替换密钥：%s", recorded.Request.URL)
+	}
+	if recorded.Request.Body != `{"api_key":"`+redacted+`"}` {
+		t.Errorf("请求体未替换密钥：%s", recorded.Request.Body)
+	}
+	if recorded.Response.Header["Retry-After"] != redacted {
+		t.Errorf("响应头未替换密钥：%v", recorded.Response.Header)
+	}
+	if _, ok := recorded.Response.Header["Set-Cookie"]; ok {
+		t.Errorf("不应保存Set-Cookie：%v", recorded.Response.Header)
+	}
+	if !strings.Contains(recorded.Response.Body, `"auth":"Bearer `+redacted+`"`) {
+		t.Errorf("响应体未替换密钥：%s", recorded.Response.Body)
+	}
+}
+
+func TestRecordCapturesStreamOnClose(t *testing.T) {
+	events := []string{
+		`data: {"choices":[{"delta":{"content":"你"}}]}`,
+		`data: {"choices":[{"delta":{"content":"好"}}]}`,
+		`data: [DONE]`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			fmt.Fprintf(w, "%s\n\n", event)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "stream.json")
+	recorder, err := New(path, ModeRecord)
+	if err != nil {
+		t.Fatalf("创建记录器失败：%v", err)
+	}
+	resp, err := (&http.Client{Transport: recorder}).Get(server.URL + "/v1/chat/completions")
+	if err != nil {
+		t.Fatalf("请求失败：%v", err)
+	}
+	//只读取第一个事件就关闭，剩余内容也应被记录
+	first := make([]byte, len(events[0]))
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		t.Fatalf("读取响应失败：%v", err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Fatalf("响应体关闭前不应写入cassette")
+	}
+	resp.Body.Close()
+	resp.Body.Close()
+
+	interactions := readCassette(t, path)
+	if len(interactions) != 1 {
+		t.Fatalf("重复关闭不应重复记录：%d", len(interactions))
+	}
+	recorded := interactions[0].Response
+	want := strings.Join(events, "\n\n") + "\n\n"
+	if recorded.Body != want || recorded.Header["Content-Type"] != "text/event-stream" {
+		t.Errorf("SSE响应记录不完整：%+v", recorded)
+	}
+}
+
+func TestReplayUsesEachInteractionOnce(t *testing.T) {
+	path := writeCassette(t, []Interaction{
+		{Request: Request{Method: http.MethodPost, URL: "https://api.example.com/v1/chat", Body: `{"n":1}`}, Response: Response{StatusCode: 200, Body: "first"}},
+		{Request: Request{Method: http.MethodPost, URL: "https://api.example.com/v1/chat", Body: `{"n":2}`}, Response: Response{StatusCode: 429, Header: map[string]string{"Retry-After": "1"}, Body: "second"}},
+		{Request: Request{Method: http.MethodPost, URL: "https://api.example.com/v1/chat", Body: `{"n":3}`}, Response: Response{StatusCode: 200, Body: "third"}},
+	})
+	recorder, err := New(path, ModeReplay)
+	if err != nil {
+		t.Fatalf("加载cassette失败：%v", err)
+	}
+	client := &http.Client{Transport: recorder}
+	call := func(body string) (*http.Response, string) {
+		t.Helper()
+		//回放与服务地址无关
+		resp, err := client.Post("http://localhost:1/v1/chat", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("回放失败：%v", err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(data)
+	}
+
+	//请求体完全相同的记录优先
+	if resp, body := call(`{"n":2}`); body != "second" || resp.StatusCode != 429 || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("应匹配请求体相同的记录：%d %s", resp.StatusCode, body)
+	}
+	//没有请求体相同的记录时按顺序使用未用过的记录
+	if _, body := call(`{"n":9}`); body != "first" {
+		t.Errorf("应使用第一条未用过的记录：%s", body)
+	}
+	//已使用的记录不再匹配
+	if _, body := call(`{"n":2}`); body != "third" {
+		t.Errorf("已使用的记录不应再次匹配：%s", body)
+	}
+	if _, err := client.Post("http://localhost:1/v1/chat", "application/json", strings.NewReader(`{"n":1}`)); err == nil {
+		t.Error("记录用完后应返回错误")
+	}
+	if _, err := client.Get("http://localhost:1/v1/embeddings"); err == nil {
+		t.Error("路径不匹配时应返回错误")
+	}
+}
@@ -0,0 +1,61 @@
+package chat
+
+import (
+	"errors"
+	"github.com/sashabaranov/go-openai"
+	"llm-mcp-rag-simple/apierr"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 将go-openai返回的错误转换为带类别的错误
+func classifyOpenAIError(err error, retryAfter time.Duration) error {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		e := apierr.FromStatus("chat", apiErr.HTTPStatusCode, apiErr.Message)
+		if apiErr.Code == "context_length_exceeded" {
+			e.Kind = apierr.KindContextLength
+		}
+		e.RetryAfter = retryAfter
+		e.Err = err
+		return e
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		e := apierr.FromStatus("chat", reqErr.HTTPStatusCode, string(reqErr.Body))
+		e.RetryAfter = retryAfter
+		e.Err = err
+		return e
+	}
+	return apierr.Classify("chat", err)
+}
+
+// 记录最近一次限流/服务不可用响应的Retry-After头，go-openai的错误类型不包含响应头
+type retryAfterTransport struct {
+	base       http.RoundTripper
+	mu         sync.Mutex
+	retryAfter time.Duration
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		t.mu.Lock()
+		t.retryAfter = apierr.ParseRetryAfter(resp.Header.Get("Retry-After"))
+		t.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// 读取并清空记录的Retry-After
+func (t *retryAfterTransport) take() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	retryAfter := t.retryAfter
+	t.retryAfter = 0
+	return retryAfter
+}
@@ -0,0 +1,208 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"llm-mcp-rag-simple/apierr"
+	"llm-mcp-rag-simple/history"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 故障转移链中的一个模型
+type FailoverEntry struct {
+	Name   string // 用于日志与上报，如 openai:gpt-4o-mini
+	Client types.ChatClient
+}
+
+type FailoverOptions struct {
+	Cooldown       time.Duration // 失败后该模型的冷却时间
+	AttemptTimeout time.Duration // 单次尝试的超时时间，0 表示只受上层context限制
+}
+
+// 按顺序尝试多个模型的聊天客户端，遇到限流、服务端错误、超时或上下文超长时切换到下一个
+// 对话历史由本客户端统一维护，每次调用前同步给实际使用的客户端
+type FailoverClient struct {
+	entries  []*failoverEntry
+	options  FailoverOptions
+	messages []types.ChatMessage
+	tools    []types.Tool
+	pending  []types.ContentPart // 附加到下一条用户消息的内容
+	mu       sync.Mutex          // 保护冷却状态
+}
+
+type failoverEntry struct {
+	FailoverEntry
+	cooldownUntil time.Time
+}
+
+func NewFailoverClient(entries []FailoverEntry, options FailoverOptions) *FailoverClient {
+	if options.Cooldown <= 0 {
+		options.Cooldown = time.Minute
+	}
+	client := &FailoverClient{
+		options:  options,
+		messages: make([]types.ChatMessage, 0),
+	}
+	for _, entry := range entries {
+		client.entries = append(client.entries, &failoverEntry{FailoverEntry: entry})
+	}
+	return client
+}
+
+// chat
+func (c *FailoverClient) Chat(ctx context.Context, prompt string, options types.GenerationOptions) (*types.ChatResponse, error) {
+	if len(c.entries) == 0 {
+		return nil, fmt.Errorf("未配置可用的模型")
+	}
+	var errs []string
+	var lastErr error
+	for _, entry := range c.candidates() {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if c.options.AttemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, c.options.AttemptTimeout)
+		}
+		entry.Client.SetTools(c.tools)
+		entry.Client.SetMessageHistory(c.messages)
+		entry.Client.AttachParts(c.pending)
+		response, err := entry.Client.Chat(attemptCtx, prompt, options)
+		cancel()
+		if err == nil {
+			c.messages = entry.Client.GetMessageHistory()
+			if prompt != "" {
+				c.pending = nil
+			}
+			response.Model = entry.Name
+			utils.LogDebug(fmt.Sprintf("模型%s已响应", entry.Name))
+			return response, nil
+		}
+		//上层context已取消，不再尝试其他模型
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if !shouldFailover(err) {
+			return nil, err
+		}
+		errs = append(errs, fmt.Sprintf("%s：%v", entry.Name, err))
+		lastErr = err
+		kind := apierr.KindOf(err)
+		//上下文超长与模型可用性无关，不进入冷却
+		if kind != apierr.KindContextLength {
+			c.coolDown(entry, apierr.RetryAfter(err))
+		}
+		utils.LogWarn(fmt.Sprintf("模型%s调用失败（%s），切换到下一个模型", entry.Name, kind))
+	}
+	//保留最后一个错误的类别，便于上层决定是否重试
+	return nil, &apierr.Error{
+		Kind:       apierr.KindOf(lastErr),
+		Op:         "chat",
+		RetryAfter: apierr.RetryAfter(lastErr),
+		Err:        fmt.Errorf("所有模型均调用失败：%s", strings.Join(errs, ";")),
+	}
+}
+
+// 返回本次尝试的模型顺序：可用的模型在前，冷却中的模型按原有顺序排在最后作为兜底，
+// 因此每个模型在一次调用中都会被尝试
+func (c *FailoverClient) candidates() []*failoverEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var ready, cooling []*failoverEntry
+	for _, entry := range c.entries {
+		if now.Before(entry.cooldownUntil) {
+			cooling = append(cooling, entry)
+		} else {
+			ready = append(ready, entry)
+		}
+	}
+	return append(ready, cooling...)
+}
+
+// 进入冷却，服务端指定的Retry-After更长时以其为准
+func (c *FailoverClient) coolDown(entry *failoverEntry, retryAfter time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cooldown := c.options.Cooldown
+	if retryAfter > cooldown {
+		cooldown = retryAfter
+	}
+	entry.cooldownUntil = time.Now().Add(cooldown)
+}
+
+// 设置可用工具列表
+func (c *FailoverClient) SetTools(tools []types.Tool) {
+	c.tools = tools
+}
+
+// 附加到下一条用户消息的内容（如图片）
+func (c *FailoverClient) AttachParts(parts []types.ContentPart) {
+	c.pending = append([]types.ContentPart(nil), parts...)
+}
+
+// 将工具执行结果添加到对话中
+func (c *FailoverClient) AppendToolResult(toolCallID, toolOutput string) {
+	c.messages = append(c.messages, types.ChatMessage{
+		Role:       openai.ChatMessageRoleTool,
+		Content:    toolOutput,
+		ToolCallID: toolCallID,
+	})
+}
+
+// 设置或添加系统提示词
+func (c *FailoverClient) SetSystemPrompt(prompt string) {
+	for i, msg := range c.messages {
+		//摘要消息保留，只替换系统提示词
+		if msg.Role == openai.ChatMessageRoleSystem && !history.IsSummary(msg) {
+			c.messages = append(c.messages[:i], c.messages[i+1:]...)
+			break
+		}
+	}
+	if prompt != "" {
+		systemMsg := types.ChatMessage{Role: openai.ChatMessageRoleSystem, Content: prompt}
+		c.messages = append([]types.ChatMessage{systemMsg}, c.messages...)
+	}
+}
+
+// 对话添加上下文
+func (c *FailoverClient) SetContext(context string) {
+	if context != "" {
+		c.messages = append(c.messages, history.NewContextMessage(context))
+	}
+}
+
+// 返回当前消息历史
+func (c *FailoverClient) GetMessageHistory() []types.ChatMessage {
+	messages := make([]types.ChatMessage, len(c.messages))
+	copy(messages, c.messages)
+	return messages
+}
+
+// 用已保存的消息历史替换当前对话
+func (c *FailoverClient) SetMessageHistory(messages []types.ChatMessage) {
+	c.messages = make([]types.ChatMessage, len(messages))
+	copy(c.messages, messages)
+}
+
+// 重置对话（保留系统提示词，清除旧对话的摘要）
+func (c *FailoverClient) ClearHistory() {
+	var systemMessages []types.ChatMessage
+	for _, msg := range c.messages {
+		if msg.Role == openai.ChatMessageRoleSystem && !history.IsSummary(msg) {
+			systemMessages = append(systemMessages, msg)
+		}
+	}
+	c.messages = systemMessages
+}
+
+// 判断错误是否应切换模型：限流、超时、服务端错误与上下文超长
+func shouldFailover(err error) bool {
+	switch apierr.KindOf(err) {
+	case apierr.KindRateLimit, apierr.KindTimeout, apierr.KindServer, apierr.KindContextLength:
+		return true
+	}
+	return false
+}
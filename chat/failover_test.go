@@ -0,0 +1,312 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"llm-mcp-rag-simple/apierr"
+	"llm-mcp-rag-simple/history"
+	"llm-mcp-rag-simple/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 按预设结果依次回复的聊天客户端，记录每次调用收到的状态
+type scriptedClient struct {
+	name     string
+	results  []error // 每次调用的结果，nil 表示成功；用完后一直成功
+	hang     bool    // 为 true 时阻塞到ctx结束
+	messages []types.ChatMessage
+	tools    []types.Tool
+	pending  []types.ContentPart
+
+	calls     int
+	received  [][]types.ChatMessage // 每次调用前同步进来的历史
+	parts     [][]types.ContentPart
+	deadlines []bool
+}
+
+func (c *scriptedClient) Chat(ctx context.Context, prompt string, options types.GenerationOptions) (*types.ChatResponse, error) {
+	c.calls++
+	c.received = append(c.received, c.GetMessageHistory())
+	c.parts = append(c.parts, c.pending)
+	_, hasDeadline := ctx.Deadline()
+	c.deadlines = append(c.deadlines, hasDeadline)
+	if prompt != "" {
+		//与真实客户端一样，先写入用户消息再发送请求
+		c.messages = append(c.messages, types.ChatMessage{Role: "user", Content: prompt, Parts: c.pending})
+		c.pending = nil
+	}
+	if c.hang {
+		<-ctx.Done()
+		return nil, fmt.Errorf("创建流式响应失败: %w", apierr.Classify("chat", ctx.Err()))
+	}
+	var err error
+	if len(c.results) > 0 {
+		err, c.results = c.results[0], c.results[1:]
+	}
+	if err != nil {
+		return nil, err
+	}
+	content := "来自" + c.name
+	c.messages = append(c.messages, types.ChatMessage{Role: "assistant", Content: content})
+	return &types.ChatResponse{Content: content, Model: c.name}, nil
+}
+
+func (c *scriptedClient) SetTools(tools []types.Tool)           { c.tools = tools }
+func (c *scriptedClient) AttachParts(parts []types.ContentPart) { c.pending = parts }
+func (c *scriptedClient) AppendToolResult(id, output string)    {}
+func (c *scriptedClient) SetSystemPrompt(prompt string)         {}
+func (c *scriptedClient) SetContext(context string)             {}
+func (c *scriptedClient) ClearHistory()                         { c.messages = nil }
+func (c *scriptedClient) SetMessageHistory(m []types.ChatMessage) {
+	c.messages = append([]types.ChatMessage(nil), m...)
+}
+func (c *scriptedClient) GetMessageHistory() []types.ChatMessage {
+	return append([]types.ChatMessage(nil), c.messages...)
+}
+
+func newFailover(options FailoverOptions, clients ...*scriptedClient) *FailoverClient {
+	var entries []FailoverEntry
+	for _, client := range clients {
+		entries = append(entries, FailoverEntry{Name: client.name, Client: client})
+	}
+	return NewFailoverClient(entries, options)
+}
+
+// 按调用顺序返回尝试过的模型
+func callOrder(before map[*scriptedClient]int, clients ...*scriptedClient) []string {
+	var order []string
+	for _, client := range clients {
+		if client.calls > before[client] {
+			order = append(order, client.name)
+		}
+	}
+	return order
+}
+
+func serverError(retryAfter time.Duration) error {
+	return &apierr.Error{Kind: apierr.KindServer, Op: "chat", RetryAfter: retryAfter, Err: errors.New("overloaded")}
+}
+
+func TestFailoverClientCooldownOrdering(t *testing.T) {
+	a := &scriptedClient{name: "a", results: []error{serverError(0), serverError(0)}}
+	b := &scriptedClient{name: "b", results: []error{serverError(0)}}
+	c := &scriptedClient{name: "c", results: []error{nil, serverError(0)}}
+	client := newFailover(FailoverOptions{Cooldown: time.Hour}, a, b, c)
+
+	//a、b失败后进入冷却，由c回答
+	response, err := client.Chat(context.Background(), "第一次", types.GenerationOptions{})
+	if err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+	if response.Model != "c" || a.calls != 1 || b.calls != 1 || c.calls != 1 {
+		t.Fatalf("期望依次尝试a、b、c，实际回答模型%s，调用次数a=%d b=%d c=%d", response.Model, a.calls, b.calls, c.calls)
+	}
+	order := client.candidates()
+	if got := []string{order[0].Name, order[1].Name, order[2].Name}; strings.Join(got, ",") != "c,a,b" {
+		t.Errorf("冷却中的模型应按原有顺序排在最后：%v", got)
+	}
+
+	//c也失败时，冷却中的模型仍作为兜底被尝试
+	response, err = client.Chat(context.Background(), "第二次", types.GenerationOptions{})
+	if err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+	if response.Model != "b" || c.calls != 2 || a.calls != 2 || b.calls != 2 {
+		t.Errorf("期望依次尝试c、a、b，实际回答模型%s，调用次数a=%d b=%d c=%d", response.Model, a.calls, b.calls, c.calls)
+	}
+}
+
+func TestFailoverClientCooldownDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantMin time.Duration // 0 表示不进入冷却
+	}{
+		{"使用默认冷却时间", serverError(0), time.Minute},
+		{"Retry-After更长时以其为准", serverError(time.Hour), time.Hour},
+		{"Retry-After更短时使用冷却时间", serverError(time.Second), time.Minute},
+		{"上下文超长不进入冷却", apierr.New(apierr.KindContextLength, "chat", errors.New("too long")), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &scriptedClient{name: "a", results: []error{tt.err}}
+			b := &scriptedClient{name: "b"}
+			client := newFailover(FailoverOptions{Cooldown: time.Minute}, a, b)
+			if _, err := client.Chat(context.Background(), "hi", types.GenerationOptions{}); err != nil {
+				t.Fatalf("Chat失败：%v", err)
+			}
+			remaining := time.Until(client.entries[0].cooldownUntil)
+			if tt.wantMin == 0 {
+				if remaining > 0 {
+					t.Errorf("不应进入冷却，剩余%v", remaining)
+				}
+				return
+			}
+			if remaining < tt.wantMin-time.Second || remaining > tt.wantMin {
+				t.Errorf("冷却时间错误：期望约%v，实际%v", tt.wantMin, remaining)
+			}
+		})
+	}
+}
+
+func TestFailoverClientStopsOnNonRetryableErrors(t *testing.T) {
+	badRequest := apierr.New(apierr.KindBadRequest, "chat", errors.New("invalid"))
+	a := &scriptedClient{name: "a", results: []error{badRequest}}
+	b := &scriptedClient{name: "b"}
+	client := newFailover(FailoverOptions{}, a, b)
+	if _, err := client.Chat(context.Background(), "hi", types.GenerationOptions{}); !errors.Is(err, badRequest) {
+		t.Fatalf("期望原样返回请求错误，实际为%v", err)
+	}
+	if b.calls != 0 {
+		t.Errorf("请求错误不应切换模型")
+	}
+	if !client.entries[0].cooldownUntil.IsZero() {
+		t.Errorf("请求错误不应进入冷却")
+	}
+}
+
+func TestFailoverClientAllFailed(t *testing.T) {
+	a := &scriptedClient{name: "a", results: []error{serverError(0)}}
+	b := &scriptedClient{name: "b", results: []error{&apierr.Error{Kind: apierr.KindRateLimit, Op: "chat", RetryAfter: 5 * time.Second, Err: errors.New("slow down")}}}
+	client := newFailover(FailoverOptions{}, a, b)
+	_, err := client.Chat(context.Background(), "hi", types.GenerationOptions{})
+	var apiErr *apierr.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("期望apierr.Error，实际为%v", err)
+	}
+	//保留最后一个错误的类别与Retry-After，便于上层重试
+	if apiErr.Kind != apierr.KindRateLimit || apiErr.RetryAfter != 5*time.Second {
+		t.Errorf("错误类别错误：%+v", apiErr)
+	}
+	if !strings.Contains(err.Error(), "a：") || !strings.Contains(err.Error(), "b：") {
+		t.Errorf("错误信息应包含所有模型：%v", err)
+	}
+	if history := client.GetMessageHistory(); len(history) != 0 {
+		t.Errorf("全部失败时不应修改对话历史：%+v", history)
+	}
+
+	if _, err := NewFailoverClient(nil, FailoverOptions{}).Chat(context.Background(), "hi", types.GenerationOptions{}); err == nil {
+		t.Errorf("未配置模型时应返回错误")
+	}
+}
+
+func TestFailoverClientAttemptTimeout(t *testing.T) {
+	a := &scriptedClient{name: "a", hang: true}
+	b := &scriptedClient{name: "b"}
+	client := newFailover(FailoverOptions{AttemptTimeout: 50 * time.Millisecond}, a, b)
+
+	start := time.Now()
+	response, err := client.Chat(context.Background(), "hi", types.GenerationOptions{})
+	if err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+	if response.Model != "b" {
+		t.Errorf("超时后应切换到下一个模型，实际为%s", response.Model)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("单次尝试超时未生效，耗时%v", elapsed)
+	}
+	if !a.deadlines[0] || !b.deadlines[0] {
+		t.Errorf("每次尝试都应设置超时：a=%v b=%v", a.deadlines, b.deadlines)
+	}
+
+	//上层context取消时不再尝试其他模型
+	a.hang, b.hang = true, true
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	client = newFailover(FailoverOptions{}, a, b)
+	before := map[*scriptedClient]int{a: a.calls, b: b.calls}
+	if _, err := client.Chat(ctx, "hi", types.GenerationOptions{}); err == nil {
+		t.Fatalf("期望查询超时")
+	}
+	if order := callOrder(before, a, b); len(order) != 1 {
+		t.Errorf("上层context取消后不应切换模型，实际尝试了%v", order)
+	}
+	if a.deadlines[1] != true {
+		t.Errorf("未设置单次超时时应沿用上层context的截止时间")
+	}
+}
+
+func TestFailoverClientSyncsHistory(t *testing.T) {
+	a := &scriptedClient{name: "a", results: []error{nil, serverError(0)}}
+	b := &scriptedClient{name: "b"}
+	client := newFailover(FailoverOptions{Cooldown: time.Hour}, a, b)
+	client.SetSystemPrompt("系统")
+	client.SetContext("背景")
+	tools := []types.Tool{{Name: "calc__add"}}
+	client.SetTools(tools)
+
+	if _, err := client.Chat(context.Background(), "第一问", types.GenerationOptions{}); err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+	if len(a.received[0]) != 2 || a.received[0][0].Role != "system" || a.received[0][1].Content != "[背景信息]\n背景" {
+		t.Errorf("首次调用应同步系统提示词与上下文：%+v", a.received[0])
+	}
+	if len(a.tools) != 1 {
+		t.Errorf("工具列表未同步：%+v", a.tools)
+	}
+	client.AppendToolResult("call_1", "3")
+
+	//a失败后由b继续，b收到的历史包含a的回答与工具结果，但不包含a失败时写入的用户消息
+	image := types.ContentPart{Type: types.ContentPartImage, ImageURL: "data:image/png;base64,AAAA"}
+	client.AttachParts([]types.ContentPart{image})
+	response, err := client.Chat(context.Background(), "第二问", types.GenerationOptions{})
+	if err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+	if response.Model != "b" {
+		t.Fatalf("期望切换到b，实际为%s", response.Model)
+	}
+	var contents []string
+	for _, msg := range b.received[0] {
+		contents = append(contents, msg.Role+":"+msg.Content)
+	}
+	want := "system:系统|user:[背景信息]\n背景|user:第一问|assistant:来自a|tool:3"
+	if got := strings.Join(contents, "|"); got != want {
+		t.Errorf("同步给b的历史错误：\n期望%s\n实际%s", want, got)
+	}
+	if len(b.parts[0]) != 1 || len(a.parts[1]) != 1 {
+		t.Errorf("附加内容应发送给每次尝试：a=%v b=%v", a.parts, b.parts)
+	}
+
+	//成功后以b的历史为准，附加内容已清空
+	history := client.GetMessageHistory()
+	if len(history) != 7 || history[5].Content != "第二问" || history[6].Content != "来自b" {
+		t.Errorf("对话历史错误：%+v", history)
+	}
+	if client.pending != nil {
+		t.Errorf("成功后应清空附加内容：%+v", client.pending)
+	}
+}
+
+func TestClientsKeepSummaryOutOfSystemPrompt(t *testing.T) {
+	clients := map[string]types.ChatClient{
+		"failover": newFailover(FailoverOptions{}, &scriptedClient{name: "a"}),
+		"ollama":   NewOllamaClient("http://127.0.0.1:0", "qwen-test", OllamaOptions{}, nil, "", ""),
+	}
+	for name, client := range clients {
+		t.Run(name, func(t *testing.T) {
+			//恢复一段已被裁剪、只有摘要没有系统提示词的对话
+			client.SetMessageHistory([]types.ChatMessage{
+				history.NewSummaryMessage("之前聊了天气"),
+				{Role: "user", Content: "问题"},
+				{Role: "assistant", Content: "回答"},
+			})
+			client.SetSystemPrompt("系统")
+			client.SetSystemPrompt("新系统")
+			messages := client.GetMessageHistory()
+			if len(messages) != 4 || messages[0].Content != "新系统" || !history.IsSummary(messages[1]) {
+				t.Errorf("设置提示词应保留摘要并位于其前：%+v", messages)
+			}
+
+			client.ClearHistory()
+			messages = client.GetMessageHistory()
+			if len(messages) != 1 || messages[0].Content != "新系统" {
+				t.Errorf("清空后应只保留系统提示词：%+v", messages)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package chat
+
+import (
+	"encoding/base64"
+	"fmt"
+	"llm-mcp-rag-simple/types"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 本地图片大小上限
+const maxImageSize = 20 << 20
+
+// 根据本地文件路径、data URL 或 http(s) 地址创建图片内容，本地文件转换为 data URL
+func LoadImage(source string) (types.ContentPart, error) {
+	if strings.HasPrefix(source, "data:") || strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return types.ContentPart{Type: types.ContentPartImage, ImageURL: source}, nil
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return types.ContentPart{}, fmt.Errorf("读取图片失败：%w", err)
+	}
+	if info.Size() > maxImageSize {
+		return types.ContentPart{}, fmt.Errorf("图片%s超过%dMB", source, maxImageSize>>20)
+	}
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return types.ContentPart{}, fmt.Errorf("读取图片失败：%w", err)
+	}
+	mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(source)))
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return types.ContentPart{}, fmt.Errorf("%s不是图片文件（%s）", source, mimeType)
+	}
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	return types.ContentPart{
+		Type:     types.ContentPartImage,
+		ImageURL: fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(data)),
+	}, nil
+}
+
+// 构造带附加内容的用户消息，没有附加内容时为纯文本消息
+func newUserMessage(prompt string, attachments []types.ContentPart) types.ChatMessage {
+	msg := types.ChatMessage{Role: "user", Content: prompt}
+	if len(attachments) == 0 {
+		return msg
+	}
+	if prompt != "" {
+		msg.Parts = append(msg.Parts, types.ContentPart{Type: types.ContentPartText, Text: prompt})
+	}
+	msg.Parts = append(msg.Parts, attachments...)
+	return msg
+}
+
+// 取出 data URL 中的base64数据
+func dataURLBase64(url string) (string, bool) {
+	if !strings.HasPrefix(url, "data:") {
+		return "", false
+	}
+	meta, data, found := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !found || !strings.HasSuffix(meta, ";base64") {
+		return "", false
+	}
+	return data, true
+}
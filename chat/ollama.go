@@ -0,0 +1,477 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"llm-mcp-rag-simple/apierr"
+	"llm-mcp-rag-simple/history"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/usage"
+	"llm-mcp-rag-simple/utils"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Ollama 原生 /api/chat 客户端，流式响应为 NDJSON（每行一个 JSON 对象）
+type OllamaClient struct {
+	baseURL    string
+	model      string
+	options    OllamaOptions
+	messages   []ollamaMessage // 对话历史消息列表
+	tools      []ollamaTool
+	toolNames  map[string]string   // 工具调用ID -> 工具名称，Ollama 工具结果需要回传工具名
+	callSeq    int                 // Ollama 不返回工具调用ID，本地生成
+	pending    []types.ContentPart // 附加到下一条用户消息的内容
+	history    *history.Manager    // 上下文预算管理，nil 表示不裁剪
+	httpClient *http.Client
+}
+
+// 模型参数，对应 /api/chat 的 options 字段
+type OllamaOptions struct {
+	NumCtx      int      `json:"num_ctx,omitempty"`     // 上下文窗口大小
+	Temperature *float64 `json:"temperature,omitempty"` // 为 nil 时使用模型默认值
+	TopP        *float64 `json:"top_p,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"` // 最大生成token数
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+	Images    []string         `json:"images,omitempty"` // base64编码的图片
+
+	toolCallIDs []string // 本地生成的工具调用ID，不发送给 Ollama
+	toolCallID  string
+	parts       []types.ContentPart // 原始多段内容，用于导出历史
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description"`
+		Parameters  map[string]interface{} `json:"parameters"`
+	} `json:"function"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Tools    []ollamaTool    `json:"tools,omitempty"`
+	Stream   bool            `json:"stream"`
+	Format   interface{}     `json:"format,omitempty"` // "json" 或 JSON Schema
+	Options  *OllamaOptions  `json:"options,omitempty"`
+}
+
+type ollamaChatChunk struct {
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason,omitempty"` // 最后一个分片中的结束原因：stop、length
+	Error           string        `json:"error,omitempty"`
+	PromptEvalCount int           `json:"prompt_eval_count,omitempty"` // 最后一个分片中的输入token数
+	EvalCount       int           `json:"eval_count,omitempty"`        // 最后一个分片中的输出token数
+}
+
+func NewOllamaClient(baseURL, model string, options OllamaOptions, tools []types.Tool, systemPrompt, context string) *OllamaClient {
+	if baseURL == "" {
+		baseURL = "http://localhost:11434"
+	}
+	client := &OllamaClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		model:      model,
+		options:    options,
+		messages:   make([]ollamaMessage, 0),
+		tools:      convertOllamaTools(tools),
+		toolNames:  make(map[string]string),
+		httpClient: &http.Client{},
+	}
+	//添加系统提示词
+	if systemPrompt != "" {
+		client.messages = append(client.messages, ollamaMessage{
+			Role:    "system",
+			Content: systemPrompt,
+		})
+	}
+	//上下文信息，裁剪历史时始终保留
+	client.SetContext(context)
+	return client
+}
+
+// chat
+func (c *OllamaClient) Chat(ctx context.Context, prompt string, options types.GenerationOptions) (*types.ChatResponse, error) {
+	utils.LogTitle("CHAT")
+	if prompt != "" {
+		c.messages = append(c.messages, toOllamaMessage(newUserMessage(prompt, c.pending)))
+		c.pending = nil
+	}
+	c.trimHistory(ctx)
+
+	reqBody := ollamaChatRequest{
+		Model:    c.model,
+		Messages: c.messages,
+		Tools:    c.tools,
+		Stream:   true,
+	}
+	c.applyGenerationOptions(&reqBody, options)
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("请求序列化失败：%w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/chat", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("创建请求错误：%w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("创建流式响应失败: %w", apierr.Classify("chat", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, apierr.FromResponse("chat", resp, body)
+	}
+
+	var content strings.Builder
+	var toolCalls []ollamaToolCall
+	var finishReason string
+
+	utils.LogTitle("RESPONSE")
+
+	//逐行解析 NDJSON 流
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var chunk ollamaChatChunk
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return nil, fmt.Errorf("解析流式响应失败: %w", err)
+		}
+		if chunk.Error != "" {
+			//流中途出错时HTTP状态码已是200，按错误内容归类
+			kind := apierr.KindServer
+			if apierr.IsContextLengthMessage(chunk.Error) {
+				kind = apierr.KindContextLength
+			}
+			return nil, fmt.Errorf("接收流式响应失败: %w", apierr.New(kind, "chat", errors.New(chunk.Error)))
+		}
+		if chunk.Message.Content != "" {
+			content.WriteString(chunk.Message.Content)
+			fmt.Print(chunk.Message.Content) //实时显示生成的内容
+		}
+		//Ollama 的工具调用整段返回，不需要拼接分片
+		toolCalls = append(toolCalls, chunk.Message.ToolCalls...)
+		if chunk.Done {
+			finishReason = chunk.DoneReason
+			usage.RecordChat(ctx, c.model, chunk.PromptEvalCount, chunk.EvalCount)
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("接收流式响应失败: %w", apierr.Classify("chat", err))
+	}
+
+	result := make([]types.ToolCall, len(toolCalls))
+	var toolCallIDs []string
+	for i := range toolCalls {
+		if toolCalls[i].Function.Arguments == nil {
+			toolCalls[i].Function.Arguments = map[string]interface{}{}
+		}
+		tc := toolCalls[i]
+		c.callSeq++
+		id := fmt.Sprintf("call_%d", c.callSeq)
+		arguments, err := json.Marshal(tc.Function.Arguments)
+		if err != nil {
+			return nil, fmt.Errorf("序列化工具参数失败：%w", err)
+		}
+		result[i].ID = id
+		result[i].Function.Name = tc.Function.Name
+		result[i].Function.Arguments = string(arguments)
+		toolCallIDs = append(toolCallIDs, id)
+		c.toolNames[id] = tc.Function.Name
+	}
+	assistantMsg := ollamaMessage{
+		Role:        "assistant",
+		Content:     content.String(),
+		ToolCalls:   toolCalls,
+		toolCallIDs: toolCallIDs,
+	}
+	//更新对话历史
+	c.messages = append(c.messages, assistantMsg)
+
+	return &types.ChatResponse{
+		Content:      content.String(),
+		ToolCalls:    result,
+		Model:        c.model,
+		FinishReason: finishReason,
+	}, nil
+}
+
+// 设置可用工具列表
+func (c *OllamaClient) SetTools(tools []types.Tool) {
+	c.tools = convertOllamaTools(tools)
+}
+
+// 附加到下一条用户消息的内容（如图片）
+func (c *OllamaClient) AttachParts(parts []types.ContentPart) {
+	c.pending = append([]types.ContentPart(nil), parts...)
+}
+
+// 将工具执行结果添加到对话中
+func (c *OllamaClient) AppendToolResult(toolCallID, toolOutput string) {
+	c.messages = append(c.messages, ollamaMessage{
+		Role:       "tool",
+		Content:    toolOutput,
+		ToolName:   c.toolNames[toolCallID],
+		toolCallID: toolCallID,
+	})
+}
+
+// 设置或添加系统提示词
+func (c *OllamaClient) SetSystemPrompt(prompt string) {
+	for i, msg := range c.messages {
+		//删除消息历史中的系统消息，确保对话中只有一个系统提示词；摘要消息保留
+		if msg.Role == "system" && !isOllamaSummary(msg) {
+			c.messages = append(c.messages[:i], c.messages[i+1:]...)
+			break
+		}
+	}
+	if prompt != "" {
+		systemMsg := ollamaMessage{
+			Role:    "system",
+			Content: prompt,
+		}
+		c.messages = append([]ollamaMessage{systemMsg}, c.messages...)
+	}
+}
+
+// 对话添加上下文
+func (c *OllamaClient) SetContext(context string) {
+	if context != "" {
+		c.messages = append(c.messages, toOllamaMessage(history.NewContextMessage(context)))
+	}
+}
+
+// 返回当前消息历史
+func (c *OllamaClient) GetMessageHistory() []types.ChatMessage {
+	messages := make([]types.ChatMessage, len(c.messages))
+	for i, msg := range c.messages {
+		messages[i] = types.ChatMessage{
+			Role:       msg.Role,
+			Content:    msg.Content,
+			Parts:      msg.parts,
+			ToolCallID: msg.toolCallID,
+		}
+		for j, tc := range msg.ToolCalls {
+			var call types.ToolCall
+			if j < len(msg.toolCallIDs) {
+				call.ID = msg.toolCallIDs[j]
+			}
+			call.Function.Name = tc.Function.Name
+			arguments, _ := json.Marshal(tc.Function.Arguments)
+			call.Function.Arguments = string(arguments)
+			messages[i].ToolCalls = append(messages[i].ToolCalls, call)
+		}
+	}
+	return messages
+}
+
+// 用已保存的消息历史替换当前对话（用于恢复会话）
+func (c *OllamaClient) SetMessageHistory(messages []types.ChatMessage) {
+	c.messages = make([]ollamaMessage, len(messages))
+	c.toolNames = make(map[string]string)
+	c.callSeq = 0
+	for i, msg := range messages {
+		c.messages[i] = toOllamaMessage(msg)
+		c.messages[i].ToolName = c.toolNames[msg.ToolCallID]
+		for _, tc := range msg.ToolCalls {
+			var call ollamaToolCall
+			call.Function.Name = tc.Function.Name
+			if err := json.Unmarshal([]byte(tc.Function.Arguments), &call.Function.Arguments); err != nil || call.Function.Arguments == nil {
+				call.Function.Arguments = map[string]interface{}{}
+			}
+			c.messages[i].ToolCalls = append(c.messages[i].ToolCalls, call)
+			c.messages[i].toolCallIDs = append(c.messages[i].toolCallIDs, tc.ID)
+			c.toolNames[tc.ID] = tc.Function.Name
+			//从已有的最大序号继续生成，裁剪或恢复后的历史中调用数可能小于序号
+			if seq, ok := callSeqOf(tc.ID); ok && seq > c.callSeq {
+				c.callSeq = seq
+			}
+		}
+	}
+}
+
+// 解析本地生成的工具调用ID（call_N）中的序号
+func callSeqOf(id string) (int, bool) {
+	suffix, ok := strings.CutPrefix(id, "call_")
+	if !ok {
+		return 0, false
+	}
+	seq, err := strconv.Atoi(suffix)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+// 转换为 Ollama 消息，图片只支持 data URL（本地文件会被转换为 data URL）
+func toOllamaMessage(msg types.ChatMessage) ollamaMessage {
+	result := ollamaMessage{
+		Role:       msg.Role,
+		Content:    msg.Content,
+		toolCallID: msg.ToolCallID,
+		parts:      msg.Parts,
+	}
+	for _, part := range msg.Parts {
+		if part.Type != types.ContentPartImage {
+			continue
+		}
+		if data, ok := dataURLBase64(part.ImageURL); ok {
+			result.Images = append(result.Images, data)
+		} else {
+			utils.LogWarn(fmt.Sprintf("Ollama不支持远程图片地址，已忽略：%s", part.ImageURL))
+		}
+	}
+	return result
+}
+
+// 重置对话（清除对话历史，保留系统消息）
+func (c *OllamaClient) ClearHistory() {
+	var systemMessages []ollamaMessage
+	for _, msg := range c.messages {
+		//旧对话的摘要不带入新对话
+		if msg.Role == "system" && !isOllamaSummary(msg) {
+			systemMessages = append(systemMessages, msg)
+		}
+	}
+	c.messages = systemMessages
+	c.toolNames = make(map[string]string)
+}
+
+// 判断是否为裁剪生成的摘要消息
+func isOllamaSummary(msg ollamaMessage) bool {
+	return history.IsSummary(types.ChatMessage{Role: msg.Role, Content: msg.Content})
+}
+
+// 设置上下文预算管理器
+func (c *OllamaClient) SetHistoryManager(manager *history.Manager) {
+	c.history = manager
+}
+
+// 替换底层HTTP传输，用于记录/回放请求
+func (c *OllamaClient) SetHTTPTransport(transport http.RoundTripper) {
+	c.httpClient.Transport = transport
+}
+
+// 超出上下文预算时裁剪对话历史
+func (c *OllamaClient) trimHistory(ctx context.Context) {
+	if c.history == nil {
+		return
+	}
+	result := c.history.Trim(ctx, c.GetMessageHistory(), c.summarize)
+	if result == nil {
+		return
+	}
+	c.messages = history.Apply(c.messages, result, func(summary types.ChatMessage) ollamaMessage {
+		return ollamaMessage{Role: summary.Role, Content: summary.Content}
+	})
+}
+
+// 调用模型将淘汰的对话总结为摘要（不写入对话历史）
+func (c *OllamaClient) summarize(ctx context.Context, previousSummary string, evicted []types.ChatMessage) (string, error) {
+	reqBody := ollamaChatRequest{
+		Model: c.model,
+		Messages: []ollamaMessage{
+			{Role: "user", Content: history.SummaryPrompt(previousSummary, evicted)},
+		},
+		Stream: false,
+	}
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", fmt.Errorf("请求序列化失败：%w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/chat", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("创建请求错误：%w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("请求摘要失败：%w", apierr.Classify("chat", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", apierr.FromResponse("chat", resp, body)
+	}
+	var chunk ollamaChatChunk
+	if err := json.NewDecoder(resp.Body).Decode(&chunk); err != nil {
+		return "", fmt.Errorf("解析摘要响应失败：%w", err)
+	}
+	usage.RecordChat(ctx, c.model, chunk.PromptEvalCount, chunk.EvalCount)
+	return strings.TrimSpace(chunk.Message.Content), nil
+}
+
+// 将生成参数合并到客户端默认的模型参数中
+// Ollama 不支持指定工具，tool_choice 为 none 时不发送工具列表
+func (c *OllamaClient) applyGenerationOptions(req *ollamaChatRequest, options types.GenerationOptions) {
+	merged := c.options
+	if options.Temperature != nil {
+		merged.Temperature = options.Temperature
+	}
+	if options.TopP != nil {
+		merged.TopP = options.TopP
+	}
+	if options.MaxTokens > 0 {
+		merged.NumPredict = options.MaxTokens
+	}
+	if len(options.Stop) > 0 {
+		merged.Stop = options.Stop
+	}
+	if options.Seed != nil {
+		merged.Seed = options.Seed
+	}
+	req.Options = &merged
+	switch {
+	case options.ResponseFormat == "json_schema" && options.JSONSchema != nil:
+		req.Format = options.JSONSchema.Schema
+	case options.ResponseFormat == "json_object":
+		req.Format = "json"
+	}
+	if options.ToolChoice == "none" {
+		req.Tools = nil
+	}
+}
+
+// 将内部工具类型转换为Ollama工具格式
+func convertOllamaTools(tools []types.Tool) []ollamaTool {
+	ollamaTools := make([]ollamaTool, len(tools))
+	for i, tool := range tools {
+		ollamaTools[i].Type = "function"
+		ollamaTools[i].Function.Name = tool.Name
+		ollamaTools[i].Function.Description = tool.Description
+		ollamaTools[i].Function.Parameters = tool.InputSchema
+	}
+	return ollamaTools
+}
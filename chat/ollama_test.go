@@ -0,0 +1,426 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"llm-mcp-rag-simple/apierr"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/usage"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 模拟 Ollama /api/chat：按顺序返回预设的 NDJSON 分片
+type fakeOllama struct {
+	URL string
+
+	mu       sync.Mutex
+	replies  []ollamaReply
+	requests []ollamaChatRequest
+}
+
+type ollamaReply struct {
+	StatusCode int
+	Body       string
+	Chunks     []ollamaChatChunk
+	Check      func(req ollamaChatRequest) error
+}
+
+func newFakeOllama(t *testing.T) *fakeOllama {
+	t.Helper()
+	f := &fakeOllama{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			http.NotFound(w, r)
+			return
+		}
+		var req ollamaChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.requests = append(f.requests, req)
+		if len(f.replies) == 0 {
+			f.mu.Unlock()
+			t.Errorf("没有预设的回复：%+v", req)
+			http.Error(w, "no reply", http.StatusInternalServerError)
+			return
+		}
+		reply := f.replies[0]
+		f.replies = f.replies[1:]
+		f.mu.Unlock()
+
+		if reply.Check != nil {
+			if err := reply.Check(req); err != nil {
+				t.Errorf("请求检查失败：%v", err)
+			}
+		}
+		if reply.StatusCode != 0 {
+			http.Error(w, reply.Body, reply.StatusCode)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		for _, chunk := range reply.Chunks {
+			if err := encoder.Encode(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(server.Close)
+	f.URL = server.URL
+	return f
+}
+
+func (f *fakeOllama) Enqueue(reply ollamaReply) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replies = append(f.replies, reply)
+}
+
+func (f *fakeOllama) Requests() []ollamaChatRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ollamaChatRequest(nil), f.requests...)
+}
+
+func contentChunk(content string) ollamaChatChunk {
+	return ollamaChatChunk{Message: ollamaMessage{Role: "assistant", Content: content}}
+}
+
+func toolCallChunk(calls ...ollamaToolCall) ollamaChatChunk {
+	return ollamaChatChunk{Message: ollamaMessage{Role: "assistant", ToolCalls: calls}, Done: true}
+}
+
+func newOllamaToolCall(name string, arguments map[string]interface{}) ollamaToolCall {
+	var call ollamaToolCall
+	call.Function.Name = name
+	call.Function.Arguments = arguments
+	return call
+}
+
+func TestOllamaClientStreamsNDJSON(t *testing.T) {
+	server := newFakeOllama(t)
+	server.Enqueue(ollamaReply{
+		Chunks: []ollamaChatChunk{
+			contentChunk("你好"),
+			contentChunk(" 世界"),
+			{Message: ollamaMessage{Role: "assistant"}, Done: true, DoneReason: "length", PromptEvalCount: 12, EvalCount: 5},
+		},
+		Check: func(req ollamaChatRequest) error {
+			if !req.Stream || req.Model != "qwen-test" {
+				return fmt.Errorf("期望流式请求模型qwen-test，实际为%+v", req)
+			}
+			if len(req.Messages) != 3 || req.Messages[0].Role != "system" || req.Messages[2].Content != "问题" {
+				return fmt.Errorf("期望系统提示词、上下文与用户消息，实际为%+v", req.Messages)
+			}
+			return nil
+		},
+	})
+
+	client := NewOllamaClient(server.URL, "qwen-test", OllamaOptions{}, nil, "系统提示词", "背景")
+	meter := usage.NewMeter()
+	ctx := usage.WithMeter(context.Background(), meter)
+	response, err := client.Chat(ctx, "问题", types.GenerationOptions{})
+	if err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+	if response.Content != "你好 世界" || response.Model != "qwen-test" || response.FinishReason != "length" {
+		t.Errorf("回复错误：%+v", response)
+	}
+	if got := meter.ByModel()["qwen-test"]; got.PromptTokens != 12 || got.CompletionTokens != 5 {
+		t.Errorf("用量记录错误：%+v", got)
+	}
+	history := client.GetMessageHistory()
+	if len(history) != 4 || history[3].Role != "assistant" || history[3].Content != "你好 世界" {
+		t.Errorf("对话历史错误：%+v", history)
+	}
+}
+
+func TestOllamaClientStreamErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    ollamaReply
+		wantKind apierr.Kind
+	}{
+		{
+			name: "流中途出错",
+			reply: ollamaReply{Chunks: []ollamaChatChunk{
+				contentChunk("部分"),
+				{Error: "model runner has unexpectedly stopped"},
+			}},
+			wantKind: apierr.KindServer,
+		},
+		{
+			name: "流中途超出上下文",
+			reply: ollamaReply{Chunks: []ollamaChatChunk{
+				{Error: "input exceeds maximum context length"},
+			}},
+			wantKind: apierr.KindContextLength,
+		},
+		{
+			name:     "HTTP状态码错误",
+			reply:    ollamaReply{StatusCode: http.StatusNotFound, Body: `{"error":"model not found"}`},
+			wantKind: apierr.KindBadRequest,
+		},
+		{
+			name:     "服务端错误",
+			reply:    ollamaReply{StatusCode: http.StatusServiceUnavailable, Body: "busy"},
+			wantKind: apierr.KindServer,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeOllama(t)
+			server.Enqueue(tt.reply)
+			client := NewOllamaClient(server.URL, "qwen-test", OllamaOptions{}, nil, "", "")
+			_, err := client.Chat(context.Background(), "hi", types.GenerationOptions{})
+			var apiErr *apierr.Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("期望apierr.Error，实际为%v", err)
+			}
+			if apiErr.Kind != tt.wantKind {
+				t.Errorf("错误类别错误：期望%s，实际%s", tt.wantKind, apiErr.Kind)
+			}
+			//失败的回复不写入对话历史
+			if history := client.GetMessageHistory(); len(history) != 1 || history[0].Role != "user" {
+				t.Errorf("对话历史错误：%+v", history)
+			}
+		})
+	}
+}
+
+func TestOllamaClientToolCallRoundTrip(t *testing.T) {
+	server := newFakeOllama(t)
+	server.Enqueue(ollamaReply{
+		Chunks: []ollamaChatChunk{toolCallChunk(
+			newOllamaToolCall("calc__add", map[string]interface{}{"a": 1, "b": 2}),
+			newOllamaToolCall("calc__now", nil),
+		)},
+		Check: func(req ollamaChatRequest) error {
+			if len(req.Tools) != 1 || req.Tools[0].Type != "function" || req.Tools[0].Function.Name != "calc__add" {
+				return fmt.Errorf("工具列表错误：%+v", req.Tools)
+			}
+			return nil
+		},
+	})
+	server.Enqueue(ollamaReply{
+		Chunks: []ollamaChatChunk{{Message: ollamaMessage{Role: "assistant", Content: "3"}, Done: true}},
+		Check: func(req ollamaChatRequest) error {
+			if len(req.Messages) != 4 {
+				return fmt.Errorf("期望4条消息，实际为%+v", req.Messages)
+			}
+			if req.Messages[2].ToolName != "calc__add" || req.Messages[2].Content != "3" {
+				return fmt.Errorf("工具结果应回传工具名：%+v", req.Messages[2])
+			}
+			if req.Messages[3].ToolName != "calc__now" {
+				return fmt.Errorf("工具结果应回传工具名：%+v", req.Messages[3])
+			}
+			return nil
+		},
+	})
+
+	client := NewOllamaClient(server.URL, "qwen-test", OllamaOptions{}, nil, "", "")
+	client.SetTools([]types.Tool{{Name: "calc__add", InputSchema: map[string]interface{}{"type": "object"}}})
+	response, err := client.Chat(context.Background(), "1+2", types.GenerationOptions{})
+	if err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+	if len(response.ToolCalls) != 2 {
+		t.Fatalf("期望2个工具调用，实际为%d", len(response.ToolCalls))
+	}
+	//Ollama 不返回工具调用ID，由客户端依次生成
+	if call := response.ToolCalls[0]; call.ID != "call_1" || call.Function.Name != "calc__add" || call.Function.Arguments != `{"a":1,"b":2}` {
+		t.Errorf("工具调用错误：%+v", call)
+	}
+	if call := response.ToolCalls[1]; call.ID != "call_2" || call.Function.Arguments != `{}` {
+		t.Errorf("缺少参数的工具调用应为空对象：%+v", call)
+	}
+
+	client.AppendToolResult("call_1", "3")
+	client.AppendToolResult("call_2", "now")
+	if _, err := client.Chat(context.Background(), "", types.GenerationOptions{}); err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+
+	//恢复会话后工具名与调用ID保持一致，新生成的ID不与已有ID重复
+	saved := client.GetMessageHistory()
+	if saved[1].ToolCalls[0].ID != "call_1" || saved[2].ToolCallID != "call_1" {
+		t.Fatalf("导出的对话历史丢失工具调用ID：%+v", saved)
+	}
+	restored := NewOllamaClient(server.URL, "qwen-test", OllamaOptions{}, nil, "", "")
+	restored.SetMessageHistory(saved)
+	server.Enqueue(ollamaReply{
+		Chunks: []ollamaChatChunk{toolCallChunk(newOllamaToolCall("calc__add", map[string]interface{}{"a": 3, "b": 4}))},
+		Check: func(req ollamaChatRequest) error {
+			if req.Messages[2].ToolName != "calc__add" || req.Messages[3].ToolName != "calc__now" {
+				return fmt.Errorf("恢复后的工具结果丢失工具名：%+v", req.Messages)
+			}
+			return nil
+		},
+	})
+	response, err = restored.Chat(context.Background(), "3+4", types.GenerationOptions{})
+	if err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+	if len(response.ToolCalls) != 1 || response.ToolCalls[0].ID != "call_3" {
+		t.Errorf("恢复后生成的工具调用ID错误：%+v", response.ToolCalls)
+	}
+}
+
+func TestOllamaClientCallSeqAfterTrimmedHistory(t *testing.T) {
+	server := newFakeOllama(t)
+	server.Enqueue(ollamaReply{Chunks: []ollamaChatChunk{toolCallChunk(newOllamaToolCall("calc__add", nil))}})
+
+	//裁剪后只剩最近一轮，调用数少于已用的最大序号
+	call := types.ToolCall{ID: "call_5"}
+	call.Function.Name = "calc__add"
+	call.Function.Arguments = `{}`
+	client := NewOllamaClient(server.URL, "qwen-test", OllamaOptions{}, nil, "", "")
+	client.SetMessageHistory([]types.ChatMessage{
+		{Role: "user", Content: "1+2"},
+		{Role: "assistant", ToolCalls: []types.ToolCall{call}},
+		{Role: "tool", Content: "3", ToolCallID: "call_5"},
+		{Role: "assistant", Content: "3"},
+	})
+	response, err := client.Chat(context.Background(), "再算一次", types.GenerationOptions{})
+	if err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+	if len(response.ToolCalls) != 1 || response.ToolCalls[0].ID != "call_6" {
+		t.Errorf("新的工具调用ID应从已有最大序号继续：%+v", response.ToolCalls)
+	}
+}
+
+func TestOllamaClientMergesOptions(t *testing.T) {
+	defaultTemperature := 0.2
+	temperature := 0.7
+	seed := 42
+	tests := []struct {
+		name    string
+		options types.GenerationOptions
+		check   func(req ollamaChatRequest) error
+	}{
+		{
+			name: "使用客户端默认参数",
+			check: func(req ollamaChatRequest) error {
+				o := req.Options
+				if o == nil || o.NumCtx != 8192 || o.Temperature == nil || *o.Temperature != 0.2 || o.NumPredict != 256 {
+					return fmt.Errorf("默认参数错误：%+v", o)
+				}
+				if len(req.Tools) != 1 || req.Format != nil {
+					return fmt.Errorf("工具或格式错误：tools=%v format=%v", req.Tools, req.Format)
+				}
+				return nil
+			},
+		},
+		{
+			name: "生成参数覆盖默认值",
+			options: types.GenerationOptions{
+				Temperature: &temperature,
+				MaxTokens:   64,
+				Stop:        []string{"END"},
+				Seed:        &seed,
+			},
+			check: func(req ollamaChatRequest) error {
+				o := req.Options
+				if o.NumCtx != 8192 || *o.Temperature != 0.7 || o.NumPredict != 64 || len(o.Stop) != 1 || o.Seed == nil || *o.Seed != 42 {
+					return fmt.Errorf("合并后的参数错误：%+v", o)
+				}
+				return nil
+			},
+		},
+		{
+			name:    "JSON输出",
+			options: types.GenerationOptions{ResponseFormat: "json_object"},
+			check: func(req ollamaChatRequest) error {
+				if req.Format != "json" {
+					return fmt.Errorf("format错误：%v", req.Format)
+				}
+				return nil
+			},
+		},
+		{
+			name: "JSON Schema输出",
+			options: types.GenerationOptions{
+				ResponseFormat: "json_schema",
+				JSONSchema:     &types.JSONSchemaFormat{Name: "answer", Schema: map[string]interface{}{"type": "object"}},
+			},
+			check: func(req ollamaChatRequest) error {
+				schema, ok := req.Format.(map[string]interface{})
+				if !ok || schema["type"] != "object" {
+					return fmt.Errorf("format错误：%v", req.Format)
+				}
+				return nil
+			},
+		},
+		{
+			name:    "不使用工具",
+			options: types.GenerationOptions{ToolChoice: "none"},
+			check: func(req ollamaChatRequest) error {
+				if len(req.Tools) != 0 {
+					return fmt.Errorf("不应发送工具列表：%+v", req.Tools)
+				}
+				return nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeOllama(t)
+			server.Enqueue(ollamaReply{
+				Chunks: []ollamaChatChunk{{Message: ollamaMessage{Role: "assistant", Content: "ok"}, Done: true}},
+				Check:  tt.check,
+			})
+			client := NewOllamaClient(server.URL, "qwen-test", OllamaOptions{
+				NumCtx:      8192,
+				Temperature: &defaultTemperature,
+				NumPredict:  256,
+			}, []types.Tool{{Name: "calc__add"}}, "", "")
+			if _, err := client.Chat(context.Background(), "hi", tt.options); err != nil {
+				t.Fatalf("Chat失败：%v", err)
+			}
+			//客户端默认参数不被单次请求修改
+			if client.options.NumPredict != 256 || *client.options.Temperature != 0.2 {
+				t.Errorf("默认参数被修改：%+v", client.options)
+			}
+			if n := len(server.Requests()); n != 1 {
+				t.Errorf("期望1次请求，实际为%d", n)
+			}
+		})
+	}
+}
+
+func TestOllamaClientSkipsRemoteImages(t *testing.T) {
+	server := newFakeOllama(t)
+	server.Enqueue(ollamaReply{
+		Chunks: []ollamaChatChunk{{Message: ollamaMessage{Role: "assistant", Content: "一只猫"}, Done: true}},
+		Check: func(req ollamaChatRequest) error {
+			msg := req.Messages[0]
+			if msg.Content != "图里是什么" || len(msg.Images) != 1 || msg.Images[0] != "AAAA" {
+				return fmt.Errorf("图片应以base64发送且忽略远程地址：%+v", msg)
+			}
+			if strings.Contains(msg.Content, "example.com") {
+				return fmt.Errorf("消息内容错误：%q", msg.Content)
+			}
+			return nil
+		},
+	})
+
+	client := NewOllamaClient(server.URL, "qwen-test", OllamaOptions{}, nil, "", "")
+	image, err := LoadImage("data:image/png;base64,AAAA")
+	if err != nil {
+		t.Fatalf("LoadImage失败：%v", err)
+	}
+	client.AttachParts([]types.ContentPart{image, {Type: types.ContentPartImage, ImageURL: "https://example.com/cat.png"}})
+	if _, err := client.Chat(context.Background(), "图里是什么", types.GenerationOptions{}); err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+}
@@ -6,16 +6,23 @@ import (
 	"fmt"
 	"github.com/sashabaranov/go-openai"
 	"io"
+	"llm-mcp-rag-simple/history"
 	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/usage"
 	"llm-mcp-rag-simple/utils"
+	"math"
+	"net/http"
 	"strings"
 )
 
 type OpenaiClient struct {
-	client   *openai.Client
-	model    string
-	messages []openai.ChatCompletionMessage // 对话历史消息列表，维护完整的对话上下文
-	tools    []openai.Tool
+	client    *openai.Client
+	model     string
+	messages  []openai.ChatCompletionMessage // 对话历史消息列表，维护完整的对话上下文
+	tools     []openai.Tool
+	pending   []types.ContentPart // 附加到下一条用户消息的内容
+	history   *history.Manager    // 上下文预算管理，nil 表示不裁剪
+	transport *retryAfterTransport
 }
 
 func NewOpenAIClient(apiKye, baseURL, model string, tools []types.Tool, systemPrompt, context string) *OpenaiClient {
@@ -23,11 +30,14 @@ func NewOpenAIClient(apiKye, baseURL, model string, tools []types.Tool, systemPr
 	if baseURL != "" {
 		config.BaseURL = baseURL
 	}
+	transport := &retryAfterTransport{base: http.DefaultTransport}
+	config.HTTPClient = &http.Client{Transport: transport}
 	client := &OpenaiClient{
-		client:   openai.NewClientWithConfig(config),
-		model:    model,
-		messages: make([]openai.ChatCompletionMessage, 0),
-		tools:    convertTools(tools),
+		client:    openai.NewClientWithConfig(config),
+		transport: transport,
+		model:     model,
+		messages:  make([]openai.ChatCompletionMessage, 0),
+		tools:     convertTools(tools),
 	}
 	//添加系统提示词
 	if systemPrompt != "" {
@@ -36,40 +46,36 @@ func NewOpenAIClient(apiKye, baseURL, model string, tools []types.Tool, systemPr
 			Content: systemPrompt,
 		})
 	}
-	//上下文信息
-	if context != "" {
-		client.messages = append(client.messages, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleUser,
-			Content: context,
-		})
-
-	}
+	//上下文信息，裁剪历史时始终保留
+	client.SetContext(context)
 	return client
 }
 
 // chat
-func (c *OpenaiClient) Chat(ctx context.Context, prompt string) (*types.ChatResponse, error) {
+func (c *OpenaiClient) Chat(ctx context.Context, prompt string, options types.GenerationOptions) (*types.ChatResponse, error) {
 	utils.LogTitle("CHAT")
 	if prompt != "" {
-		c.messages = append(c.messages, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleUser,
-			Content: prompt,
-		})
+		c.messages = append(c.messages, toOpenAIMessage(newUserMessage(prompt, c.pending)))
+		c.pending = nil
 	}
+	c.trimHistory(ctx)
 
 	req := openai.ChatCompletionRequest{
 		Model:    c.model,
 		Messages: c.messages,
 		Stream:   true,
+		//最后一个分片返回本次请求的token用量
+		StreamOptions: &openai.StreamOptions{IncludeUsage: true},
 	}
 
 	if len(c.tools) > 0 {
 		req.Tools = c.tools
 	}
+	applyGenerationOptions(&req, options)
 	//创建流式响应流
 	stream, err := c.client.CreateChatCompletionStream(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("创建流式响应失败: %w", err)
+		return nil, fmt.Errorf("创建流式响应失败: %w", classifyOpenAIError(err, c.transport.take()))
 	}
 	defer stream.Close()
 
@@ -77,6 +83,7 @@ func (c *OpenaiClient) Chat(ctx context.Context, prompt string) (*types.ChatResp
 	var content strings.Builder                   //收集完整的响应内容
 	var toolCalls []types.ToolCall                // 收集工具请求
 	toolCallsMap := make(map[int]*types.ToolCall) // 用于组装分片的工具调用数据
+	var finishReason openai.FinishReason
 
 	utils.LogTitle("RESPONSE")
 
@@ -88,12 +95,18 @@ func (c *OpenaiClient) Chat(ctx context.Context, prompt string) (*types.ChatResp
 				//流结束，正常退出
 				break
 			}
-			return nil, fmt.Errorf("接收流式响应失败: %w", err)
+			return nil, fmt.Errorf("接收流式响应失败: %w", classifyOpenAIError(err, c.transport.take()))
+		}
+		if response.Usage != nil {
+			usage.RecordChat(ctx, c.model, response.Usage.PromptTokens, response.Usage.CompletionTokens)
 		}
 		if len(response.Choices) == 0 {
 			continue
 		}
 		delta := response.Choices[0].Delta
+		if response.Choices[0].FinishReason != "" {
+			finishReason = response.Choices[0].FinishReason
+		}
 
 		//处理文本内容
 		if delta.Content != "" {
@@ -132,6 +145,12 @@ func (c *OpenaiClient) Chat(ctx context.Context, prompt string) (*types.ChatResp
 			}
 		}
 	}
+	//按索引顺序整理工具调用
+	for i := 0; i < len(toolCallsMap); i++ {
+		if call, exists := toolCallsMap[i]; exists {
+			toolCalls = append(toolCalls, *call)
+		}
+	}
 
 	//将回复添加到对话历史
 	assistantMsg := openai.ChatCompletionMessage{
@@ -157,11 +176,23 @@ func (c *OpenaiClient) Chat(ctx context.Context, prompt string) (*types.ChatResp
 	c.messages = append(c.messages, assistantMsg)
 
 	return &types.ChatResponse{
-		Content:   content.String(),
-		ToolCalls: toolCalls,
+		Content:      content.String(),
+		ToolCalls:    toolCalls,
+		Model:        c.model,
+		FinishReason: string(finishReason),
 	}, nil
 }
 
+// 设置可用工具列表
+func (c *OpenaiClient) SetTools(tools []types.Tool) {
+	c.tools = convertTools(tools)
+}
+
+// 附加到下一条用户消息的内容（如图片）
+func (c *OpenaiClient) AttachParts(parts []types.ContentPart) {
+	c.pending = append([]types.ContentPart(nil), parts...)
+}
+
 // 将工具执行结果添加到对话中
 func (c *OpenaiClient) AppendToolResult(toolCallID, toolOutput string) {
 	c.messages = append(c.messages, openai.ChatCompletionMessage{
@@ -174,13 +205,13 @@ func (c *OpenaiClient) AppendToolResult(toolCallID, toolOutput string) {
 // 设置或添加系统提示词
 func (c *OpenaiClient) SetSystemPrompt(prompt string) {
 	for i, msg := range c.messages {
-		//删除消息历史中的系统消息，确保对话中只有一个系统提示词
-		if msg.Role == openai.ChatMessageRoleSystem {
+		//删除消息历史中的系统消息，确保对话中只有一个系统提示词；摘要消息保留
+		if msg.Role == openai.ChatMessageRoleSystem && !history.IsSummary(fromOpenAIMessage(msg)) {
 			c.messages = append(c.messages[:i], c.messages[i+1:]...)
 			break
 		}
 	}
-	//添加新的系统提示词
+	//添加新的系统提示词，位于摘要之前
 	if prompt != "" {
 		systemMsg := openai.ChatCompletionMessage{
 			Role:    openai.ChatMessageRoleSystem,
@@ -193,10 +224,7 @@ func (c *OpenaiClient) SetSystemPrompt(prompt string) {
 // 对话添加上下文
 func (c *OpenaiClient) SetContext(context string) {
 	if context != "" {
-		c.messages = append(c.messages, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleUser,
-			Content: context,
-		})
+		c.messages = append(c.messages, toOpenAIMessage(history.NewContextMessage(context)))
 	}
 }
 
@@ -204,26 +232,194 @@ func (c *OpenaiClient) SetContext(context string) {
 func (c *OpenaiClient) GetMessageHistory() []types.ChatMessage {
 	messages := make([]types.ChatMessage, len(c.messages))
 	for i, msg := range c.messages {
-		messages[i] = types.ChatMessage{
-			Role:    msg.Role,
-			Content: msg.Content,
-		}
+		messages[i] = fromOpenAIMessage(msg)
 	}
 	return messages
 }
 
+// 用已保存的消息历史替换当前对话（用于恢复会话）
+func (c *OpenaiClient) SetMessageHistory(messages []types.ChatMessage) {
+	c.messages = make([]openai.ChatCompletionMessage, len(messages))
+	for i, msg := range messages {
+		c.messages[i] = toOpenAIMessage(msg)
+	}
+}
+
+// 转换为 OpenAI 消息，多段内容映射为 content parts（此时 Content 必须为空）
+func toOpenAIMessage(msg types.ChatMessage) openai.ChatCompletionMessage {
+	result := openai.ChatCompletionMessage{
+		Role:       msg.Role,
+		Content:    msg.Content,
+		ToolCallID: msg.ToolCallID,
+	}
+	if len(msg.Parts) > 0 {
+		result.Content = ""
+		for _, part := range msg.Parts {
+			switch part.Type {
+			case types.ContentPartImage:
+				result.MultiContent = append(result.MultiContent, openai.ChatMessagePart{
+					Type:     openai.ChatMessagePartTypeImageURL,
+					ImageURL: &openai.ChatMessageImageURL{URL: part.ImageURL, Detail: openai.ImageURLDetail(part.Detail)},
+				})
+			default:
+				result.MultiContent = append(result.MultiContent, openai.ChatMessagePart{
+					Type: openai.ChatMessagePartTypeText,
+					Text: part.Text,
+				})
+			}
+		}
+	}
+	for _, tc := range msg.ToolCalls {
+		result.ToolCalls = append(result.ToolCalls, openai.ToolCall{
+			ID:   tc.ID,
+			Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{
+				Name:      tc.Function.Name,
+				Arguments: tc.Function.Arguments,
+			},
+		})
+	}
+	return result
+}
+
+// 从 OpenAI 消息转换，content parts 中的文本拼接到 Content
+func fromOpenAIMessage(msg openai.ChatCompletionMessage) types.ChatMessage {
+	result := types.ChatMessage{
+		Role:       msg.Role,
+		Content:    msg.Content,
+		ToolCallID: msg.ToolCallID,
+	}
+	var texts []string
+	for _, part := range msg.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeImageURL:
+			if part.ImageURL != nil {
+				result.Parts = append(result.Parts, types.ContentPart{
+					Type:     types.ContentPartImage,
+					ImageURL: part.ImageURL.URL,
+					Detail:   string(part.ImageURL.Detail),
+				})
+			}
+		default:
+			texts = append(texts, part.Text)
+			result.Parts = append(result.Parts, types.ContentPart{Type: types.ContentPartText, Text: part.Text})
+		}
+	}
+	if len(msg.MultiContent) > 0 {
+		result.Content = strings.Join(texts, "\n")
+	}
+	for _, tc := range msg.ToolCalls {
+		var call types.ToolCall
+		call.ID = tc.ID
+		call.Function.Name = tc.Function.Name
+		call.Function.Arguments = tc.Function.Arguments
+		result.ToolCalls = append(result.ToolCalls, call)
+	}
+	return result
+}
+
+// 设置上下文预算管理器
+func (c *OpenaiClient) SetHistoryManager(manager *history.Manager) {
+	c.history = manager
+}
+
+// 替换底层HTTP传输，用于记录/回放请求
+func (c *OpenaiClient) SetHTTPTransport(transport http.RoundTripper) {
+	c.transport.base = transport
+}
+
+// 超出上下文预算时裁剪对话历史
+func (c *OpenaiClient) trimHistory(ctx context.Context) {
+	if c.history == nil {
+		return
+	}
+	result := c.history.Trim(ctx, c.GetMessageHistory(), c.summarize)
+	if result == nil {
+		return
+	}
+	c.messages = history.Apply(c.messages, result, func(summary types.ChatMessage) openai.ChatCompletionMessage {
+		return openai.ChatCompletionMessage{Role: summary.Role, Content: summary.Content}
+	})
+}
+
+// 调用模型将淘汰的对话总结为摘要（不写入对话历史）
+func (c *OpenaiClient) summarize(ctx context.Context, previousSummary string, evicted []types.ChatMessage) (string, error) {
+	resp, err := c.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: c.model,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: history.SummaryPrompt(previousSummary, evicted)},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("请求摘要失败：%w", classifyOpenAIError(err, c.transport.take()))
+	}
+	usage.RecordChat(ctx, c.model, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("摘要响应为空")
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
 // 重置对话（清除对话历史，保留系统消息，确保新对话且角色设定不丢失）
 func (c *OpenaiClient) ClearHistory() {
 	var systemMessages []openai.ChatCompletionMessage
-	//提取系统消息,只保留系统提示词
+	//提取系统消息,只保留系统提示词，旧对话的摘要一并清除
 	for _, msg := range c.messages {
-		if msg.Role == openai.ChatMessageRoleSystem {
+		if msg.Role == openai.ChatMessageRoleSystem && !history.IsSummary(fromOpenAIMessage(msg)) {
 			systemMessages = append(systemMessages, msg)
 		}
 	}
 	c.messages = systemMessages
 }
 
+// 将生成参数写入请求
+func applyGenerationOptions(req *openai.ChatCompletionRequest, options types.GenerationOptions) {
+	if options.Temperature != nil {
+		req.Temperature = float32(*options.Temperature)
+		//temperature为0时会被omitempty忽略，使用最小非零值代替
+		if req.Temperature == 0 {
+			req.Temperature = math.SmallestNonzeroFloat32
+		}
+	}
+	if options.TopP != nil {
+		req.TopP = float32(*options.TopP)
+	}
+	req.MaxTokens = options.MaxTokens
+	req.Stop = options.Stop
+	req.Seed = options.Seed
+	if options.ResponseFormat != "" {
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatType(options.ResponseFormat),
+		}
+		if options.JSONSchema != nil {
+			schema, err := json.Marshal(options.JSONSchema.Schema)
+			if err != nil {
+				utils.LogWarn(fmt.Sprintf("序列化JSON Schema失败：%v", err))
+			} else {
+				req.ResponseFormat.JSONSchema = &openai.ChatCompletionResponseFormatJSONSchema{
+					Name:   options.JSONSchema.Name,
+					Schema: json.RawMessage(schema),
+					Strict: options.JSONSchema.Strict,
+				}
+			}
+		}
+	}
+	if len(req.Tools) == 0 {
+		return
+	}
+	switch options.ToolChoice {
+	case "":
+	case "auto", "none", "required":
+		req.ToolChoice = options.ToolChoice
+	default:
+		//指定工具名称时强制调用该工具
+		req.ToolChoice = openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: options.ToolChoice},
+		}
+	}
+}
+
 // 将内部工具类型转换为OpenAI工具格式
 func convertTools(tools []types.Tool) []openai.Tool {
 	openaiTools := make([]openai.Tool, len(tools))
@@ -231,7 +427,7 @@ func convertTools(tools []types.Tool) []openai.Tool {
 		// JSON序列化和反序列化确保数据结构的正确转换
 		parametersBytes, err := json.Marshal(tool.InputSchema)
 		if err != nil {
-			fmt.Errorf("解析出错: %w", err)
+			utils.LogWarn(fmt.Sprintf("解析工具%s参数出错: %v", tool.Name, err))
 			return nil
 		}
 		var parameters map[string]interface{}
@@ -0,0 +1,231 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"llm-mcp-rag-simple/apierr"
+	"llm-mcp-rag-simple/fakeopenai"
+	"llm-mcp-rag-simple/history"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/usage"
+	"net/http"
+	"testing"
+)
+
+func TestOpenaiClientStreamsContentAndUsage(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	server.Enqueue(fakeopenai.Reply{
+		Content: "你好 世界 hello world",
+		Usage:   &openai.Usage{PromptTokens: 12, CompletionTokens: 5},
+		Check: func(req openai.ChatCompletionRequest) error {
+			if !req.Stream {
+				return fmt.Errorf("期望流式请求")
+			}
+			if len(req.Messages) != 2 || req.Messages[0].Role != openai.ChatMessageRoleSystem {
+				return fmt.Errorf("期望系统提示词与用户消息，实际为%v", req.Messages)
+			}
+			if req.Messages[1].Content != "问题" {
+				return fmt.Errorf("用户消息错误：%q", req.Messages[1].Content)
+			}
+			return nil
+		},
+	})
+
+	client := NewOpenAIClient("test-key", server.URL, "gpt-test", nil, "系统提示词", "")
+	meter := usage.NewMeter()
+	ctx := usage.WithMeter(context.Background(), meter)
+	response, err := client.Chat(ctx, "问题", types.GenerationOptions{})
+	if err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+	if response.Content != "你好 世界 hello world" || response.FinishReason != "stop" {
+		t.Errorf("回复错误：%+v", response)
+	}
+	if got := meter.ByModel()["gpt-test"]; got.PromptTokens != 12 || got.CompletionTokens != 5 {
+		t.Errorf("用量记录错误：%+v", got)
+	}
+	history := client.GetMessageHistory()
+	if len(history) != 3 || history[2].Role != openai.ChatMessageRoleAssistant {
+		t.Errorf("对话历史错误：%+v", history)
+	}
+}
+
+func TestOpenaiClientAssemblesToolCalls(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	server.Enqueue(fakeopenai.Reply{
+		ToolCalls: []fakeopenai.ToolCall{
+			{ID: "call_a", Name: "calc.add", Arguments: `{"a":1,"b":2}`},
+			{ID: "call_b", Name: "calc.mul", Arguments: `{"a":3,"b":4}`},
+		},
+		Check: func(req openai.ChatCompletionRequest) error {
+			if len(req.Tools) != 1 || req.Tools[0].Function.Name != "calc.add" {
+				return fmt.Errorf("工具列表错误：%+v", req.Tools)
+			}
+			return nil
+		},
+	})
+
+	client := NewOpenAIClient("test-key", server.URL, "gpt-test", nil, "", "")
+	client.SetTools([]types.Tool{{Name: "calc.add", InputSchema: map[string]interface{}{"type": "object"}}})
+	response, err := client.Chat(context.Background(), "1+2", types.GenerationOptions{})
+	if err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+	if len(response.ToolCalls) != 2 {
+		t.Fatalf("期望2个工具调用，实际为%d", len(response.ToolCalls))
+	}
+	if call := response.ToolCalls[0]; call.ID != "call_a" || call.Function.Name != "calc.add" || call.Function.Arguments != `{"a":1,"b":2}` {
+		t.Errorf("工具调用组装错误：%+v", call)
+	}
+	if call := response.ToolCalls[1]; call.ID != "call_b" || call.Function.Arguments != `{"a":3,"b":4}` {
+		t.Errorf("工具调用组装错误：%+v", call)
+	}
+}
+
+func TestOpenaiClientSendsGenerationOptions(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	server.Enqueue(fakeopenai.Reply{
+		Content: "ok",
+		Check: func(req openai.ChatCompletionRequest) error {
+			if req.Temperature != 0.5 || req.MaxTokens != 64 || len(req.Stop) != 1 {
+				return fmt.Errorf("生成参数错误：temperature=%v max_tokens=%d stop=%v", req.Temperature, req.MaxTokens, req.Stop)
+			}
+			return nil
+		},
+	})
+
+	temperature := 0.5
+	client := NewOpenAIClient("test-key", server.URL, "gpt-test", nil, "", "")
+	_, err := client.Chat(context.Background(), "hi", types.GenerationOptions{
+		Temperature: &temperature,
+		MaxTokens:   64,
+		Stop:        []string{"END"},
+	})
+	if err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+}
+
+func TestOpenaiClientClassifiesErrors(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	server.Enqueue(fakeopenai.Reply{
+		StatusCode: http.StatusTooManyRequests,
+		Error:      "rate limited",
+		Header:     map[string]string{"Retry-After": "7"},
+	})
+
+	client := NewOpenAIClient("test-key", server.URL, "gpt-test", nil, "", "")
+	_, err := client.Chat(context.Background(), "hi", types.GenerationOptions{})
+	var apiErr *apierr.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("期望apierr.Error，实际为%v", err)
+	}
+	if apiErr.Kind != apierr.KindRateLimit {
+		t.Errorf("错误类别错误：%s", apiErr.Kind)
+	}
+	if apierr.RetryAfter(err).Seconds() != 7 {
+		t.Errorf("Retry-After错误：%v", apierr.RetryAfter(err))
+	}
+}
+
+func TestOpenaiClientSendsImageParts(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	server.Enqueue(fakeopenai.Reply{
+		Content: "一只猫",
+		Check: func(req openai.ChatCompletionRequest) error {
+			msg := req.Messages[0]
+			if msg.Content != "" || len(msg.MultiContent) != 2 {
+				return fmt.Errorf("期望2段内容，实际为%+v", msg)
+			}
+			if msg.MultiContent[0].Text != "图里是什么" || msg.MultiContent[1].ImageURL == nil || msg.MultiContent[1].ImageURL.URL != "data:image/png;base64,AAAA" {
+				return fmt.Errorf("内容片段错误：%+v", msg.MultiContent)
+			}
+			return nil
+		},
+	})
+
+	client := NewOpenAIClient("test-key", server.URL, "gpt-test", nil, "", "")
+	image, err := LoadImage("data:image/png;base64,AAAA")
+	if err != nil {
+		t.Fatalf("LoadImage失败：%v", err)
+	}
+	client.AttachParts([]types.ContentPart{image})
+	if _, err := client.Chat(context.Background(), "图里是什么", types.GenerationOptions{}); err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+	history := client.GetMessageHistory()
+	if history[0].Content != "图里是什么" || history[0].ImageCount() != 1 {
+		t.Errorf("对话历史中的图片丢失：%+v", history[0])
+	}
+}
+
+// 生成多轮对话，使裁剪时产生摘要
+func longConversation(turns int) []types.ChatMessage {
+	var messages []types.ChatMessage
+	for i := 1; i <= turns; i++ {
+		messages = append(messages,
+			types.ChatMessage{Role: openai.ChatMessageRoleUser, Content: fmt.Sprintf("问题%d", i)},
+			types.ChatMessage{Role: openai.ChatMessageRoleAssistant, Content: fmt.Sprintf("回答%d", i)},
+		)
+	}
+	return messages
+}
+
+// 裁剪并生成摘要后，返回摘要所在的位置
+func trimWithSummary(t *testing.T, client *OpenaiClient, server *fakeopenai.Server) int {
+	t.Helper()
+	client.SetHistoryManager(history.NewManager(history.Config{MaxTokens: 60, KeepTurns: 1, Summarize: true}, history.TokenizerFunc(func(text string) int {
+		return len([]rune(text))
+	})))
+	client.SetMessageHistory(append(client.GetMessageHistory(), longConversation(4)...))
+	server.Enqueue(fakeopenai.Reply{Content: "之前聊了问题1到3"}, fakeopenai.Reply{Content: "回答5"})
+	if _, err := client.Chat(context.Background(), "问题5", types.GenerationOptions{}); err != nil {
+		t.Fatalf("Chat失败：%v", err)
+	}
+	for i, msg := range client.GetMessageHistory() {
+		if history.IsSummary(msg) {
+			return i
+		}
+	}
+	t.Fatalf("裁剪后应生成摘要：%+v", client.GetMessageHistory())
+	return -1
+}
+
+func TestOpenaiClientClearHistoryDropsSummary(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	client := NewOpenAIClient("test-key", server.URL, "gpt-test", nil, "系统提示词", "")
+	trimWithSummary(t, client, server)
+
+	//清空后只保留系统提示词，旧对话的摘要不带入新对话
+	client.ClearHistory()
+	messages := client.GetMessageHistory()
+	if len(messages) != 1 || messages[0].Content != "系统提示词" {
+		t.Errorf("清空后应只保留系统提示词：%+v", messages)
+	}
+}
+
+func TestOpenaiClientSetSystemPromptKeepsSummary(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	client := NewOpenAIClient("test-key", server.URL, "gpt-test", nil, "", "")
+	if pos := trimWithSummary(t, client, server); pos != 0 {
+		t.Fatalf("没有系统提示词时摘要应位于最前，实际位于%d", pos)
+	}
+
+	//设置提示词不应删除摘要，新提示词位于摘要之前
+	client.SetSystemPrompt("新提示词")
+	client.SetSystemPrompt("再次替换")
+	messages := client.GetMessageHistory()
+	if messages[0].Role != openai.ChatMessageRoleSystem || messages[0].Content != "再次替换" {
+		t.Errorf("系统提示词应位于最前：%+v", messages)
+	}
+	if !history.IsSummary(messages[1]) {
+		t.Errorf("摘要应保留在系统提示词之后：%+v", messages)
+	}
+	for _, msg := range messages[2:] {
+		if msg.Role == openai.ChatMessageRoleSystem {
+			t.Errorf("只应有一个系统提示词：%+v", messages)
+		}
+	}
+}
@@ -1,18 +1,27 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"github.com/joho/godotenv"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	OpenAI    OpenAIConfig    `json:"openai"`
-	Embedding EmbeddingConfig `json:"embedding"`
-	App       AppConfig       `json:"app"`
-	Agent     AgentConfig     `json:"agent"`
+	OpenAI     OpenAIConfig     `json:"openai"`
+	Ollama     OllamaConfig     `json:"ollama"`
+	Embedding  EmbeddingConfig  `json:"embedding"`
+	Generation GenerationConfig `json:"generation"`
+	History    HistoryConfig    `json:"history"`
+	Usage      UsageConfig      `json:"usage"`
+	Fallback   FallbackConfig   `json:"fallback"`
+	ToolResult ToolResultConfig `json:"tool_result"`
+	MCP        MCPConfig        `json:"mcp"`
+	App        AppConfig        `json:"app"`
+	Agent      AgentConfig      `json:"agent"`
 }
 
 type OpenAIConfig struct {
@@ -21,22 +30,90 @@ type OpenAIConfig struct {
 	Model   string `json:"model"`
 }
 
+type OllamaConfig struct {
+	BaseURL     string   `json:"base_url"`
+	Model       string   `json:"model"`
+	NumCtx      int      `json:"num_ctx"`
+	Temperature *float64 `json:"temperature"` // 未设置时使用模型默认值
+}
+
 type EmbeddingConfig struct {
 	BaseURL string `json:"base_url"`
 	APIKey  string `json:"api_key"`
 	Model   string `json:"model"`
 }
+
+// 模型生成参数，未设置的项使用服务端默认值
+type GenerationConfig struct {
+	Temperature    *float64 `json:"temperature"`
+	TopP           *float64 `json:"top_p"`
+	MaxTokens      int      `json:"max_tokens"`
+	Stop           []string `json:"stop"`
+	Seed           *int     `json:"seed"`
+	ResponseFormat string   `json:"response_format"`
+	ToolChoice     string   `json:"tool_choice"`
+}
+
+type HistoryConfig struct {
+	MaxTokens     int  `json:"max_tokens"`     // 0 表示不裁剪
+	ReserveTokens int  `json:"reserve_tokens"` // 为模型回复预留
+	KeepTurns     int  `json:"keep_turns"`
+	Summarize     bool `json:"summarize"`
+}
+
+// 工具结果大小限制（字符数）
+type ToolResultConfig struct {
+	MaxChars int            `json:"max_chars"` // 默认上限，0 表示不限制
+	Limits   map[string]int `json:"limits"`    // 按 client.tool 或 client 覆盖
+	SpillDir string         `json:"spill_dir"` // 完整结果保存目录，为空时直接丢弃被截断的部分
+}
+
+// mcp服务健康检查与自动重连
+type MCPConfig struct {
+	PingInterval time.Duration `json:"ping_interval"` // 心跳间隔，0 表示不发送心跳
+	MaxRestarts  int           `json:"max_restarts"`  // 连接断开后的最大重连次数
+
+	SamplingMaxTokens int             `json:"sampling_max_tokens"` // 服务请求模型采样时的输出token上限，0 表示不限制
+	SamplingModels    []FallbackModel `json:"sampling_models"`     // 可按服务的模型偏好选择的模型
+
+	LogDir    string `json:"log_dir"`    // 不为空时将每个服务的日志写入 <LogDir>/<服务名>.log
+	LogBuffer int    `json:"log_buffer"` // 每个服务在内存中保留的日志条数
+}
+
+// 模型故障转移链，主模型失败时按顺序尝试
+type FallbackConfig struct {
+	Models         []FallbackModel `json:"models"`
+	Cooldown       time.Duration   `json:"cooldown"`        // 失败模型的冷却时间
+	AttemptTimeout time.Duration   `json:"attempt_timeout"` // 单次尝试超时，0 表示不限制
+}
+
+type FallbackModel struct {
+	Provider string `json:"provider"` // openai 或 ollama，使用对应服务商的地址与密钥
+	Model    string `json:"model"`
+}
+
+type UsageConfig struct {
+	PriceFile string  `json:"price_file"` // 模型价格表JSON文件
+	MaxCost   float64 `json:"max_cost"`   // 进程内费用上限，0 表示不限制
+	MaxTokens int     `json:"max_tokens"` // 进程内token上限，0 表示不限制
+}
+
 type AppConfig struct {
-	LogLevel   string        `json:"log_level"`
-	MaxRetries int           `json:"max_retries"`
-	Timeout    time.Duration `json:"timeout"`
-	Debug      bool          `json:"debug"`
+	ChatProvider string        `json:"chat_provider"` // openai 或 ollama
+	SessionDir   string        `json:"session_dir"`   // 会话文件保存目录
+	CassetteMode string        `json:"cassette_mode"` // record 或 replay，为空时不记录
+	CassettePath string        `json:"cassette_path"` // 记录文件路径
+	LogLevel     string        `json:"log_level"`
+	MaxRetries   int           `json:"max_retries"`
+	Timeout      time.Duration `json:"timeout"`
+	Debug        bool          `json:"debug"`
 }
 
 type AgentConfig struct {
 	Name         string `json:"name"`
 	SystemPrompt string `json:"systemPrompt"`
 	Context      string `json:"context"`
+	Vision       bool   `json:"vision"` // 模型支持图片输入时，工具返回的图片会发送给模型
 }
 
 func LoadConfig() (*Config, error) {
@@ -44,29 +121,84 @@ func LoadConfig() (*Config, error) {
 		fmt.Printf("加载环境变量失败：%v\n", err)
 		return nil, err
 	}
+	env := &envReader{}
 	config := &Config{
 		OpenAI: OpenAIConfig{
 			APIKey:  getEnvString("OPENAI_API_KEY"),
 			BaseURL: getEnvString("OPENAI_BASE_URL"),
 			Model:   getEnvString("OPENAI_MODEL"),
 		},
+		Ollama: OllamaConfig{
+			BaseURL:     getEnvString("OLLAMA_BASE_URL"),
+			Model:       getEnvString("OLLAMA_MODEL"),
+			NumCtx:      env.getInt("OLLAMA_NUM_CTX", 0),
+			Temperature: env.getFloatPtr("OLLAMA_TEMPERATURE"),
+		},
 		Embedding: EmbeddingConfig{
 			BaseURL: getEnvString("EMBEDDING_BASE_URL"),
 			APIKey:  getEnvString("EMBEDDING_KEY"),
 			Model:   getEnvString("EMBEDDING_MODEL"),
 		},
+		Generation: GenerationConfig{
+			Temperature:    env.getFloatPtr("LLM_TEMPERATURE"),
+			TopP:           env.getFloatPtr("LLM_TOP_P"),
+			MaxTokens:      env.getInt("LLM_MAX_TOKENS", 0),
+			Stop:           getEnvList("LLM_STOP"),
+			Seed:           env.getIntPtr("LLM_SEED"),
+			ResponseFormat: getEnvString("LLM_RESPONSE_FORMAT"),
+			ToolChoice:     getEnvString("LLM_TOOL_CHOICE"),
+		},
+		History: HistoryConfig{
+			MaxTokens:     env.getInt("CONTEXT_MAX_TOKENS", 0),
+			ReserveTokens: env.getInt("CONTEXT_RESERVE_TOKENS", 1024),
+			KeepTurns:     env.getInt("CONTEXT_KEEP_TURNS", 4),
+			Summarize:     env.getBool("CONTEXT_SUMMARIZE", false),
+		},
+		Fallback: FallbackConfig{
+			Models:         parseFallbackModels(getEnvList("CHAT_FALLBACKS")),
+			Cooldown:       time.Duration(env.getInt("CHAT_FALLBACK_COOLDOWN_SECONDS", 60)) * time.Second,
+			AttemptTimeout: time.Duration(env.getInt("CHAT_ATTEMPT_TIMEOUT_SECONDS", 0)) * time.Second,
+		},
+		ToolResult: ToolResultConfig{
+			MaxChars: env.getInt("TOOL_RESULT_MAX_CHARS", 16000),
+			Limits:   parseToolLimits(getEnvList("TOOL_RESULT_LIMITS")),
+			SpillDir: getEnvString("TOOL_RESULT_SPILL_DIR"),
+		},
+		MCP: MCPConfig{
+			PingInterval: time.Duration(env.getInt("MCP_PING_INTERVAL_SECONDS", 30)) * time.Second,
+			MaxRestarts:  env.getInt("MCP_MAX_RESTARTS", 5),
+
+			SamplingMaxTokens: env.getInt("MCP_SAMPLING_MAX_TOKENS", 1024),
+			SamplingModels:    parseFallbackModels(getEnvList("MCP_SAMPLING_MODELS")),
+
+			LogDir:    getEnvString("MCP_LOG_DIR"),
+			LogBuffer: env.getInt("MCP_LOG_BUFFER", 500),
+		},
+		Usage: UsageConfig{
+			PriceFile: getEnvDefault("USAGE_PRICE_FILE", "model_prices.json"),
+			MaxCost:   env.getFloat("USAGE_BUDGET_COST", 0),
+			MaxTokens: env.getInt("USAGE_BUDGET_TOKENS", 0),
+		},
 		App: AppConfig{
-			LogLevel:   getEnvString("LOG_LEVEL"),
-			MaxRetries: getEnvInt("MAX_RETRIES", 3),
-			Timeout:    time.Duration(getEnvInt("TIMEOUT_SECONDS", 30)) * time.Second,
-			Debug:      getEnvBool("DEBUG", false),
+			ChatProvider: getEnvDefault("CHAT_PROVIDER", "openai"),
+			SessionDir:   getEnvDefault("SESSION_DIR", "sessions"),
+			CassetteMode: getEnvString("HTTP_CASSETTE_MODE"),
+			CassettePath: getEnvString("HTTP_CASSETTE_PATH"),
+			LogLevel:     getEnvString("LOG_LEVEL"),
+			MaxRetries:   env.getInt("MAX_RETRIES", 3),
+			Timeout:      time.Duration(env.getInt("TIMEOUT_SECONDS", 30)) * time.Second,
+			Debug:        env.getBool("DEBUG", false),
 		},
 		Agent: AgentConfig{
 			Name:         getEnvString("AGENT_NAME"),
 			SystemPrompt: defaultSystemPrompt("AGENT_SYSTEM_PROMPT"),
 			Context:      getEnvString("AGENT_CONTEXT"),
+			Vision:       env.getBool("LLM_VISION", false),
 		},
 	}
+	if err := env.err(); err != nil {
+		return nil, fmt.Errorf("配置验证失败：%w", err)
+	}
 	if err := config.Validate(); err != nil {
 		return nil, fmt.Errorf("配置验证失败：%w", err)
 	}
@@ -74,8 +206,17 @@ func LoadConfig() (*Config, error) {
 }
 
 func (c *Config) Validate() error {
-	if c.OpenAI.APIKey == "" {
-		return fmt.Errorf("OPENAI_API_KEY 不能为空")
+	switch c.App.ChatProvider {
+	case "openai":
+		if c.OpenAI.APIKey == "" {
+			return fmt.Errorf("OPENAI_API_KEY 不能为空")
+		}
+	case "ollama":
+		if c.Ollama.Model == "" {
+			return fmt.Errorf("OLLAMA_MODEL 不能为空")
+		}
+	default:
+		return fmt.Errorf("无效的CHAT_PROVIDER：%s", c.App.ChatProvider)
 	}
 	if c.Embedding.BaseURL == "" {
 		return fmt.Errorf("EMBEDDING_BASE_URL 不能为空 ")
@@ -93,6 +234,76 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("TIMEOUT_SECONDS 必需大于0")
 	}
 
+	if t := c.Generation.Temperature; t != nil && (*t < 0 || *t > 2) {
+		return fmt.Errorf("LLM_TEMPERATURE 必需在0到2之间")
+	}
+	if p := c.Generation.TopP; p != nil && (*p <= 0 || *p > 1) {
+		return fmt.Errorf("LLM_TOP_P 必需在0到1之间")
+	}
+	if c.Generation.MaxTokens < 0 {
+		return fmt.Errorf("LLM_MAX_TOKENS 不能为负数")
+	}
+	if !contains([]string{"", "text", "json_object"}, c.Generation.ResponseFormat) {
+		return fmt.Errorf("无效的LLM_RESPONSE_FORMAT：%s", c.Generation.ResponseFormat)
+	}
+	if !validToolChoice(c.Generation.ToolChoice) {
+		return fmt.Errorf("无效的LLM_TOOL_CHOICE：%s，可选 auto、none、required 或工具全名 client.tool", c.Generation.ToolChoice)
+	}
+
+	if c.History.MaxTokens > 0 && c.History.ReserveTokens >= c.History.MaxTokens {
+		return fmt.Errorf("CONTEXT_RESERVE_TOKENS 必需小于 CONTEXT_MAX_TOKENS")
+	}
+
+	for _, fallback := range c.Fallback.Models {
+		if fallback.Provider != "openai" && fallback.Provider != "ollama" {
+			return fmt.Errorf("CHAT_FALLBACKS 中无效的服务商：%s", fallback.Provider)
+		}
+		if fallback.Model == "" {
+			return fmt.Errorf("CHAT_FALLBACKS 中的模型不能为空，格式为 provider:model")
+		}
+		if fallback.Provider == "openai" && c.OpenAI.APIKey == "" {
+			return fmt.Errorf("CHAT_FALLBACKS 使用openai时 OPENAI_API_KEY 不能为空")
+		}
+	}
+
+	if c.ToolResult.MaxChars < 0 {
+		return fmt.Errorf("TOOL_RESULT_MAX_CHARS 不能为负数")
+	}
+	for name, limit := range c.ToolResult.Limits {
+		if name == "" || limit < 0 {
+			return fmt.Errorf("TOOL_RESULT_LIMITS 格式为 client.tool=字符数，且字符数不能为负数")
+		}
+	}
+
+	if c.MCP.PingInterval < 0 || c.MCP.MaxRestarts < 0 {
+		return fmt.Errorf("MCP_PING_INTERVAL_SECONDS 与 MCP_MAX_RESTARTS 不能为负数")
+	}
+	if c.MCP.SamplingMaxTokens < 0 {
+		return fmt.Errorf("MCP_SAMPLING_MAX_TOKENS 不能为负数")
+	}
+	if c.MCP.LogBuffer <= 0 {
+		return fmt.Errorf("MCP_LOG_BUFFER 必须大于0")
+	}
+	for _, model := range c.MCP.SamplingModels {
+		if model.Provider != "openai" && model.Provider != "ollama" {
+			return fmt.Errorf("MCP_SAMPLING_MODELS 中无效的服务商：%s", model.Provider)
+		}
+		if model.Model == "" {
+			return fmt.Errorf("MCP_SAMPLING_MODELS 中的模型不能为空，格式为 provider:model")
+		}
+	}
+
+	if c.Usage.MaxCost < 0 || c.Usage.MaxTokens < 0 {
+		return fmt.Errorf("USAGE_BUDGET_COST 与 USAGE_BUDGET_TOKENS 不能为负数")
+	}
+
+	if !contains([]string{"", "record", "replay"}, c.App.CassetteMode) {
+		return fmt.Errorf("无效的HTTP_CASSETTE_MODE：%s", c.App.CassetteMode)
+	}
+	if c.App.CassetteMode != "" && c.App.CassettePath == "" {
+		return fmt.Errorf("设置HTTP_CASSETTE_MODE时必须设置HTTP_CASSETTE_PATH")
+	}
+
 	validLogLevels := []string{"debug", "info", "warning", "error"}
 	if !contains(validLogLevels, c.App.LogLevel) {
 		return fmt.Errorf("无效的日志级别：%s", validLogLevels)
@@ -100,6 +311,33 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+// 解析 provider:model 列表，省略provider时默认为openai
+func parseFallbackModels(items []string) []FallbackModel {
+	models := make([]FallbackModel, 0, len(items))
+	for _, item := range items {
+		provider, model, found := strings.Cut(item, ":")
+		if !found {
+			provider, model = "openai", item
+		}
+		models = append(models, FallbackModel{Provider: strings.TrimSpace(provider), Model: strings.TrimSpace(model)})
+	}
+	return models
+}
+
+// 解析 name=limit 列表，无法解析的上限记为-1，由Validate报错
+func parseToolLimits(items []string) map[string]int {
+	limits := make(map[string]int, len(items))
+	for _, item := range items {
+		name, value, _ := strings.Cut(item, "=")
+		limit, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			limit = -1
+		}
+		limits[strings.TrimSpace(name)] = limit
+	}
+	return limits
+}
+
 func defaultSystemPrompt(key string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -109,31 +347,101 @@ func defaultSystemPrompt(key string) string {
 
 func getEnvString(key string) string {
 	value := os.Getenv(key)
-	if value == "" {
-		fmt.Errorf("环境变量%s不存在", key)
-		return ""
-	}
 	return value
 }
 
-func getEnvInt(key string, defaultValue int) int {
+func getEnvDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
-		}
+		return value
 	}
 	return defaultValue
 }
 
-func getEnvBool(key string, defaultValue bool) bool {
-	if value := os.Getenv(key); value != "" {
-		if boolValue, err := strconv.ParseBool(value); err == nil {
-			return boolValue
+// 读取数值与布尔类型的环境变量，记录无法解析的值
+type envReader struct {
+	errs []error
+}
+
+func (r *envReader) parse(key string, parse func(value string) error) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return false
+	}
+	if err := parse(strings.TrimSpace(value)); err != nil {
+		r.errs = append(r.errs, fmt.Errorf("%s 的值无效：%s", key, value))
+		return false
+	}
+	return true
+}
+
+// 返回所有无法解析的环境变量
+func (r *envReader) err() error {
+	return errors.Join(r.errs...)
+}
+
+func (r *envReader) getInt(key string, defaultValue int) int {
+	var intValue int
+	if r.parse(key, func(value string) (err error) { intValue, err = strconv.Atoi(value); return }) {
+		return intValue
+	}
+	return defaultValue
+}
+
+// 未设置或解析失败时返回nil
+func (r *envReader) getIntPtr(key string) *int {
+	var intValue int
+	if r.parse(key, func(value string) (err error) { intValue, err = strconv.Atoi(value); return }) {
+		return &intValue
+	}
+	return nil
+}
+
+// 逗号分隔的列表，忽略空项
+func getEnvList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
 	}
+	return items
+}
+
+func (r *envReader) getFloat(key string, defaultValue float64) float64 {
+	var floatValue float64
+	if r.parse(key, func(value string) (err error) { floatValue, err = strconv.ParseFloat(value, 64); return }) {
+		return floatValue
+	}
 	return defaultValue
 }
 
+// 未设置或解析失败时返回nil
+func (r *envReader) getFloatPtr(key string) *float64 {
+	var floatValue float64
+	if r.parse(key, func(value string) (err error) { floatValue, err = strconv.ParseFloat(value, 64); return }) {
+		return &floatValue
+	}
+	return nil
+}
+
+func (r *envReader) getBool(key string, defaultValue bool) bool {
+	var boolValue bool
+	if r.parse(key, func(value string) (err error) { boolValue, err = strconv.ParseBool(value); return }) {
+		return boolValue
+	}
+	return defaultValue
+}
+
+// 工具选择：auto、none、required 或工具全名 client.tool
+func validToolChoice(choice string) bool {
+	switch choice {
+	case "", "auto", "none", "required":
+		return true
+	}
+	server, tool, found := strings.Cut(choice, ".")
+	return found && server != "" && tool != "" && !strings.ContainsAny(choice, " \t")
+}
+
 func contains(slice []string, item string) bool {
 	for _, s := range slice {
 		if s == item {
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidToolChoice(t *testing.T) {
+	tests := []struct {
+		choice string
+		want   bool
+	}{
+		{"", true},
+		{"auto", true},
+		{"none", true},
+		{"required", true},
+		{"calc.add", true},
+		{"always", false},
+		{"calc", false},
+		{".add", false},
+		{"calc.", false},
+		{"calc. add", false},
+	}
+	for _, tt := range tests {
+		if got := validToolChoice(tt.choice); got != tt.want {
+			t.Errorf("validToolChoice(%q)：期望%v，实际%v", tt.choice, tt.want, got)
+		}
+	}
+}
+
+func TestEnvReaderReportsInvalidValues(t *testing.T) {
+	t.Setenv("TEST_INT", "12")
+	t.Setenv("TEST_BAD_INT", "12k")
+	t.Setenv("TEST_BAD_FLOAT", "warm")
+	t.Setenv("TEST_BAD_BOOL", "maybe")
+	env := &envReader{}
+	if got := env.getInt("TEST_INT", 0); got != 12 {
+		t.Errorf("getInt错误：%d", got)
+	}
+	if got := env.getInt("TEST_MISSING", 7); got != 7 {
+		t.Errorf("未设置时应使用默认值：%d", got)
+	}
+	if env.err() != nil {
+		t.Fatalf("合法的值不应报错：%v", env.err())
+	}
+
+	env.getInt("TEST_BAD_INT", 0)
+	if env.getFloatPtr("TEST_BAD_FLOAT") != nil {
+		t.Errorf("无法解析时应返回nil")
+	}
+	env.getBool("TEST_BAD_BOOL", false)
+	err := env.err()
+	for _, key := range []string{"TEST_BAD_INT", "TEST_BAD_FLOAT", "TEST_BAD_BOOL"} {
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("错误应包含%s：%v", key, err)
+		}
+	}
+}
+
+func TestValidateToolChoice(t *testing.T) {
+	config := &Config{
+		OpenAI:     OpenAIConfig{APIKey: "key"},
+		Embedding:  EmbeddingConfig{BaseURL: "http://localhost", APIKey: "key"},
+		Generation: GenerationConfig{ToolChoice: "requred"},
+		MCP:        MCPConfig{LogBuffer: 1},
+		App:        AppConfig{ChatProvider: "openai", MaxRetries: 1, Timeout: 1, LogLevel: "info"},
+	}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "LLM_TOOL_CHOICE") {
+		t.Errorf("无效的工具选择应报错：%v", err)
+	}
+	config.Generation.ToolChoice = "calc.add"
+	if err := config.Validate(); err != nil {
+		t.Errorf("工具全名应合法：%v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"llm-mcp-rag-simple/types"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 根据服务请求的JSON Schema逐项询问用户，生成表单数据
+func (in *cliInput) elicit(ctx context.Context, request types.ElicitationRequest) (*types.ElicitationResult, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	fmt.Printf("\nmcp服务 %s 请求输入：%s\n", request.Server, request.Message)
+	answer, ok, err := in.readLineContext(ctx, "填写？[y]填写 [n]拒绝 [c]取消：")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return &types.ElicitationResult{Action: types.ElicitCancel}, nil
+	}
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+	case "n", "no":
+		return &types.ElicitationResult{Action: types.ElicitDecline}, nil
+	default:
+		return &types.ElicitationResult{Action: types.ElicitCancel}, nil
+	}
+
+	properties, _ := request.Schema["properties"].(map[string]interface{})
+	required := make(map[string]bool)
+	if list, ok := request.Schema["required"].([]interface{}); ok {
+		for _, name := range list {
+			if s, ok := name.(string); ok {
+				required[s] = true
+			}
+		}
+	}
+	//必填项在前，其余按名称排序
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if required[names[i]] != required[names[j]] {
+			return required[names[i]]
+		}
+		return names[i] < names[j]
+	})
+
+	content := make(map[string]interface{})
+	for _, name := range names {
+		property, _ := properties[name].(map[string]interface{})
+		value, ok, err := in.askField(ctx, name, property, required[name])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return &types.ElicitationResult{Action: types.ElicitCancel}, nil
+		}
+		if value != nil {
+			content[name] = value
+		}
+	}
+	return &types.ElicitationResult{Action: types.ElicitAccept, Content: content}, nil
+}
+
+// 询问单个字段，直到输入合法；输入结束时返回 false
+func (in *cliInput) askField(ctx context.Context, name string, property map[string]interface{}, required bool) (interface{}, bool, error) {
+	label := name
+	if title, _ := property["title"].(string); title != "" {
+		label = title
+	}
+	if description, _ := property["description"].(string); description != "" {
+		label += "（" + description + "）"
+	}
+	fieldType, _ := property["type"].(string)
+	options := enumOptions(property)
+	if len(options) > 0 {
+		label += "，可选：" + strings.Join(options, "/")
+	} else if fieldType == "boolean" {
+		label += "，y/n"
+	}
+	defaultValue, hasDefault := property["default"]
+	if hasDefault {
+		label += fmt.Sprintf("，默认 %v", defaultValue)
+	} else if !required {
+		label += "，可留空"
+	}
+
+	for {
+		input, ok, err := in.readLineContext(ctx, label+"：")
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		if input == "" {
+			if hasDefault {
+				return defaultValue, true, nil
+			}
+			if !required {
+				return nil, true, nil
+			}
+			fmt.Println("该字段为必填项")
+			continue
+		}
+		value, err := parseField(input, fieldType, property, options)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		return value, true, nil
+	}
+}
+
+// 按字段类型与约束解析输入
+func parseField(input, fieldType string, property map[string]interface{}, options []string) (interface{}, error) {
+	switch fieldType {
+	case "boolean":
+		switch strings.ToLower(input) {
+		case "y", "yes", "true":
+			return true, nil
+		case "n", "no", "false":
+			return false, nil
+		}
+		return nil, fmt.Errorf("请输入 y 或 n")
+	case "number", "integer":
+		number, err := strconv.ParseFloat(input, 64)
+		if err != nil {
+			return nil, fmt.Errorf("请输入数字")
+		}
+		if fieldType == "integer" && number != float64(int64(number)) {
+			return nil, fmt.Errorf("请输入整数")
+		}
+		if minimum, ok := property["minimum"].(float64); ok && number < minimum {
+			return nil, fmt.Errorf("不能小于%v", minimum)
+		}
+		if maximum, ok := property["maximum"].(float64); ok && number > maximum {
+			return nil, fmt.Errorf("不能大于%v", maximum)
+		}
+		if fieldType == "integer" {
+			return int64(number), nil
+		}
+		return number, nil
+	default:
+		if len(options) > 0 {
+			for _, option := range options {
+				if option == input {
+					return input, nil
+				}
+			}
+			return nil, fmt.Errorf("请从可选值中选择")
+		}
+		length := len([]rune(input))
+		if minLength, ok := property["minLength"].(float64); ok && float64(length) < minLength {
+			return nil, fmt.Errorf("至少需要%v个字符", minLength)
+		}
+		if maxLength, ok := property["maxLength"].(float64); ok && float64(length) > maxLength {
+			return nil, fmt.Errorf("最多%v个字符", maxLength)
+		}
+		return input, nil
+	}
+}
+
+// 字符串枚举的可选值
+func enumOptions(property map[string]interface{}) []string {
+	values, _ := property["enum"].([]interface{})
+	options := make([]string, 0, len(values))
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			options = append(options, s)
+		}
+	}
+	return options
+}
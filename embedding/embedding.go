@@ -6,7 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"llm-mcp-rag-simple/apierr"
 	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/usage"
 	"llm-mcp-rag-simple/utils"
 	"net/http"
 	"time"
@@ -34,15 +36,25 @@ func NewRetriever(embeddingModel, baseURL, apiKey string, vectorStore types.Vect
 	}
 }
 
+// 替换底层HTTP传输，用于记录/回放请求
+func (r *Retriever) SetHTTPTransport(transport http.RoundTripper) {
+	r.httpClient.Transport = transport
+}
+
 //将文档嵌入为向量，并存储
 
 func (r *Retriever) EmbedDocument(ctx context.Context, document string) ([]float64, error) {
+	return r.EmbedDocumentWithMetadata(ctx, document, nil)
+}
+
+// 将文档嵌入为向量，并连同元数据（如来源）一起存储
+func (r *Retriever) EmbedDocumentWithMetadata(ctx context.Context, document string, metadata map[string]interface{}) ([]float64, error) {
 	utils.LogTitle("EMBEDDING DOCUMENT")
 	embedding, err := r.embed(ctx, document)
 	if err != nil {
 		return nil, fmt.Errorf("文本向量化失败%w", err)
 	}
-	err = r.vectorStore.AddEmbedding(ctx, embedding, document, nil)
+	err = r.vectorStore.AddEmbedding(ctx, embedding, document, metadata)
 	if err != nil {
 		return nil, fmt.Errorf("存储向量失败%w", err)
 	}
@@ -105,13 +117,13 @@ func (r *Retriever) embed(ctx context.Context, text string) ([]float64, error) {
 
 	resp, err := r.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("发送请求错误：%w", err)
+		return nil, fmt.Errorf("发送请求错误：%w", apierr.Classify("embedding", err))
 	}
 	defer resp.Body.Close()
 	//检查响应状态
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("api 请求错误，错误码：%d,响应信息：%s", resp.StatusCode, body)
+		return nil, apierr.FromResponse("embedding", resp, body)
 	}
 
 	//解析响应
@@ -120,6 +132,8 @@ func (r *Retriever) embed(ctx context.Context, text string) ([]float64, error) {
 		return nil, fmt.Errorf("解析响应失败%w", err)
 	}
 
+	usage.RecordEmbedding(ctx, r.embeddingModel, embeddingResp.Usage.PromptTokens)
+
 	if len(embeddingResp.Data) == 0 {
 		return nil, fmt.Errorf("没有 embedding 数据")
 	}
@@ -0,0 +1,77 @@
+package embedding
+
+import (
+	"context"
+	"llm-mcp-rag-simple/fakeopenai"
+	"llm-mcp-rag-simple/usage"
+	"llm-mcp-rag-simple/vectorstore"
+	"reflect"
+	"testing"
+)
+
+func TestRetrieverEmbedsDeterministically(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	retriever := NewRetriever("embed-test", server.URL, "test-key", vectorstore.NewInMemoryVectorStore())
+
+	meter := usage.NewMeter()
+	ctx := usage.WithMeter(context.Background(), meter)
+	first, err := retriever.EmbedQuery(ctx, "go 语言 并发")
+	if err != nil {
+		t.Fatalf("EmbedQuery失败：%v", err)
+	}
+	second, err := retriever.EmbedQuery(ctx, "go 语言 并发")
+	if err != nil {
+		t.Fatalf("EmbedQuery失败：%v", err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("相同文本的向量不一致")
+	}
+	if !reflect.DeepEqual(first, fakeopenai.Vector("go 语言 并发", server.Dimensions)) {
+		t.Errorf("向量与服务器返回不一致")
+	}
+
+	requests := server.EmbeddingRequests()
+	if len(requests) != 2 || requests[0].Model != "embed-test" || requests[0].Input != "go 语言 并发" {
+		t.Errorf("嵌入请求错误：%+v", requests)
+	}
+	if got := meter.ByModel()["embed-test"]; got.EmbeddingTokens != 6 {
+		t.Errorf("嵌入用量错误：%+v", got)
+	}
+}
+
+func TestRetrieverRetrievesStoredDocument(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	store := vectorstore.NewInMemoryVectorStore()
+	retriever := NewRetriever("embed-test", server.URL, "test-key", store)
+
+	ctx := context.Background()
+	documents := []string{"猫喜欢晒太阳", "Go 使用 goroutine 实现并发", "今天天气很好"}
+	for _, document := range documents {
+		if _, err := retriever.EmbedDocument(ctx, document); err != nil {
+			t.Fatalf("EmbedDocument失败：%v", err)
+		}
+	}
+	if retriever.GetVectorStoreSize() != len(documents) {
+		t.Fatalf("向量库文档数错误：%d", retriever.GetVectorStoreSize())
+	}
+
+	//相同文本的向量完全相同，应排在第一位
+	results, err := retriever.Retrieve(ctx, documents[1], 1)
+	if err != nil {
+		t.Fatalf("Retrieve失败：%v", err)
+	}
+	if len(results) != 1 || results[0] != documents[1] {
+		t.Errorf("检索结果错误：%v", results)
+	}
+}
+
+func TestRetrieverRejectsEmptyText(t *testing.T) {
+	server := fakeopenai.NewServer(t)
+	retriever := NewRetriever("embed-test", server.URL, "test-key", vectorstore.NewInMemoryVectorStore())
+	if _, err := retriever.EmbedQuery(context.Background(), ""); err == nil {
+		t.Errorf("空文本应返回错误")
+	}
+	if len(server.EmbeddingRequests()) != 0 {
+		t.Errorf("空文本不应发送请求")
+	}
+}
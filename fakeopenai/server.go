@@ -0,0 +1,298 @@
+package fakeopenai
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 进程内的OpenAI兼容测试服务器，实现 /chat/completions（流式与非流式）与 /embeddings
+// 聊天回复按脚本顺序返回，收到的请求全部保存，供测试断言
+type Server struct {
+	URL        string // 作为客户端的 BaseURL 使用
+	Dimensions int    // 嵌入向量维度，默认 8
+
+	t       testing.TB
+	server  *httptest.Server
+	mu      sync.Mutex
+	replies []Reply
+	chats   []openai.ChatCompletionRequest
+	embeds  []EmbeddingRequest
+}
+
+// 一条脚本化的聊天回复
+type Reply struct {
+	Content    string
+	ToolCalls  []ToolCall
+	Usage      *openai.Usage
+	Finish     openai.FinishReason                          // 结束原因，为空时按是否有工具调用决定
+	StatusCode int                                          // 非0且不是200时返回错误响应
+	Error      string                                       // 错误响应中的 message
+	Header     map[string]string                            // 额外的响应头，如 Retry-After
+	Check      func(req openai.ChatCompletionRequest) error // 对收到的请求进行断言
+}
+
+type ToolCall struct {
+	ID        string
+	Name      string
+	Arguments string
+}
+
+type EmbeddingRequest struct {
+	Model string `json:"model"`
+	Input string `json:"input"`
+}
+
+// 启动服务器，测试结束时自动关闭
+func NewServer(t testing.TB) *Server {
+	s := &Server{t: t, Dimensions: 8}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chat/completions", s.handleChat)
+	mux.HandleFunc("/embeddings", s.handleEmbeddings)
+	s.server = httptest.NewServer(mux)
+	s.URL = s.server.URL
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// 追加聊天回复，按请求顺序依次使用
+func (s *Server) Enqueue(replies ...Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies = append(s.replies, replies...)
+}
+
+// 收到的聊天请求
+func (s *Server) ChatRequests() []openai.ChatCompletionRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]openai.ChatCompletionRequest(nil), s.chats...)
+}
+
+// 收到的嵌入请求
+func (s *Server) EmbeddingRequests() []EmbeddingRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]EmbeddingRequest(nil), s.embeds...)
+}
+
+// 尚未使用的聊天回复数量
+func (s *Server) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.replies)
+}
+
+// 根据文本生成确定的单位向量，相同文本得到相同向量
+func Vector(text string, dimensions int) []float64 {
+	vector := make([]float64, dimensions)
+	var norm float64
+	for i := range vector {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%d:%s", i, text)
+		vector[i] = float64(h.Sum64()%2000)/1000 - 1
+		norm += vector[i] * vector[i]
+	}
+	norm = math.Sqrt(norm)
+	if norm == 0 {
+		return vector
+	}
+	for i := range vector {
+		vector[i] /= norm
+	}
+	return vector
+}
+
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	var req openai.ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("无效的请求：%v", err))
+		return
+	}
+
+	s.mu.Lock()
+	s.chats = append(s.chats, req)
+	if len(s.replies) == 0 {
+		s.mu.Unlock()
+		s.t.Errorf("fakeopenai: 收到第%d个聊天请求，但没有待返回的回复", len(s.chats))
+		writeError(w, http.StatusInternalServerError, "没有待返回的回复")
+		return
+	}
+	reply := s.replies[0]
+	s.replies = s.replies[1:]
+	s.mu.Unlock()
+
+	if reply.Check != nil {
+		if err := reply.Check(req); err != nil {
+			s.t.Errorf("fakeopenai: 聊天请求断言失败：%v", err)
+		}
+	}
+	for key, value := range reply.Header {
+		w.Header().Set(key, value)
+	}
+	if reply.StatusCode != 0 && reply.StatusCode != http.StatusOK {
+		writeError(w, reply.StatusCode, reply.Error)
+		return
+	}
+	if req.Stream {
+		s.writeStream(w, req, reply)
+		return
+	}
+	writeJSON(w, openai.ChatCompletionResponse{
+		ID:     "chatcmpl-fake",
+		Object: "chat.completion",
+		Model:  req.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message: openai.ChatCompletionMessage{
+				Role:      openai.ChatMessageRoleAssistant,
+				Content:   reply.Content,
+				ToolCalls: reply.toolCalls(true),
+			},
+			FinishReason: reply.finishReason(),
+		}},
+		Usage: reply.usage(),
+	})
+}
+
+// 以SSE分片返回：内容按词切分，工具调用的参数拆成两段，最后返回用量与 [DONE]
+func (s *Server) writeStream(w http.ResponseWriter, req openai.ChatCompletionRequest, reply Reply) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	send := func(chunk openai.ChatCompletionStreamResponse) {
+		chunk.ID = "chatcmpl-fake"
+		chunk.Object = "chat.completion.chunk"
+		chunk.Model = req.Model
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	delta := func(d openai.ChatCompletionStreamChoiceDelta) {
+		send(openai.ChatCompletionStreamResponse{Choices: []openai.ChatCompletionStreamChoice{{Delta: d}}})
+	}
+
+	delta(openai.ChatCompletionStreamChoiceDelta{Role: openai.ChatMessageRoleAssistant})
+	for _, piece := range splitContent(reply.Content) {
+		delta(openai.ChatCompletionStreamChoiceDelta{Content: piece})
+	}
+	for i, call := range reply.toolCalls(false) {
+		index := i
+		half := len(call.Function.Arguments) / 2
+		call.Index = &index
+		first := call
+		first.Function.Arguments = call.Function.Arguments[:half]
+		delta(openai.ChatCompletionStreamChoiceDelta{ToolCalls: []openai.ToolCall{first}})
+		delta(openai.ChatCompletionStreamChoiceDelta{ToolCalls: []openai.ToolCall{{
+			Index:    &index,
+			Function: openai.FunctionCall{Arguments: call.Function.Arguments[half:]},
+		}}})
+	}
+	send(openai.ChatCompletionStreamResponse{Choices: []openai.ChatCompletionStreamChoice{{FinishReason: reply.finishReason()}}})
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		usage := reply.usage()
+		send(openai.ChatCompletionStreamResponse{Choices: []openai.ChatCompletionStreamChoice{}, Usage: &usage})
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func (s *Server) handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	var req EmbeddingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("无效的请求：%v", err))
+		return
+	}
+	s.mu.Lock()
+	s.embeds = append(s.embeds, req)
+	dimensions := s.Dimensions
+	s.mu.Unlock()
+
+	tokens := len(strings.Fields(req.Input))
+	writeJSON(w, map[string]interface{}{
+		"object": "list",
+		"model":  req.Model,
+		"data": []map[string]interface{}{{
+			"object":    "embedding",
+			"index":     0,
+			"embedding": Vector(req.Input, dimensions),
+		}},
+		"usage": map[string]int{"prompt_tokens": tokens, "total_tokens": tokens},
+	})
+}
+
+func (r Reply) toolCalls(withIndex bool) []openai.ToolCall {
+	var calls []openai.ToolCall
+	for i, call := range r.ToolCalls {
+		id := call.ID
+		if id == "" {
+			id = fmt.Sprintf("call_%d", i+1)
+		}
+		toolCall := openai.ToolCall{
+			ID:       id,
+			Type:     openai.ToolTypeFunction,
+			Function: openai.FunctionCall{Name: call.Name, Arguments: call.Arguments},
+		}
+		if withIndex {
+			index := i
+			toolCall.Index = &index
+		}
+		calls = append(calls, toolCall)
+	}
+	return calls
+}
+
+func (r Reply) finishReason() openai.FinishReason {
+	if r.Finish != "" {
+		return r.Finish
+	}
+	if len(r.ToolCalls) > 0 {
+		return openai.FinishReasonToolCalls
+	}
+	return openai.FinishReasonStop
+}
+
+func (r Reply) usage() openai.Usage {
+	if r.Usage != nil {
+		return *r.Usage
+	}
+	return openai.Usage{}
+}
+
+// 按空白切分内容，保留分隔符，模拟逐词输出
+func splitContent(content string) []string {
+	var pieces []string
+	start := 0
+	for i, ch := range content {
+		if ch == ' ' && i > start {
+			pieces = append(pieces, content[start:i])
+			start = i
+		}
+	}
+	if start < len(content) {
+		pieces = append(pieces, content[start:])
+	}
+	return pieces
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    "fake_error",
+		},
+	})
+}
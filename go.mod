@@ -6,13 +6,13 @@ toolchain go1.24.3
 
 require (
 	github.com/fatih/color v1.18.0
+	github.com/google/jsonschema-go v0.3.0
 	github.com/joho/godotenv v1.5.1
 	github.com/modelcontextprotocol/go-sdk v0.8.0
 	github.com/sashabaranov/go-openai v1.41.2
 )
 
 require (
-	github.com/google/jsonschema-go v0.3.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/yosida95/uritemplate/v3 v3.0.2 // indirect
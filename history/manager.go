@@ -0,0 +1,215 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/utils"
+	"strings"
+)
+
+// 摘要消息前缀，用于在历史中识别滚动摘要
+const SummaryPrefix = "[对话摘要]"
+
+// 上下文消息前缀，用于在历史中识别代理注入的上下文（AGENT_CONTEXT）
+const ContextPrefix = "[背景信息]"
+
+// 将被淘汰的消息与之前的摘要合并为新摘要
+type Summarizer func(ctx context.Context, previousSummary string, evicted []types.ChatMessage) (string, error)
+
+type Config struct {
+	MaxTokens     int  // 上下文预算，<=0 表示不裁剪
+	ReserveTokens int  // 为模型回复预留的token数
+	KeepTurns     int  // 至少保留的最近轮数（一轮从一条用户消息开始）
+	Summarize     bool // 是否将淘汰的轮次总结为摘要
+}
+
+// 上下文预算管理：估算token，超出预算时淘汰最早的轮次
+type Manager struct {
+	maxTokens     int
+	reserveTokens int
+	keepTurns     int
+	summarize     bool
+	tokenizer     Tokenizer
+}
+
+func NewManager(config Config, tokenizer Tokenizer) *Manager {
+	if config.KeepTurns <= 0 {
+		config.KeepTurns = 1
+	}
+	if tokenizer == nil {
+		tokenizer = HeuristicTokenizer{}
+	}
+	return &Manager{
+		maxTokens:     config.MaxTokens,
+		reserveTokens: config.ReserveTokens,
+		keepTurns:     config.KeepTurns,
+		summarize:     config.Summarize,
+		tokenizer:     tokenizer,
+	}
+}
+
+// 裁剪结果：调用方按Keep下标重建自身的消息列表，并在SummaryPos处插入Summary
+type TrimResult struct {
+	Keep       []int              // 按顺序保留的消息下标
+	Summary    *types.ChatMessage // 新的摘要消息，nil 表示无需插入
+	SummaryPos int                // 摘要在保留消息中的插入位置
+}
+
+// 估算消息列表的总token数
+func (m *Manager) Estimate(messages []types.ChatMessage) int {
+	total := 0
+	for _, msg := range messages {
+		total += EstimateMessage(m.tokenizer, msg)
+	}
+	return total
+}
+
+// 检查消息是否超出预算，超出则返回裁剪方案；未超出返回nil
+// 系统消息与上下文消息始终保留；其他消息按轮次整体淘汰，保证工具调用与其结果不会被拆开
+func (m *Manager) Trim(ctx context.Context, messages []types.ChatMessage, summarizer Summarizer) *TrimResult {
+	if m.maxTokens <= 0 {
+		return nil
+	}
+	budget := m.maxTokens - m.reserveTokens
+	total := m.Estimate(messages)
+	if total <= budget {
+		return nil
+	}
+
+	var pinned []int
+	summaryIndex := -1
+	var turns [][]int
+	for i, msg := range messages {
+		if msg.Role == "system" {
+			if IsSummary(msg) {
+				summaryIndex = i
+				continue
+			}
+			pinned = append(pinned, i)
+			continue
+		}
+		if IsContext(msg) {
+			pinned = append(pinned, i)
+			continue
+		}
+		//用户消息开启新一轮，助手工具调用与工具结果归入同一轮
+		if msg.Role == "user" || len(turns) == 0 {
+			turns = append(turns, nil)
+		}
+		turns[len(turns)-1] = append(turns[len(turns)-1], i)
+	}
+
+	//从最早的轮次开始淘汰，至少保留最近keepTurns轮
+	var evicted []types.ChatMessage
+	evictedTurns := 0
+	for evictedTurns < len(turns)-m.keepTurns && total > budget {
+		for _, i := range turns[evictedTurns] {
+			total -= EstimateMessage(m.tokenizer, messages[i])
+			evicted = append(evicted, messages[i])
+		}
+		evictedTurns++
+	}
+	if evictedTurns == 0 {
+		utils.LogWarn(fmt.Sprintf("对话历史约%d tokens超出预算%d，但最近%d轮不可裁剪", total, budget, m.keepTurns))
+		return nil
+	}
+	utils.LogDebug(fmt.Sprintf("裁剪对话历史：淘汰%d轮共%d条消息", evictedTurns, len(evicted)))
+
+	result := &TrimResult{Keep: append([]int(nil), pinned...), SummaryPos: len(pinned)}
+	keepOldSummary := summaryIndex >= 0
+	if m.summarize && summarizer != nil {
+		previous := ""
+		if summaryIndex >= 0 {
+			previous = strings.TrimSpace(strings.TrimPrefix(messages[summaryIndex].Content, SummaryPrefix))
+		}
+		summary, err := summarizer(ctx, previous, evicted)
+		if err != nil {
+			utils.LogWarn(fmt.Sprintf("生成对话摘要失败：%v", err))
+		} else if summary != "" {
+			msg := NewSummaryMessage(summary)
+			result.Summary = &msg
+			keepOldSummary = false
+		}
+	}
+	if keepOldSummary {
+		result.Keep = append(result.Keep, summaryIndex)
+	}
+	for _, turn := range turns[evictedTurns:] {
+		result.Keep = append(result.Keep, turn...)
+	}
+	return result
+}
+
+// 按裁剪方案重建调用方自身格式的消息列表，newSummary将摘要转换为对应格式
+func Apply[T any](messages []T, result *TrimResult, newSummary func(types.ChatMessage) T) []T {
+	trimmed := make([]T, 0, len(result.Keep)+1)
+	for i, index := range result.Keep {
+		if result.Summary != nil && i == result.SummaryPos {
+			trimmed = append(trimmed, newSummary(*result.Summary))
+		}
+		trimmed = append(trimmed, messages[index])
+	}
+	if result.Summary != nil && result.SummaryPos >= len(result.Keep) {
+		trimmed = append(trimmed, newSummary(*result.Summary))
+	}
+	return trimmed
+}
+
+// 构造摘要消息
+func NewSummaryMessage(summary string) types.ChatMessage {
+	return types.ChatMessage{
+		Role:    "system",
+		Content: SummaryPrefix + "\n" + summary,
+	}
+}
+
+// 判断是否为摘要消息
+func IsSummary(msg types.ChatMessage) bool {
+	return msg.Role == "system" && strings.HasPrefix(msg.Content, SummaryPrefix)
+}
+
+// 构造上下文消息
+func NewContextMessage(context string) types.ChatMessage {
+	return types.ChatMessage{
+		Role:    "user",
+		Content: ContextPrefix + "\n" + context,
+	}
+}
+
+// 判断是否为上下文消息
+func IsContext(msg types.ChatMessage) bool {
+	return msg.Role == "user" && strings.HasPrefix(msg.Content, ContextPrefix)
+}
+
+// 将消息格式化为纯文本对话记录，供摘要使用
+func FormatTranscript(messages []types.ChatMessage) string {
+	var builder strings.Builder
+	for _, msg := range messages {
+		builder.WriteString(msg.Role)
+		builder.WriteString(": ")
+		builder.WriteString(msg.Content)
+		if count := msg.ImageCount(); count > 0 {
+			builder.WriteString(fmt.Sprintf(" [%d张图片]", count))
+		}
+		for _, tc := range msg.ToolCalls {
+			builder.WriteString(fmt.Sprintf("\n  调用工具 %s(%s)", tc.Function.Name, tc.Function.Arguments))
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// 摘要请求的提示词
+func SummaryPrompt(previousSummary string, evicted []types.ChatMessage) string {
+	var builder strings.Builder
+	builder.WriteString("请将以下对话内容压缩为简洁的摘要，保留关键事实、用户意图、已得出的结论和工具调用结果，不要添加新信息。\n\n")
+	if previousSummary != "" {
+		builder.WriteString("已有摘要：\n")
+		builder.WriteString(previousSummary)
+		builder.WriteString("\n\n")
+	}
+	builder.WriteString("新增对话：\n")
+	builder.WriteString(FormatTranscript(evicted))
+	return builder.String()
+}
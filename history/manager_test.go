@@ -0,0 +1,307 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"llm-mcp-rag-simple/types"
+	"reflect"
+	"testing"
+)
+
+// 每段非空文本计6个token，普通消息共10个token，便于推算预算
+var fixedTokenizer = TokenizerFunc(func(text string) int {
+	if text == "" {
+		return 0
+	}
+	return 6
+})
+
+func toolCallMessage(id, name, arguments string) types.ChatMessage {
+	tc := types.ToolCall{ID: id}
+	tc.Function.Name = name
+	tc.Function.Arguments = arguments
+	return types.ChatMessage{Role: "assistant", ToolCalls: []types.ToolCall{tc}}
+}
+
+// 系统提示词、上下文消息与三轮对话，第一轮包含工具调用，共106个token
+func conversation() []types.ChatMessage {
+	return []types.ChatMessage{
+		{Role: "system", Content: "sys"},
+		NewContextMessage("背景"),
+		{Role: "user", Content: "u1"},
+		toolCallMessage("call_1", "weather__query", `{"city":"北京"}`),
+		{Role: "tool", Content: "r1", ToolCallID: "call_1"},
+		{Role: "assistant", Content: "a1"},
+		{Role: "user", Content: "u2"},
+		{Role: "assistant", Content: "a2"},
+		{Role: "user", Content: "u3"},
+		{Role: "assistant", Content: "a3"},
+	}
+}
+
+func TestManagerTrim(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   []int // nil 表示无需裁剪
+	}{
+		{
+			name:   "未超出预算",
+			config: Config{MaxTokens: 106},
+			want:   nil,
+		},
+		{
+			name:   "不限制预算",
+			config: Config{MaxTokens: 0},
+			want:   nil,
+		},
+		{
+			name:   "工具调用与结果整轮淘汰",
+			config: Config{MaxTokens: 100},
+			want:   []int{0, 1, 6, 7, 8, 9},
+		},
+		{
+			name:   "预留回复token计入预算",
+			config: Config{MaxTokens: 120, ReserveTokens: 20},
+			want:   []int{0, 1, 6, 7, 8, 9},
+		},
+		{
+			name:   "淘汰到预算以内",
+			config: Config{MaxTokens: 50},
+			want:   []int{0, 1, 8, 9},
+		},
+		{
+			name:   "至少保留最近轮次",
+			config: Config{MaxTokens: 50, KeepTurns: 2},
+			want:   []int{0, 1, 6, 7, 8, 9},
+		},
+		{
+			name:   "最近轮次不可裁剪",
+			config: Config{MaxTokens: 50, KeepTurns: 3},
+			want:   nil,
+		},
+		{
+			name:   "系统消息与上下文消息始终保留",
+			config: Config{MaxTokens: 1},
+			want:   []int{0, 1, 8, 9},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := NewManager(tt.config, fixedTokenizer)
+			result := manager.Trim(context.Background(), conversation(), nil)
+			if tt.want == nil {
+				if result != nil {
+					t.Fatalf("期望无需裁剪，实际保留%v", result.Keep)
+				}
+				return
+			}
+			if result == nil {
+				t.Fatalf("期望裁剪为%v，实际未裁剪", tt.want)
+			}
+			if !reflect.DeepEqual(result.Keep, tt.want) {
+				t.Errorf("保留的消息错误：期望%v，实际%v", tt.want, result.Keep)
+			}
+			if result.Summary != nil {
+				t.Errorf("未开启摘要时不应生成摘要：%v", result.Summary)
+			}
+		})
+	}
+}
+
+func TestManagerTrimSummary(t *testing.T) {
+	//旧摘要位于系统提示词之后
+	messages := conversation()
+	messages = append(messages[:1], append([]types.ChatMessage{NewSummaryMessage("旧摘要")}, messages[1:]...)...)
+
+	tests := []struct {
+		name        string
+		summarize   bool
+		summary     string
+		err         error
+		wantKeep    []int
+		wantSummary string // 为空表示不插入新摘要
+		wantCalled  bool
+	}{
+		{
+			name:        "新摘要替换淘汰的轮次与旧摘要",
+			summarize:   true,
+			summary:     "新摘要",
+			wantKeep:    []int{0, 2, 7, 8, 9, 10},
+			wantSummary: SummaryPrefix + "\n新摘要",
+			wantCalled:  true,
+		},
+		{
+			name:       "摘要失败时保留旧摘要",
+			summarize:  true,
+			err:        errors.New("模型不可用"),
+			wantKeep:   []int{0, 2, 1, 7, 8, 9, 10},
+			wantCalled: true,
+		},
+		{
+			name:       "摘要为空时保留旧摘要",
+			summarize:  true,
+			wantKeep:   []int{0, 2, 1, 7, 8, 9, 10},
+			wantCalled: true,
+		},
+		{
+			name:     "未开启摘要时不调用",
+			wantKeep: []int{0, 2, 1, 7, 8, 9, 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			summarizer := func(ctx context.Context, previous string, evicted []types.ChatMessage) (string, error) {
+				called = true
+				if previous != "旧摘要" {
+					t.Errorf("旧摘要错误：%q", previous)
+				}
+				var contents []string
+				for _, msg := range evicted {
+					contents = append(contents, msg.Role+":"+msg.Content)
+				}
+				want := []string{"user:u1", "assistant:", "tool:r1", "assistant:a1"}
+				if !reflect.DeepEqual(contents, want) {
+					t.Errorf("淘汰的消息错误：期望%v，实际%v", want, contents)
+				}
+				return tt.summary, tt.err
+			}
+			manager := NewManager(Config{MaxTokens: 100, Summarize: tt.summarize}, fixedTokenizer)
+			result := manager.Trim(context.Background(), messages, summarizer)
+			if result == nil {
+				t.Fatal("期望裁剪")
+			}
+			if called != tt.wantCalled {
+				t.Errorf("摘要调用错误：期望%v，实际%v", tt.wantCalled, called)
+			}
+			if !reflect.DeepEqual(result.Keep, tt.wantKeep) {
+				t.Errorf("保留的消息错误：期望%v，实际%v", tt.wantKeep, result.Keep)
+			}
+			if tt.wantSummary == "" {
+				if result.Summary != nil {
+					t.Errorf("不应插入新摘要：%v", result.Summary)
+				}
+				return
+			}
+			if result.Summary == nil || result.Summary.Content != tt.wantSummary || !IsSummary(*result.Summary) {
+				t.Fatalf("新摘要错误：%v", result.Summary)
+			}
+			//摘要插入在固定消息之后
+			if result.SummaryPos != 2 {
+				t.Errorf("摘要位置错误：%d", result.SummaryPos)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	messages := []string{"sys", "ctx", "u1", "a1", "u2", "a2"}
+	summary := NewSummaryMessage("摘要")
+	tests := []struct {
+		name   string
+		result TrimResult
+		want   []string
+	}{
+		{
+			name:   "无摘要",
+			result: TrimResult{Keep: []int{0, 1, 4, 5}, SummaryPos: 2},
+			want:   []string{"sys", "ctx", "u2", "a2"},
+		},
+		{
+			name:   "摘要插入在固定消息之后",
+			result: TrimResult{Keep: []int{0, 1, 4, 5}, Summary: &summary, SummaryPos: 2},
+			want:   []string{"sys", "ctx", "summary", "u2", "a2"},
+		},
+		{
+			name:   "摘要位于末尾",
+			result: TrimResult{Keep: []int{0}, Summary: &summary, SummaryPos: 1},
+			want:   []string{"sys", "summary"},
+		},
+		{
+			name:   "没有固定消息",
+			result: TrimResult{Keep: []int{4, 5}, Summary: &summary, SummaryPos: 0},
+			want:   []string{"summary", "u2", "a2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Apply(messages, &tt.result, func(msg types.ChatMessage) string {
+				if !IsSummary(msg) {
+					t.Errorf("期望摘要消息，实际%v", msg)
+				}
+				return "summary"
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("期望%v，实际%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestIsContext(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  types.ChatMessage
+		want bool
+	}{
+		{"上下文消息", NewContextMessage("背景"), true},
+		{"普通用户消息", types.ChatMessage{Role: "user", Content: "背景"}, false},
+		{"系统消息", types.ChatMessage{Role: "system", Content: ContextPrefix}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsContext(tt.msg); got != tt.want {
+				t.Errorf("期望%v，实际%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHeuristicTokenizer(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"abcd", 1},
+		{"abcde", 2},
+		{"你好", 2},
+		{"你好abcd", 3},
+		{"，。", 2},
+		{"こんにちは", 5},
+	}
+	for _, tt := range tests {
+		if got := (HeuristicTokenizer{}).CountTokens(tt.text); got != tt.want {
+			t.Errorf("%q：期望%d，实际%d", tt.text, tt.want, got)
+		}
+	}
+}
+
+func TestEstimateMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  types.ChatMessage
+		want int
+	}{
+		{"文本", types.ChatMessage{Role: "user", Content: "hi"}, messageOverhead + 6},
+		{"空消息", types.ChatMessage{Role: "assistant"}, messageOverhead},
+		{"工具调用计入名称与参数", toolCallMessage("call_1", "tool", "{}"), messageOverhead + 12},
+		{
+			name: "图片",
+			msg: types.ChatMessage{Role: "user", Content: "看图", Parts: []types.ContentPart{
+				{Type: types.ContentPartText, Text: "看图"},
+				{Type: types.ContentPartImage, ImageURL: "https://example.com/a.png"},
+				{Type: types.ContentPartImage, ImageURL: "https://example.com/b.png"},
+			}},
+			want: messageOverhead + 6 + 2*imageTokens,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EstimateMessage(fixedTokenizer, tt.msg); got != tt.want {
+				t.Errorf("期望%d，实际%d", tt.want, got)
+			}
+		})
+	}
+}
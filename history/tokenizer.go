@@ -0,0 +1,54 @@
+package history
+
+import (
+	"llm-mcp-rag-simple/types"
+	"unicode"
+)
+
+// 估算文本token数，可替换为模型对应的精确分词器
+type Tokenizer interface {
+	CountTokens(text string) int
+}
+
+// 函数适配为Tokenizer
+type TokenizerFunc func(text string) int
+
+func (f TokenizerFunc) CountTokens(text string) int {
+	return f(text)
+}
+
+// 启发式估算：中日韩字符约1个token/字，其他字符约4个字符/token
+type HeuristicTokenizer struct{}
+
+func (HeuristicTokenizer) CountTokens(text string) int {
+	cjk, other := 0, 0
+	for _, r := range text {
+		if isCJK(r) {
+			cjk++
+		} else {
+			other++
+		}
+	}
+	return cjk + (other+3)/4
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) ||
+		(r >= 0x3000 && r <= 0x303F) || // 中日韩标点
+		(r >= 0xFF00 && r <= 0xFFEF) // 全角字符
+}
+
+// 单条消息的固定开销（角色、分隔符等）
+const messageOverhead = 4
+
+// 单张图片的估算token数（按高精度 1024x1024 图片计）
+const imageTokens = 765
+
+// 估算单条消息的token数，包含图片、工具调用名称与参数
+func EstimateMessage(t Tokenizer, msg types.ChatMessage) int {
+	tokens := messageOverhead + t.CountTokens(msg.Content) + msg.ImageCount()*imageTokens
+	for _, tc := range msg.ToolCalls {
+		tokens += t.CountTokens(tc.Function.Name) + t.CountTokens(tc.Function.Arguments)
+	}
+	return tokens
+}
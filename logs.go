@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"llm-mcp-rag-simple/agent"
+	"llm-mcp-rag-simple/utils"
+	"strconv"
+)
+
+// 显示mcp服务最近的日志
+func printLogs(agent *agent.Agent, server string, args []string) {
+	limit := 50
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			fmt.Println("条数必须为正整数")
+			return
+		}
+		limit = n
+	}
+	entries, err := agent.MCPLogs(server, limit)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("获取日志失败：%v", err))
+		return
+	}
+	if len(entries) == 0 {
+		fmt.Println("没有日志")
+		return
+	}
+	fmt.Printf("\n%s 最近%d条日志:\n", server, len(entries))
+	for _, entry := range entries {
+		fmt.Println(entry)
+	}
+}
+
+// 设置mcp服务的日志级别
+func setLogLevel(agent *agent.Agent, server, level string) {
+	if err := agent.SetMCPLogLevel(context.Background(), server, level); err != nil {
+		utils.LogError(fmt.Sprintf("设置日志级别失败：%v", err))
+		return
+	}
+	fmt.Printf("%s 的日志级别已设置为 %s\n", server, level)
+}
+
+// 实时显示长时间工具调用的进度
+func printProgress(server, tool string, progress, total float64, message string) {
+	fmt.Printf("[%s] %s 进度 %v", server, tool, progress)
+	if total > 0 {
+		fmt.Printf("/%v (%.0f%%)", total, progress/total*100)
+	}
+	if message != "" {
+		fmt.Printf(" %s", message)
+	}
+	fmt.Println()
+}
@@ -1,18 +1,22 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"io/fs"
 	"llm-mcp-rag-simple/agent"
+	"llm-mcp-rag-simple/cassette"
 	"llm-mcp-rag-simple/chat"
 	"llm-mcp-rag-simple/config"
 	"llm-mcp-rag-simple/embedding"
+	"llm-mcp-rag-simple/history"
 	mcpClient "llm-mcp-rag-simple/mcp"
+	"llm-mcp-rag-simple/session"
 	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/usage"
 	"llm-mcp-rag-simple/utils"
 	"llm-mcp-rag-simple/vectorstore"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -37,29 +41,98 @@ func main() {
 	vectorStore := vectorstore.NewInMemoryVectorStore()
 	embeddingRetriever := embedding.NewRetriever(cfg.Embedding.Model, cfg.Embedding.BaseURL, cfg.Embedding.APIKey, vectorStore)
 
-	chatClient := chat.NewOpenAIClient(cfg.OpenAI.APIKey, cfg.OpenAI.BaseURL, cfg.OpenAI.Model, []types.Tool{}, "", "")
+	//记录或回放HTTP请求
+	var transport http.RoundTripper
+	if cfg.App.CassetteMode != "" {
+		recorder, err := cassette.New(cfg.App.CassettePath, cassette.Mode(cfg.App.CassetteMode), cfg.OpenAI.APIKey, cfg.Embedding.APIKey)
+		if err != nil {
+			fmt.Printf("初始化cassette失败：%v\n", err)
+			os.Exit(1)
+		}
+		transport = recorder
+		embeddingRetriever.SetHTTPTransport(transport)
+		utils.LogInfo(fmt.Sprintf("HTTP请求%s模式：%s", cfg.App.CassetteMode, cfg.App.CassettePath))
+	}
+
+	historyManager := history.NewManager(history.Config{
+		MaxTokens:     cfg.History.MaxTokens,
+		ReserveTokens: cfg.History.ReserveTokens,
+		KeepTurns:     cfg.History.KeepTurns,
+		Summarize:     cfg.History.Summarize,
+	}, nil)
+	newChatClient := func() types.ChatClient {
+		return createChatClient(cfg, historyManager, transport)
+	}
 
 	//创建agent实例
 	agentConfig := agent.AgentConfig{
 		Name:         cfg.Agent.Name,
 		SystemPrompt: cfg.Agent.SystemPrompt,
 		Context:      cfg.Agent.Context,
-		MaxRetries:   cfg.App.MaxRetries,
-		Timeout:      cfg.App.Timeout,
+		Vision:       cfg.Agent.Vision,
+		ToolResults: agent.ToolResultLimits{
+			MaxChars: cfg.ToolResult.MaxChars,
+			PerTool:  cfg.ToolResult.Limits,
+			SpillDir: cfg.ToolResult.SpillDir,
+		},
+		MaxRetries: cfg.App.MaxRetries,
+		Timeout:    cfg.App.Timeout,
+		Generation: types.GenerationOptions{
+			Temperature:    cfg.Generation.Temperature,
+			TopP:           cfg.Generation.TopP,
+			MaxTokens:      cfg.Generation.MaxTokens,
+			Stop:           cfg.Generation.Stop,
+			Seed:           cfg.Generation.Seed,
+			ResponseFormat: cfg.Generation.ResponseFormat,
+			ToolChoice:     cfg.Generation.ToolChoice,
+		},
+		Prices: loadPriceTable(cfg.Usage.PriceFile),
+		Budget: usage.Budget{
+			MaxCost:   cfg.Usage.MaxCost,
+			MaxTokens: cfg.Usage.MaxTokens,
+		},
 	}
-	agentInstance := agent.NewAgent(agentConfig, chatClient, embeddingRetriever, vectorStore)
+	//工具调用审批与交互命令共用标准输入
+	stdin := newCLIInput()
+	agentConfig.Approve = stdin.approve
+	agentConfig.Elicit = stdin.elicit
+	agentConfig.Sampling = agent.SamplingConfig{
+		MaxTokens: cfg.MCP.SamplingMaxTokens,
+		Approve:   stdin.approveSampling,
+	}
+	for _, model := range cfg.MCP.SamplingModels {
+		agentConfig.Sampling.Models = append(agentConfig.Sampling.Models, agent.SamplingModel{
+			Name: model.Model,
+			NewChatClient: func() types.ChatClient {
+				return createProviderClient(cfg, model.Provider, model.Model, historyManager, transport)
+			},
+		})
+	}
+	agentInstance := agent.NewAgent(agentConfig, newChatClient, embeddingRetriever, vectorStore)
 
 	//加载知识库
 	if err := loadKnowledgeBase(ctx, agentInstance); err != nil {
 		utils.LogWarn(fmt.Sprintf("加载知识库失败：%v", err))
 	}
 	//初始化mcp客户端
-	if err := initializeMCPClients(ctx, agentInstance); err != nil {
+	if err := initializeMCPClients(ctx, agentInstance, cfg.MCP); err != nil {
 		utils.LogWarn(fmt.Sprintf("初始化mcp客户端失败：%v", err))
 	}
 
+	//会话存储
+	sessionStore, err := session.NewStore(cfg.App.SessionDir)
+	if err != nil {
+		fmt.Printf("初始化会话存储失败：%v\n", err)
+		os.Exit(1)
+	}
+	sessions := &cliSessions{
+		store:        sessionStore,
+		current:      session.New(""),
+		conversation: agentInstance.NewConversation(),
+	}
+
 	go func() {
-		if err := runInteractiveSession(ctx, agentInstance); err != nil {
+		if err := runInteractiveSession(ctx, agentInstance, sessions, stdin); err != nil {
 			utils.LogError(fmt.Sprintf("运行交互会话失败：%v", err))
 			cancel()
 		}
@@ -74,6 +147,67 @@ func main() {
 	utils.LogInfo("GoodBye!")
 }
 
+// 根据CHAT_PROVIDER创建对应的聊天客户端，配置了CHAT_FALLBACKS时组合为故障转移客户端
+func createChatClient(cfg *config.Config, historyManager *history.Manager, transport http.RoundTripper) types.ChatClient {
+	primaryModel := cfg.OpenAI.Model
+	if cfg.App.ChatProvider == "ollama" {
+		primaryModel = cfg.Ollama.Model
+	}
+	primary := createProviderClient(cfg, cfg.App.ChatProvider, primaryModel, historyManager, transport)
+	if len(cfg.Fallback.Models) == 0 {
+		return primary
+	}
+	entries := []chat.FailoverEntry{{Name: cfg.App.ChatProvider + ":" + primaryModel, Client: primary}}
+	for _, fallback := range cfg.Fallback.Models {
+		entries = append(entries, chat.FailoverEntry{
+			Name:   fallback.Provider + ":" + fallback.Model,
+			Client: createProviderClient(cfg, fallback.Provider, fallback.Model, historyManager, transport),
+		})
+	}
+	return chat.NewFailoverClient(entries, chat.FailoverOptions{
+		Cooldown:       cfg.Fallback.Cooldown,
+		AttemptTimeout: cfg.Fallback.AttemptTimeout,
+	})
+}
+
+// 创建指定服务商与模型的聊天客户端，transport 非nil时替换底层HTTP传输
+func createProviderClient(cfg *config.Config, provider, model string, historyManager *history.Manager, transport http.RoundTripper) types.ChatClient {
+	switch provider {
+	case "ollama":
+		options := chat.OllamaOptions{
+			NumCtx:      cfg.Ollama.NumCtx,
+			Temperature: cfg.Ollama.Temperature,
+		}
+		client := chat.NewOllamaClient(cfg.Ollama.BaseURL, model, options, []types.Tool{}, "", "")
+		client.SetHistoryManager(historyManager)
+		if transport != nil {
+			client.SetHTTPTransport(transport)
+		}
+		return client
+	default:
+		client := chat.NewOpenAIClient(cfg.OpenAI.APIKey, cfg.OpenAI.BaseURL, model, []types.Tool{}, "", "")
+		client.SetHistoryManager(historyManager)
+		if transport != nil {
+			client.SetHTTPTransport(transport)
+		}
+		return client
+	}
+}
+
+// 加载模型价格表，文件不存在时只统计token不计算费用
+func loadPriceTable(path string) usage.PriceTable {
+	if _, err := os.Stat(path); err != nil {
+		return usage.PriceTable{}
+	}
+	prices, err := usage.LoadPriceTable(path)
+	if err != nil {
+		utils.LogWarn(fmt.Sprintf("加载价格表%s失败：%v", path, err))
+		return usage.PriceTable{}
+	}
+	utils.LogInfo(fmt.Sprintf("成功加载价格表%s", path))
+	return prices
+}
+
 // 从知识目录加载文档到向量数据库
 func loadKnowledgeBase(ctx context.Context, agent *agent.Agent) error {
 	knowledgeDir := "knowledge"
@@ -115,7 +249,7 @@ func loadKnowledgeBase(ctx context.Context, agent *agent.Agent) error {
 }
 
 // 初始mcp客户端
-func initializeMCPClients(ctx context.Context, agent *agent.Agent) error {
+func initializeMCPClients(ctx context.Context, agent *agent.Agent, settings config.MCPConfig) error {
 	//从配置文件中加载mcp server配置
 	serverConfigs := []mcpClient.ServerConfig{}
 	const defaultJSON = "mcp_servers.json"
@@ -132,71 +266,160 @@ func initializeMCPClients(ctx context.Context, agent *agent.Agent) error {
 		utils.LogWarn(fmt.Sprintf("默认mcp server配置文件%s不存在", defaultJSON))
 	}
 
+	if settings.LogDir != "" {
+		if err := os.MkdirAll(settings.LogDir, 0o755); err != nil {
+			return fmt.Errorf("创建mcp日志目录失败：%w", err)
+		}
+	}
+
 	for _, mcpCfg := range serverConfigs {
-		client := mcpClient.NewClient(mcpCfg.Name, mcpCfg.Command, mcpCfg.Args, "1.0.0")
+		client := mcpCfg.NewClient("1.0.0")
+		client.SetHealthOptions(mcpClient.HealthOptions{
+			PingInterval: settings.PingInterval,
+			MaxRestarts:  settings.MaxRestarts,
+		})
+		logOptions := mcpClient.LogOptions{BufferSize: settings.LogBuffer}
+		if settings.LogDir != "" {
+			logOptions.File = filepath.Join(settings.LogDir, mcpCfg.Name+".log")
+		}
+		client.SetLogOptions(logOptions)
+		client.SetProgressHandler(printProgress)
+		//采样请求可能在初始化后立即到达，先设置策略
+		agent.SetSamplingPolicy(mcpCfg.Name, samplingPolicy(mcpCfg))
 
 		if err := agent.AddMCPClient(mcpCfg.Name, client); err != nil {
 			utils.LogWarn(fmt.Sprintf("添加mcp client【%s】失败：%v", mcpCfg.Name, err))
 			client.Close()
 			continue
 		}
+		agent.SetToolPolicy(mcpCfg.Name, toolPolicy(mcpCfg))
+		for _, uri := range mcpCfg.Resources {
+			if err := agent.IngestResource(ctx, mcpCfg.Name, uri); err != nil {
+				utils.LogWarn(fmt.Sprintf("导入mcp client【%s】的资源失败：%v", mcpCfg.Name, err))
+			}
+		}
 		utils.LogInfo(fmt.Sprintf("成功添加mcp client【%s】", mcpCfg.Name))
 	}
 	return nil
 }
 
 // 运行交互聊天会话
-func runInteractiveSession(ctx context.Context, agent *agent.Agent) error {
-	scanner := bufio.NewScanner(os.Stdin)
+func runInteractiveSession(ctx context.Context, agent *agent.Agent, sessions *cliSessions, stdin *cliInput) error {
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		default:
-			fmt.Printf("\n>")
-			if !scanner.Scan() {
-				if err := scanner.Err(); err != nil {
-					return fmt.Errorf("读取用户输入失败：%w", err)
-				}
+			input, ok, err := stdin.readLine("\n>")
+			if err != nil {
+				return fmt.Errorf("读取用户输入失败：%w", err)
+			}
+			if !ok {
 				return nil
 			}
-			input := strings.TrimSpace(scanner.Text())
 			if input == "" {
 				continue
 			}
+			//以 / 开头的为mcp提示词命令
+			if strings.HasPrefix(input, "/") {
+				runSlashCommand(ctx, agent, sessions, stdin, input)
+				continue
+			}
 			//处理特殊命令
-			if handled := handleSpecialCommands(input, agent); handled {
+			if handled := handleSpecialCommands(input, agent, sessions); handled {
 				continue
 			}
 
-			//用户查询
-			response, err := agent.Query(ctx, input)
+			//用户查询，附加的图片随本条消息发送
+			response, err := agent.Query(ctx, sessions.conversation, input, sessions.queryOptions())
 			if err != nil {
 				utils.LogError(fmt.Sprintf("查询失败：%v", err))
 				continue
 			}
-			fmt.Printf("Assistant:\n %s\n", response.Content)
+			sessions.attachments = nil
+			printResponse(response)
+			sessions.save()
 		}
 
 	}
 }
 
+// 显示模型回复
+func printResponse(response *types.ChatResponse) {
+	fmt.Printf("Assistant:\n %s\n", response.Content)
+	if response.Model != "" {
+		utils.LogDebug(fmt.Sprintf("响应模型：%s", response.Model))
+	}
+	if response.Usage != nil {
+		utils.LogDebug(fmt.Sprintf("本次用量：输入%d，输出%d，嵌入%d，费用%.6f", response.Usage.PromptTokens, response.Usage.CompletionTokens, response.Usage.EmbeddingTokens, response.Usage.Cost))
+	}
+}
+
 // 自定义对话交互命令
-func handleSpecialCommands(input string, agent *agent.Agent) bool {
-	switch strings.ToLower(input) {
+func handleSpecialCommands(input string, agent *agent.Agent, sessions *cliSessions) bool {
+	fields := strings.Fields(input)
+	command := strings.ToLower(fields[0])
+	args := fields[1:]
+	//带参数的会话命令
+	switch {
+	case command == "resume" && len(args) == 1:
+		sessions.resume(args[0])
+		return true
+	case command == "rename" && len(args) >= 2:
+		sessions.rename(args[0], strings.Join(args[1:], " "))
+		return true
+	case command == "fork" && len(args) >= 1:
+		sessions.fork(args[0], strings.Join(args[1:], " "))
+		return true
+	case command == "delete" && len(args) == 1:
+		sessions.delete(args[0])
+		return true
+	case command == "attach" && len(args) >= 1:
+		attachImages(sessions, args)
+		return true
+	case command == "resources" && len(args) == 1:
+		printResources(agent, args[0])
+		return true
+	case command == "read" && len(args) == 2:
+		printResource(agent, args[0], args[1])
+		return true
+	case command == "ingest" && len(args) >= 2:
+		ingestResources(agent, args[0], args[1:])
+		return true
+	case command == "logs" && (len(args) == 1 || len(args) == 2):
+		printLogs(agent, args[0], args[1:])
+		return true
+	case command == "loglevel" && len(args) == 2:
+		setLogLevel(agent, args[0], args[1])
+		return true
+	}
+	if len(args) > 0 {
+		return false
+	}
+	switch command {
 	case "help":
 		printHelp()
 		return true
 	case "clear":
-		agent.ClearHistory()
-		fmt.Println("历史消息已清除")
+		sessions.startNew()
+		fmt.Println("历史消息已清除，已开始新会话")
 		return true
 	case "history":
-		printHistory(agent)
+		printHistory(sessions.conversation)
+		return true
+	case "detach":
+		sessions.attachments = nil
+		fmt.Println("已清除待发送的图片")
+		return true
+	case "sessions":
+		sessions.list()
 		return true
 	case "clients":
 		printMCPClients(agent)
 		return true
+	case "usage":
+		printUsage(agent, sessions.conversation)
+		return true
 	case "exit", "quit":
 		fmt.Println("GoodBye")
 		os.Exit(0)
@@ -209,15 +432,30 @@ func handleSpecialCommands(input string, agent *agent.Agent) bool {
 
 func printHelp() {
 	fmt.Println("\nAvailable commands:")
-	fmt.Println("  help     - Show this help message")
-	fmt.Println("  clear    - Clear chat history")
-	fmt.Println("  history  - Show chat history")
-	fmt.Println("  clients  - Show available MCP clients")
-	fmt.Println("  exit     - Exit the application")
+	fmt.Println("  help                 - Show this help message")
+	fmt.Println("  clear                - Clear chat history and start a new session")
+	fmt.Println("  history              - Show chat history")
+	fmt.Println("  sessions             - List saved sessions")
+	fmt.Println("  resume <id>          - Resume a saved session")
+	fmt.Println("  rename <id> <name>   - Rename a saved session")
+	fmt.Println("  fork <id> [name]     - Copy a session and continue in the copy")
+	fmt.Println("  delete <id>          - Delete a saved session")
+	fmt.Println("  attach <path|url>... - Attach images to the next message")
+	fmt.Println("  detach               - Remove pending image attachments")
+	fmt.Println("  clients              - Show available MCP clients")
+	fmt.Println("  resources <server>   - List MCP resources and resource templates")
+	fmt.Println("  read <server> <uri>  - Show the content of an MCP resource")
+	fmt.Println("  ingest <server> <uri> - Add MCP resources to the knowledge base")
+	fmt.Println("  logs <server> [n]    - Show recent MCP server logs (default 50)")
+	fmt.Println("  loglevel <server> <level> - Set the MCP server logging level")
+	fmt.Println("  usage                - Show token usage and cost")
+	fmt.Println("  /prompts             - List MCP prompts")
+	fmt.Println("  /<server>:<prompt> [name=value]... - Run an MCP prompt")
+	fmt.Println("  exit                 - Exit the application")
 	fmt.Println("\nOr just type your question to chat with the agent.")
 }
-func printHistory(agent *agent.Agent) {
-	history := agent.GetMessageHistory()
+func printHistory(conv *agent.Conversation) {
+	history := conv.GetMessageHistory()
 	if len(history) == 0 {
 		fmt.Println("没有历史消息 ")
 		return
@@ -225,8 +463,28 @@ func printHistory(agent *agent.Agent) {
 	fmt.Println("\n 历史消息:")
 	for i, msg := range history {
 		fmt.Printf("%d. %s: %s\n", i+1, msg.Role, msg.Content)
+		if count := msg.ImageCount(); count > 0 {
+			fmt.Printf("   [%d张图片]\n", count)
+		}
+		for _, tc := range msg.ToolCalls {
+			fmt.Printf("   -> %s(%s)\n", tc.Function.Name, tc.Function.Arguments)
+		}
+	}
+}
+
+// 加载图片并附加到下一条消息
+func attachImages(sessions *cliSessions, sources []string) {
+	for _, source := range sources {
+		image, err := chat.LoadImage(source)
+		if err != nil {
+			utils.LogError(fmt.Sprintf("附加图片失败：%v", err))
+			continue
+		}
+		sessions.attachments = append(sessions.attachments, image)
 	}
+	fmt.Printf("已附加%d张图片，将随下一条消息发送\n", len(sessions.attachments))
 }
+
 func printMCPClients(agent *agent.Agent) {
 	clients := agent.GetMCPClient()
 	if len(clients) == 0 {
@@ -235,6 +493,30 @@ func printMCPClients(agent *agent.Agent) {
 	}
 	fmt.Println("\n可用的MCP客户端:")
 	for i, client := range clients {
-		fmt.Printf("%d,%s \n", i+1, client)
+		status, _ := agent.MCPClientStatus(client)
+		fmt.Printf("%d,%s [%s] 工具:%d 重启:%d\n", i+1, client, status.State, status.Tools, status.Restarts)
+		if status.LastError != "" {
+			fmt.Printf("   最近错误: %s\n", status.LastError)
+		}
+	}
+}
+
+func printUsage(agent *agent.Agent, conv *agent.Conversation) {
+	sessionTotal, sessionModels := conv.Usage()
+	processTotal, processModels := agent.Usage()
+	printUsageTable("当前会话用量", sessionTotal, sessionModels)
+	printUsageTable("进程累计用量", processTotal, processModels)
+}
+
+func printUsageTable(title string, total types.Usage, models []usage.ModelUsage) {
+	fmt.Printf("\n%s:\n", title)
+	if len(models) == 0 {
+		fmt.Println("  暂无用量")
+		return
+	}
+	fmt.Printf("  %-30s %10s %10s %10s %12s\n", "模型", "输入", "输出", "嵌入", "费用")
+	for _, m := range models {
+		fmt.Printf("  %-30s %10d %10d %10d %12.6f\n", m.Model, m.PromptTokens, m.CompletionTokens, m.EmbeddingTokens, m.Cost)
 	}
+	fmt.Printf("  %-30s %10d %10d %10d %12.6f\n", "合计", total.PromptTokens, total.CompletionTokens, total.EmbeddingTokens, total.Cost)
 }
@@ -2,28 +2,56 @@ package mcp
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"llm-mcp-rag-simple/apierr"
 	"llm-mcp-rag-simple/types"
 	"llm-mcp-rag-simple/utils"
+	"net/http"
+	"os"
 	"os/exec"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Client struct {
-	name    string   //客户端名称
-	version string   //版本号
-	command string   //mcp服务可执行文件路径
-	args    []string //mcp服务的命令行参数
+	name    string            //客户端名称
+	version string            //版本号
+	command string            //mcp服务可执行文件路径
+	args    []string          //mcp服务的命令行参数
+	env     map[string]string // 追加到服务进程的环境变量
+	dir     string            // 服务进程的工作目录
+	remote  *RemoteOptions    // 不为nil时连接远程服务，忽略command与args
 
 	client    *mcp.Client
-	session   *mcp.ClientSession    //客户端会话
-	transport *mcp.CommandTransport //命令传输层
+	session   *mcp.ClientSession //客户端会话
+	transport mcp.Transport      //传输层
 
 	//状态管理
-	tools  []types.Tool
-	mu     sync.RWMutex
-	closed bool //客户端是否关闭
+	tools    []types.Tool
+	mu       sync.RWMutex
+	closed   bool //客户端是否关闭
+	state    types.MCPClientState
+	lastErr  error
+	restarts int
+	health   HealthOptions
+	lifetime context.Context // 客户端生命周期，关闭时取消，用于服务进程与重连
+	cancel   context.CancelFunc
+	refresh  sync.Mutex // 串行刷新工具列表，保证按通知顺序生效
+
+	subscriptions   map[string]bool // 已订阅的资源URI
+	resourceUpdated func(uri string)
+	sampling        types.SamplingHandler // 为nil时不声明 sampling 能力
+	elicitation     types.ElicitationHandler
+	roots           []Root
+
+	logs     *logBuffer // 服务的stderr、日志通知与进度
+	logFile  string
+	logLevel string
+	progress ProgressFunc
+	callSeq  atomic.Int64 // 进度令牌序号
 }
 
 func NewClient(name, command string, args []string, version string) *Client {
@@ -36,42 +64,170 @@ func NewClient(name, command string, args []string, version string) *Client {
 		command: command,
 		args:    args,
 		tools:   make([]types.Tool, 0),
+		state:   types.MCPStateStarting,
+		health:  defaultHealthOptions(),
+		logs:    newLogBuffer(0),
 	}
 }
 
+// 远程MCP服务的连接选项
+type RemoteOptions struct {
+	Transport   string            // http（Streamable HTTP，默认）或 sse（旧版 HTTP+SSE）
+	URL         string            // 服务端点
+	Headers     map[string]string // 每个请求附带的请求头
+	BearerToken string            // 不为空时设置 Authorization: Bearer <token>
+}
+
+// 创建连接远程服务的客户端
+func NewRemoteClient(name string, options RemoteOptions, version string) *Client {
+	client := NewClient(name, "", nil, version)
+	client.remote = &options
+	return client
+}
+
 // 初始化并连接到服务
 func (c *Client) Init(ctx context.Context) error {
 	utils.LogInfo(fmt.Sprintf("初始化mcp client %s", c.name))
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	if c.client != nil {
+		c.mu.Unlock()
 		return fmt.Errorf("client 已经初始化了")
 	}
-	//创建mcp客户端实例
+	//创建mcp客户端实例，心跳失败时会话会被关闭并触发重连
 	impl := &mcp.Implementation{
 		Name:    c.name,
 		Version: c.version,
 	}
-	c.client = mcp.NewClient(impl, nil)
-	//命令传输层
-	// CommandTransport负责启动外部MCP服务器进程并管理通信
-	cmd := exec.CommandContext(ctx, c.command, c.args...)
-	c.transport = &mcp.CommandTransport{
-		Command: cmd,
+	options := &mcp.ClientOptions{
+		KeepAlive:                   c.health.PingInterval,
+		ToolListChangedHandler:      c.onToolListChanged,
+		ResourceUpdatedHandler:      c.onResourceUpdated,
+		LoggingMessageHandler:       c.onLoggingMessage,
+		ProgressNotificationHandler: c.onProgress,
 	}
-	//建立连接并创建会话
-	session, err := c.client.Connect(ctx, c.transport, nil)
+	if c.sampling != nil {
+		options.CreateMessageHandler = c.createMessage
+	}
+	if c.elicitation != nil {
+		options.ElicitationHandler = c.elicit
+	}
+	if c.logFile != "" {
+		if err := c.logs.openFile(c.logFile); err != nil {
+			c.mu.Unlock()
+			return err
+		}
+	}
+	c.client = mcp.NewClient(impl, options)
+	c.client.AddRoots(toMCPRoots(c.roots)...)
+	c.lifetime, c.cancel = context.WithCancel(context.Background())
+	c.state = types.MCPStateStarting
+	c.mu.Unlock()
+
+	session, err := c.connect(ctx)
 	if err != nil {
-		return fmt.Errorf("连接mcp服务错误,%w", err)
+		//释放本次初始化创建的资源，允许之后再次调用Init重试
+		c.mu.Lock()
+		c.cancel()
+		c.client = nil
+		c.transport = nil
+		c.logs.close()
+		c.state = types.MCPStateFailed
+		c.lastErr = err
+		c.mu.Unlock()
+		return err
 	}
+	c.mu.Lock()
 	c.session = session
+	c.state = types.MCPStateReady
+	c.mu.Unlock()
+	go c.monitor(session)
+
+	utils.LogInfo(fmt.Sprintf("mcp client 发现%d个工具，工具列表:%v", len(c.GetTools()), c.getToolNames()))
+	return nil
+}
+
+// 建立连接并获取工具列表，服务进程的生命周期与客户端一致
+func (c *Client) connect(ctx context.Context) (*mcp.ClientSession, error) {
+	c.mu.RLock()
+	client := c.client
+	lifetime := c.lifetime
+	c.mu.RUnlock()
+	if client == nil {
+		return nil, fmt.Errorf("mcp client 已关闭")
+	}
+
+	transport, err := c.newTransport(lifetime)
+	if err != nil {
+		return nil, err
+	}
+	//建立连接并创建会话
+	session, err := client.Connect(ctx, transport, nil)
+	if err != nil {
+		return nil, fmt.Errorf("连接mcp服务错误,%w", err)
+	}
 	//获取工具列表
-	if err := c.ListTools(ctx); err != nil {
-		return fmt.Errorf("获取工具列表失败:%w", err)
+	tools, err := fetchTools(ctx, session)
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("获取工具列表失败:%w", err)
 	}
+	c.mu.Lock()
+	c.transport = transport
+	c.tools = tools
+	c.mu.Unlock()
+	c.resubscribe(ctx, session)
+	c.applyLogLevel(ctx, session)
+	return session, nil
+}
 
-	utils.LogInfo(fmt.Sprintf("mcp client 发现%d个工具，工具列表:%v", len(c.tools), c.getToolNames()))
-	return nil
+// 根据配置创建传输层
+func (c *Client) newTransport(ctx context.Context) (mcp.Transport, error) {
+	if c.remote == nil {
+		// CommandTransport负责启动外部MCP服务器进程并管理通信
+		cmd := exec.CommandContext(ctx, c.command, c.args...)
+		cmd.Dir = c.dir
+		cmd.Stderr = &lineWriter{emit: func(line string) { c.addLog("stderr", "", "", line) }}
+		if len(c.env) > 0 {
+			cmd.Env = os.Environ()
+			for key, value := range c.env {
+				cmd.Env = append(cmd.Env, key+"="+value)
+			}
+		}
+		return &mcp.CommandTransport{Command: cmd}, nil
+	}
+	headers := make(map[string]string, len(c.remote.Headers)+1)
+	for key, value := range c.remote.Headers {
+		headers[key] = value
+	}
+	if c.remote.BearerToken != "" {
+		headers["Authorization"] = "Bearer " + c.remote.BearerToken
+	}
+	httpClient := &http.Client{Transport: &headerTransport{base: http.DefaultTransport, headers: headers}}
+	switch c.remote.Transport {
+	case "", "http":
+		return &mcp.StreamableClientTransport{Endpoint: c.remote.URL, HTTPClient: httpClient}, nil
+	case "sse":
+		return &mcp.SSEClientTransport{Endpoint: c.remote.URL, HTTPClient: httpClient}, nil
+	default:
+		return nil, fmt.Errorf("不支持的传输方式：%s", c.remote.Transport)
+	}
+}
+
+// 为每个请求添加固定请求头
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.headers) == 0 {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	return t.base.RoundTrip(req)
 }
 
 // 关闭mcp客户端，并清理资源
@@ -83,6 +239,9 @@ func (c *Client) Close() error {
 		return nil
 	}
 	c.closed = true
+	if c.cancel != nil {
+		c.cancel()
+	}
 	if c.session != nil {
 		c.session.Close()
 		c.session = nil
@@ -90,6 +249,7 @@ func (c *Client) Close() error {
 	//清理客户端引用
 	c.client = nil
 	c.transport = nil
+	c.logs.close()
 	utils.LogInfo(fmt.Sprintf("mcp client [%s],关闭", c.name))
 
 	return nil
@@ -111,7 +271,12 @@ func (c *Client) CallTool(ctx context.Context, name string, params map[string]in
 	// 检查客户端是否已关闭或未初始化
 	if c.closed || c.session == nil {
 		c.mu.RUnlock()
-		return nil, fmt.Errorf("mcp client 不可用")
+		return nil, apierr.New(apierr.KindToolFailure, "mcp", fmt.Errorf("mcp client 不可用"))
+	}
+	if c.state != types.MCPStateReady {
+		state := c.state
+		c.mu.RUnlock()
+		return nil, apierr.New(apierr.KindToolFailure, "mcp", fmt.Errorf("mcp client【%s】当前状态为%s，暂时无法调用工具", c.name, state))
 	}
 	session := c.session
 	c.mu.RUnlock()
@@ -119,11 +284,14 @@ func (c *Client) CallTool(ctx context.Context, name string, params map[string]in
 		Name:      name,
 		Arguments: params,
 	}
+	//Meta为nil时SetProgressToken不会生效
+	callParams.Meta = mcp.Meta{}
+	callParams.SetProgressToken(c.progressToken(name))
 
 	//通过会话调用工具
 	result, err := session.CallTool(ctx, callParams)
 	if err != nil {
-		return nil, fmt.Errorf("调用工具%s错误：%w", name, err)
+		return nil, apierr.New(apierr.KindToolFailure, "mcp", fmt.Errorf("调用工具%s错误：%w", name, err))
 	}
 
 	toolResult := c.convertCallToolResult(result)
@@ -131,74 +299,130 @@ func (c *Client) CallTool(ctx context.Context, name string, params map[string]in
 
 }
 
-// 从mcp服务获取工具列表
+// 从mcp服务重新获取工具列表
 func (c *Client) ListTools(ctx context.Context) error {
+	c.mu.RLock()
+	session := c.session
+	c.mu.RUnlock()
+	if session == nil {
+		return fmt.Errorf("mcp client 不可用")
+	}
+	tools, err := fetchTools(ctx, session)
+	if err != nil {
+		return err
+	}
+	//更新工具列表
+	c.mu.Lock()
+	c.tools = tools
+	c.mu.Unlock()
+	return nil
+}
 
-	result, err := c.session.ListTools(ctx, &mcp.ListToolsParams{})
+// 服务端通知工具列表变化，在新协程中刷新，避免阻塞会话的消息处理
+func (c *Client) onToolListChanged(ctx context.Context, req *mcp.ToolListChangedRequest) {
+	go c.refreshTools(req.Session)
+}
+
+// 重新拉取工具列表并整体替换，会话已被替换或客户端已关闭时丢弃结果
+func (c *Client) refreshTools(session *mcp.ClientSession) {
+	c.refresh.Lock()
+	defer c.refresh.Unlock()
+	c.mu.RLock()
+	lifetime := c.lifetime
+	c.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(lifetime, 30*time.Second)
+	defer cancel()
+
+	tools, err := fetchTools(ctx, session)
 	if err != nil {
-		return fmt.Errorf("获取list tool 错误: %w", err)
+		utils.LogWarn(fmt.Sprintf("mcp client【%s】刷新工具列表失败：%v", c.name, err))
+		return
 	}
-	tools := make([]types.Tool, len(result.Tools))
-	for i, tool := range result.Tools {
-		tools[i] = types.Tool{
-			Name:        tool.Name,
-			Description: tool.Description,
-			InputSchema: c.convertInputSchema(tool.InputSchema),
-		}
+	c.mu.Lock()
+	if c.closed || (c.session != nil && c.session != session) {
+		c.mu.Unlock()
+		return
 	}
-	//更新工具列表
 	c.tools = tools
+	c.mu.Unlock()
+	utils.LogInfo(fmt.Sprintf("mcp client【%s】工具列表已更新，共%d个工具：%v", c.name, len(tools), c.getToolNames()))
+}
 
-	return nil
+// 分页获取全部工具
+func fetchTools(ctx context.Context, session *mcp.ClientSession) ([]types.Tool, error) {
+	tools := make([]types.Tool, 0)
+	for tool, err := range session.Tools(ctx, nil) {
+		if err != nil {
+			return nil, fmt.Errorf("获取list tool 错误: %w", err)
+		}
+		tools = append(tools, types.Tool{
+			Name:        tool.Name,
+			Description: tool.Description,
+			InputSchema: convertInputSchema(tool.InputSchema),
+		})
+	}
+	return tools, nil
 }
 
-// 转换CallToolResult格式
+// 转换CallToolResult格式，保留每段内容的类型
 func (c *Client) convertCallToolResult(result *mcp.CallToolResult) *types.MCPToolResult {
 	toolResult := &types.MCPToolResult{
-		Content: make([]struct {
-			Type string `json:"type"`
-			Text string `json:"text"`
-		}, 0),
+		Content: make([]types.MCPContent, 0, len(result.Content)),
 		IsError: result.IsError,
 	}
 	//转换内容数组
 	for _, content := range result.Content {
 		switch c := content.(type) {
 		case *mcp.TextContent:
-			toolResult.Content = append(toolResult.Content, struct {
-				Type string `json:"type"`
-				Text string `json:"text"`
-			}{Type: "text", Text: c.Text})
+			toolResult.Content = append(toolResult.Content, types.MCPContent{Type: types.MCPContentText, Text: c.Text})
 		case *mcp.ImageContent:
-			toolResult.Content = append(toolResult.Content, struct {
-				Type string `json:"type"`
-				Text string `json:"text"`
-			}{Type: "text", Text: fmt.Sprintf("[Image:%s]", c.Data)})
+			toolResult.Content = append(toolResult.Content, types.MCPContent{
+				Type:     types.MCPContentImage,
+				Data:     base64.StdEncoding.EncodeToString(c.Data),
+				MIMEType: c.MIMEType,
+			})
 		case *mcp.AudioContent:
-			toolResult.Content = append(toolResult.Content, struct {
-				Type string `json:"type"`
-				Text string `json:"text"`
-			}{Type: "text", Text: fmt.Sprintf("[Audio:%s]", c.Data)})
+			toolResult.Content = append(toolResult.Content, types.MCPContent{
+				Type:     types.MCPContentAudio,
+				Data:     base64.StdEncoding.EncodeToString(c.Data),
+				MIMEType: c.MIMEType,
+			})
+		case *mcp.ResourceLink:
+			name := c.Name
+			if c.Title != "" {
+				name = c.Title
+			}
+			toolResult.Content = append(toolResult.Content, types.MCPContent{
+				Type:        types.MCPContentResourceLink,
+				URI:         c.URI,
+				Name:        name,
+				MIMEType:    c.MIMEType,
+				Description: c.Description,
+			})
+		case *mcp.EmbeddedResource:
+			if c.Resource == nil {
+				continue
+			}
+			part := types.MCPContent{
+				Type:     types.MCPContentResource,
+				URI:      c.Resource.URI,
+				MIMEType: c.Resource.MIMEType,
+				Text:     c.Resource.Text,
+			}
+			if c.Resource.Blob != nil {
+				part.Data = base64.StdEncoding.EncodeToString(c.Resource.Blob)
+			}
+			toolResult.Content = append(toolResult.Content, part)
 		default:
 			//未知类型
-			toolResult.Content = append(toolResult.Content, struct {
-				Type string `json:"type"`
-				Text string `json:"text"`
-			}{Type: "text", Text: fmt.Sprintf("%v", content)})
+			toolResult.Content = append(toolResult.Content, types.MCPContent{Type: types.MCPContentText, Text: fmt.Sprintf("%v", content)})
 		}
 	}
-	//没有内容则添加一个空文本内容
-	if len(toolResult.Content) == 0 {
-		toolResult.Content = append(toolResult.Content, struct {
-			Type string `json:"type"`
-			Text string `json:"text"`
-		}{Type: "text", Text: ""})
-	}
 	return toolResult
 }
 
 // 转换工具输入模式
-func (c *Client) convertInputSchema(schema any) map[string]interface{} {
+func convertInputSchema(schema any) map[string]interface{} {
 	if schema == nil {
 		return make(map[string]interface{})
 	}
@@ -215,6 +439,8 @@ func (c *Client) convertInputSchema(schema any) map[string]interface{} {
 
 // 返回工具名称列表
 func (c *Client) getToolNames() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	names := make([]string, len(c.tools))
 	for i, tool := range c.tools {
 		names[i] = tool.Name
@@ -0,0 +1,679 @@
+package mcp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"io"
+	"llm-mcp-rag-simple/types"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type addInput struct {
+	A float64 `json:"a"`
+	B float64 `json:"b"`
+}
+
+// 进程内的计算器服务，记录收到的请求头
+func newTestServer() *mcp.Server {
+	server := mcp.NewServer(&mcp.Implementation{Name: "calc", Version: "test"}, nil)
+	mcp.AddTool(server, &mcp.Tool{Name: "add", Description: "加法"}, func(ctx context.Context, req *mcp.CallToolRequest, in addInput) (*mcp.CallToolResult, any, error) {
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: fmt.Sprintf("%v", in.A+in.B)},
+				&mcp.ImageContent{Data: []byte{0x89, 'P', 'N', 'G'}, MIMEType: "image/png"},
+			},
+		}, nil, nil
+	})
+	return server
+}
+
+type headerRecorder struct {
+	mu      sync.Mutex
+	headers []http.Header
+	next    http.Handler
+}
+
+func (h *headerRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.headers = append(h.headers, r.Header.Clone())
+	h.mu.Unlock()
+	h.next.ServeHTTP(w, r)
+}
+
+func TestRemoteClientTransports(t *testing.T) {
+	server := newTestServer()
+	getServer := func(*http.Request) *mcp.Server { return server }
+	handlers := map[string]http.Handler{
+		"http": mcp.NewStreamableHTTPHandler(getServer, nil),
+		"sse":  mcp.NewSSEHandler(getServer, nil),
+	}
+	for transport, handler := range handlers {
+		t.Run(transport, func(t *testing.T) {
+			recorder := &headerRecorder{next: handler}
+			httpServer := httptest.NewServer(recorder)
+			defer httpServer.Close()
+
+			client := NewRemoteClient("calc", RemoteOptions{
+				Transport:   transport,
+				URL:         httpServer.URL,
+				Headers:     map[string]string{"X-Tenant": "demo"},
+				BearerToken: "secret-token",
+			}, "")
+			ctx := context.Background()
+			if err := client.Init(ctx); err != nil {
+				t.Fatalf("Init失败：%v", err)
+			}
+			defer client.Close()
+
+			tools := client.GetTools()
+			if len(tools) != 1 || tools[0].Name != "add" {
+				t.Fatalf("工具列表错误：%+v", tools)
+			}
+			if _, ok := tools[0].InputSchema["properties"]; !ok {
+				t.Errorf("输入模式缺少properties：%v", tools[0].InputSchema)
+			}
+
+			result, err := client.CallTool(ctx, "add", map[string]interface{}{"a": 1, "b": 2})
+			if err != nil {
+				t.Fatalf("CallTool失败：%v", err)
+			}
+			if len(result.Content) != 2 || result.Content[0].Text != "3" {
+				t.Fatalf("工具结果错误：%+v", result.Content)
+			}
+			if image := result.Content[1]; image.Type != types.MCPContentImage || image.MIMEType != "image/png" || image.Data != "iVBORw==" {
+				t.Errorf("图片内容错误：%+v", image)
+			}
+
+			recorder.mu.Lock()
+			defer recorder.mu.Unlock()
+			if len(recorder.headers) == 0 {
+				t.Fatalf("服务端没有收到请求")
+			}
+			for _, header := range recorder.headers {
+				if header.Get("Authorization") != "Bearer secret-token" || header.Get("X-Tenant") != "demo" {
+					t.Errorf("请求头缺失：%v", header)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadServerConfigFromJSON(t *testing.T) {
+	path := t.TempDir() + "/mcp_servers.json"
+	writeFile(t, path, `[
+		{"Name": "local", "Command": "calc-server"},
+		{"Name": "remote", "URL": "https://example.com/mcp", "BearerToken": "t"},
+		{"Name": "legacy", "Transport": "sse", "URL": "https://example.com/sse"}
+	]`)
+	configs, err := LoadServerConfigFromJSON(path)
+	if err != nil {
+		t.Fatalf("加载配置失败：%v", err)
+	}
+	if len(configs) != 3 || configs[0].IsRemote() || configs[1].Transport != "http" || configs[2].Transport != "sse" {
+		t.Errorf("配置解析错误：%+v", configs)
+	}
+
+	writeFile(t, path, `[{"Name": "bad", "Transport": "sse", "Command": "x"}]`)
+	if _, err := LoadServerConfigFromJSON(path); err == nil {
+		t.Errorf("sse传输缺少URL时应报错")
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("写入文件失败：%v", err)
+	}
+}
+
+func TestLoadDesktopServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/work", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_MCP_TOKEN", "abc")
+	path := dir + "/mcp_servers.json"
+	writeFile(t, path, `{
+		"mcpServers": {
+			"files": {"command": "npx", "args": ["-y", "server-fs", "${HOME_DIR_UNUSED:-x}"], "env": {"TOKEN": "${env:TEST_MCP_TOKEN}"}, "cwd": "work"},
+			"remote": {"type": "streamable-http", "url": "https://example.com/mcp", "headers": {"Authorization": "Bearer ${TEST_MCP_TOKEN}"}},
+			"off": {"command": "unused", "disabled": true}
+		}
+	}`)
+	configs, err := LoadServerConfigFromJSON(path)
+	if err != nil {
+		t.Fatalf("加载配置失败：%v", err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("期望2个启用的服务，实际为%+v", configs)
+	}
+	files, remote := configs[0], configs[1]
+	if files.Name != "files" || files.Env["TOKEN"] != "abc" || files.Cwd != dir+"/work" || files.Args[2] != "${HOME_DIR_UNUSED:-x}" {
+		t.Errorf("files配置错误：%+v", files)
+	}
+	if remote.Transport != "http" || remote.Headers["Authorization"] != "Bearer abc" {
+		t.Errorf("remote配置错误：%+v", remote)
+	}
+
+	writeFile(t, path, `{
+		"mcpServers": {
+			"a": {"command": "x", "env": {"K": "${TEST_MCP_MISSING}"}},
+			"b": {"command": "x", "url": "https://example.com"},
+			"c": {"command": "x", "cwd": "missing-dir", "approval": "maybe"}
+		}
+	}`)
+	_, err = LoadServerConfigFromJSON(path)
+	if err == nil {
+		t.Fatalf("期望校验失败")
+	}
+	for _, want := range []string{"TEST_MCP_MISSING", "不能同时配置command与url", "工作目录不存在", "审批策略无效"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("错误信息缺少%q：%v", want, err)
+		}
+	}
+}
+
+// 等待客户端状态满足条件
+func waitStatus(t *testing.T, client *Client, ok func(types.MCPClientStatus) bool) types.MCPClientStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := client.Status()
+		if ok(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("等待状态超时，当前状态：%+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	server := newTestServer()
+	httpServer := httptest.NewServer(mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server { return server }, nil))
+	defer httpServer.Close()
+
+	client := NewRemoteClient("calc", RemoteOptions{URL: httpServer.URL}, "")
+	client.SetHealthOptions(HealthOptions{
+		PingInterval: 50 * time.Millisecond,
+		MaxRestarts:  2,
+		BaseBackoff:  10 * time.Millisecond,
+		MaxBackoff:   20 * time.Millisecond,
+	})
+	ctx := context.Background()
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("Init失败：%v", err)
+	}
+	defer client.Close()
+	if status := client.Status(); status.State != types.MCPStateReady || status.Tools != 1 {
+		t.Fatalf("初始化后状态错误：%+v", status)
+	}
+
+	//服务端关闭会话后，心跳失败并自动重连
+	for session := range server.Sessions() {
+		session.Close()
+	}
+	status := waitStatus(t, client, func(s types.MCPClientStatus) bool {
+		return s.State == types.MCPStateReady && s.Restarts == 1
+	})
+	if status.Tools != 1 || status.LastError == "" {
+		t.Errorf("重连后状态错误：%+v", status)
+	}
+	if _, err := client.CallTool(ctx, "add", map[string]interface{}{"a": 1, "b": 2}); err != nil {
+		t.Fatalf("重连后调用工具失败：%v", err)
+	}
+
+	//服务不可用时重连次数用尽，进入failed状态
+	httpServer.CloseClientConnections()
+	httpServer.Close()
+	waitStatus(t, client, func(s types.MCPClientStatus) bool { return s.State == types.MCPStateFailed })
+	if _, err := client.CallTool(ctx, "add", map[string]interface{}{"a": 1, "b": 2}); err == nil {
+		t.Error("failed状态下调用工具应返回错误")
+	}
+}
+
+func TestClientInitRetryAfterFailure(t *testing.T) {
+	server := newTestServer()
+	var down atomic.Bool
+	down.Store(true)
+	next := mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server { return server }, nil)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+	defer httpServer.Close()
+
+	client := NewRemoteClient("calc", RemoteOptions{URL: httpServer.URL}, "")
+	client.SetLogOptions(LogOptions{File: filepath.Join(t.TempDir(), "calc.log")})
+	ctx := context.Background()
+	if err := client.Init(ctx); err == nil {
+		t.Fatal("服务不可用时Init应失败")
+	}
+	if status := client.Status(); status.State != types.MCPStateFailed || status.LastError == "" {
+		t.Errorf("连接失败后状态错误：%+v", status)
+	}
+	//失败后释放生命周期与日志文件
+	client.mu.RLock()
+	lifetime, released := client.lifetime, client.client == nil && client.logs.file == nil
+	client.mu.RUnlock()
+	if lifetime.Err() == nil || !released {
+		t.Errorf("连接失败后应释放资源")
+	}
+
+	//服务恢复后可以再次初始化
+	down.Store(false)
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("再次Init失败：%v", err)
+	}
+	defer client.Close()
+	if status := client.Status(); status.State != types.MCPStateReady || status.Tools != 1 {
+		t.Errorf("再次初始化后状态错误：%+v", status)
+	}
+}
+
+// 开启后 initialize 请求一直挂起，模拟接受连接但不响应的服务
+type stallingHandler struct {
+	stall   atomic.Bool
+	release chan struct{}
+	next    http.Handler
+}
+
+func (h *stallingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if h.stall.Load() && strings.Contains(string(body), `"method":"initialize"`) {
+		select {
+		case <-r.Context().Done():
+		case <-h.release:
+		}
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func TestClientReconnectAttemptTimeout(t *testing.T) {
+	server := newTestServer()
+	handler := &stallingHandler{
+		release: make(chan struct{}),
+		next:    mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server { return server }, nil),
+	}
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+	defer close(handler.release)
+
+	client := NewRemoteClient("calc", RemoteOptions{URL: httpServer.URL}, "")
+	client.SetHealthOptions(HealthOptions{
+		PingInterval:   50 * time.Millisecond,
+		MaxRestarts:    50,
+		BaseBackoff:    10 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+		ConnectTimeout: 100 * time.Millisecond,
+	})
+	if err := client.Init(context.Background()); err != nil {
+		t.Fatalf("Init失败：%v", err)
+	}
+	defer client.Close()
+
+	//服务不响应时，每次重连尝试在超时后失败并继续重试
+	handler.stall.Store(true)
+	for session := range server.Sessions() {
+		session.Close()
+	}
+	status := waitStatus(t, client, func(s types.MCPClientStatus) bool {
+		return s.State == types.MCPStateDegraded && strings.Contains(s.LastError, "deadline exceeded")
+	})
+	if status.Restarts != 0 {
+		t.Errorf("重连不应成功：%+v", status)
+	}
+
+	//服务恢复后下一次尝试重连成功
+	handler.stall.Store(false)
+	status = waitStatus(t, client, func(s types.MCPClientStatus) bool {
+		return s.State == types.MCPStateReady && s.Restarts == 1
+	})
+	if status.Tools != 1 {
+		t.Errorf("重连后状态错误：%+v", status)
+	}
+}
+
+func TestClientToolListChanged(t *testing.T) {
+	server := newTestServer()
+	httpServer := httptest.NewServer(mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server { return server }, nil))
+	defer httpServer.Close()
+
+	client := NewRemoteClient("calc", RemoteOptions{URL: httpServer.URL}, "")
+	if err := client.Init(context.Background()); err != nil {
+		t.Fatalf("Init失败：%v", err)
+	}
+	defer client.Close()
+
+	toolNames := func() string {
+		names := client.getToolNames()
+		return strings.Join(names, ",")
+	}
+	waitTools := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for toolNames() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("工具列表未更新，期望%s，实际%s", want, toolNames())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	//运行时新增与删除工具，服务端发送tools/list_changed通知
+	mcp.AddTool(server, &mcp.Tool{Name: "sub", Description: "减法"}, func(ctx context.Context, req *mcp.CallToolRequest, in addInput) (*mcp.CallToolResult, any, error) {
+		return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("%v", in.A-in.B)}}}, nil, nil
+	})
+	waitTools("add,sub")
+	server.RemoveTools("add")
+	waitTools("sub")
+	if status := client.Status(); status.Tools != 1 {
+		t.Errorf("状态中的工具数量错误：%+v", status)
+	}
+}
+
+func TestClientResources(t *testing.T) {
+	server := mcp.NewServer(&mcp.Implementation{Name: "docs", Version: "test"}, &mcp.ServerOptions{
+		SubscribeHandler:   func(context.Context, *mcp.SubscribeRequest) error { return nil },
+		UnsubscribeHandler: func(context.Context, *mcp.UnsubscribeRequest) error { return nil },
+	})
+	read := func(ctx context.Context, req *mcp.ReadResourceRequest) (*mcp.ReadResourceResult, error) {
+		return &mcp.ReadResourceResult{Contents: []*mcp.ResourceContents{{
+			URI:      req.Params.URI,
+			MIMEType: "text/markdown",
+			Text:     "# 使用说明",
+		}}}, nil
+	}
+	server.AddResource(&mcp.Resource{URI: "file:///docs/readme.md", Name: "readme", MIMEType: "text/markdown"}, read)
+	server.AddResourceTemplate(&mcp.ResourceTemplate{URITemplate: "file:///docs/{name}", Name: "docs"}, read)
+	httpServer := httptest.NewServer(mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server { return server }, nil))
+	defer httpServer.Close()
+
+	client := NewRemoteClient("docs", RemoteOptions{URL: httpServer.URL}, "")
+	ctx := context.Background()
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("Init失败：%v", err)
+	}
+	defer client.Close()
+
+	resources, err := client.ListResources(ctx)
+	if err != nil || len(resources) != 1 || resources[0].URI != "file:///docs/readme.md" || resources[0].MIMEType != "text/markdown" {
+		t.Fatalf("资源列表错误：%+v，%v", resources, err)
+	}
+	templates, err := client.ListResourceTemplates(ctx)
+	if err != nil || len(templates) != 1 || templates[0].URITemplate != "file:///docs/{name}" {
+		t.Fatalf("资源模板错误：%+v，%v", templates, err)
+	}
+	contents, err := client.ReadResource(ctx, "file:///docs/guide.md")
+	if err != nil || len(contents) != 1 || contents[0].Text != "# 使用说明" || contents[0].URI != "file:///docs/guide.md" {
+		t.Fatalf("读取资源错误：%+v，%v", contents, err)
+	}
+
+	updated := make(chan string, 1)
+	client.OnResourceUpdated(func(uri string) { updated <- uri })
+	if err := client.Subscribe(ctx, "file:///docs/readme.md"); err != nil {
+		t.Fatalf("订阅失败：%v", err)
+	}
+	if err := server.ResourceUpdated(ctx, &mcp.ResourceUpdatedNotificationParams{URI: "file:///docs/readme.md"}); err != nil {
+		t.Fatalf("发送更新通知失败：%v", err)
+	}
+	select {
+	case uri := <-updated:
+		if uri != "file:///docs/readme.md" {
+			t.Errorf("更新的资源错误：%s", uri)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("未收到资源更新通知")
+	}
+}
+
+func TestClientPrompts(t *testing.T) {
+	server := mcp.NewServer(&mcp.Implementation{Name: "review", Version: "test"}, nil)
+	server.AddPrompt(&mcp.Prompt{
+		Name:        "review",
+		Description: "代码审查",
+		Arguments:   []*mcp.PromptArgument{{Name: "file", Required: true}, {Name: "focus"}},
+	}, func(ctx context.Context, req *mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+		return &mcp.GetPromptResult{Messages: []*mcp.PromptMessage{
+			{Role: "assistant", Content: &mcp.TextContent{Text: "我会仔细审查。"}},
+			{Role: "user", Content: &mcp.ImageContent{Data: []byte("png"), MIMEType: "image/png"}},
+			{Role: "user", Content: &mcp.TextContent{Text: "请审查" + req.Params.Arguments["file"]}},
+		}}, nil
+	})
+	httpServer := httptest.NewServer(mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server { return server }, nil))
+	defer httpServer.Close()
+
+	client := NewRemoteClient("review", RemoteOptions{URL: httpServer.URL}, "")
+	ctx := context.Background()
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("Init失败：%v", err)
+	}
+	defer client.Close()
+
+	prompts, err := client.ListPrompts(ctx)
+	if err != nil || len(prompts) != 1 || len(prompts[0].Arguments) != 2 || !prompts[0].Arguments[0].Required {
+		t.Fatalf("提示词列表错误：%+v，%v", prompts, err)
+	}
+	messages, err := client.GetPrompt(ctx, "review", map[string]string{"file": "main.go"})
+	if err != nil || len(messages) != 3 {
+		t.Fatalf("获取提示词失败：%+v，%v", messages, err)
+	}
+	if messages[0].Role != "assistant" || messages[2].Content != "请审查main.go" {
+		t.Errorf("提示词消息错误：%+v", messages)
+	}
+	if len(messages[1].Parts) != 1 || messages[1].Parts[0].ImageURL != "data:image/png;base64,cG5n" {
+		t.Errorf("图片消息错误：%+v", messages[1])
+	}
+}
+
+func TestClientSampling(t *testing.T) {
+	server := mcp.NewServer(&mcp.Implementation{Name: "writer", Version: "test"}, nil)
+	mcp.AddTool(server, &mcp.Tool{Name: "summarize", Description: "总结"}, func(ctx context.Context, req *mcp.CallToolRequest, in struct{}) (*mcp.CallToolResult, any, error) {
+		result, err := req.Session.CreateMessage(ctx, &mcp.CreateMessageParams{
+			Messages:         []*mcp.SamplingMessage{{Role: "user", Content: &mcp.TextContent{Text: "总结这段文字"}}},
+			SystemPrompt:     "你是摘要助手",
+			MaxTokens:        100,
+			ModelPreferences: &mcp.ModelPreferences{Hints: []*mcp.ModelHint{{Name: "mini"}}},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		text := result.Content.(*mcp.TextContent).Text
+		return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: result.Model + ":" + text}}}, nil, nil
+	})
+	httpServer := httptest.NewServer(mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server { return server }, nil))
+	defer httpServer.Close()
+
+	var received types.SamplingRequest
+	client := NewRemoteClient("writer", RemoteOptions{URL: httpServer.URL}, "")
+	client.SetSamplingHandler(func(ctx context.Context, request types.SamplingRequest) (*types.SamplingResult, error) {
+		received = request
+		return &types.SamplingResult{Content: "摘要", Model: "gpt-mini", StopReason: "endTurn"}, nil
+	})
+	ctx := context.Background()
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("Init失败：%v", err)
+	}
+	defer client.Close()
+
+	result, err := client.CallTool(ctx, "summarize", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("调用工具失败：%v", err)
+	}
+	if result.IsError || len(result.Content) != 1 || result.Content[0].Text != "gpt-mini:摘要" {
+		t.Fatalf("采样结果未返回给服务：%+v", result)
+	}
+	if received.Server != "writer" || received.MaxTokens != 100 || received.SystemPrompt != "你是摘要助手" ||
+		len(received.Messages) != 1 || received.Messages[0].Content != "总结这段文字" ||
+		len(received.ModelHints) != 1 || received.ModelHints[0] != "mini" {
+		t.Errorf("采样请求转换错误：%+v", received)
+	}
+	//服务要求的温度为 0 时同样传递，不使用模型的默认温度
+	if received.Temperature == nil || *received.Temperature != 0 {
+		t.Errorf("温度为0时应传递：%v", received.Temperature)
+	}
+}
+
+func TestClientRootsAndElicitation(t *testing.T) {
+	server := mcp.NewServer(&mcp.Implementation{Name: "fs", Version: "test"}, nil)
+	mcp.AddTool(server, &mcp.Tool{Name: "setup", Description: "初始化"}, func(ctx context.Context, req *mcp.CallToolRequest, in struct{}) (*mcp.CallToolResult, any, error) {
+		roots, err := req.Session.ListRoots(ctx, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		result, err := req.Session.Elicit(ctx, &mcp.ElicitParams{
+			Message: "请输入项目名称",
+			RequestedSchema: map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"project": map[string]any{"type": "string"}},
+				"required":   []string{"project"},
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		text := fmt.Sprintf("%s %s %s %v", roots.Roots[0].URI, roots.Roots[0].Name, result.Action, result.Content["project"])
+		return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: text}}}, nil, nil
+	})
+	httpServer := httptest.NewServer(mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server { return server }, nil))
+	defer httpServer.Close()
+
+	dir := t.TempDir()
+	config := ServerConfig{Name: "fs", URL: httpServer.URL, Roots: []string{dir}}
+	if issues := config.resolve(dir); len(issues) > 0 {
+		t.Fatalf("配置校验失败：%v", issues)
+	}
+	client := config.NewClient("")
+	var received types.ElicitationRequest
+	client.SetElicitationHandler(func(ctx context.Context, request types.ElicitationRequest) (*types.ElicitationResult, error) {
+		received = request
+		return &types.ElicitationResult{Action: types.ElicitAccept, Content: map[string]interface{}{"project": "demo"}}, nil
+	})
+	ctx := context.Background()
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("Init失败：%v", err)
+	}
+	defer client.Close()
+
+	result, err := client.CallTool(ctx, "setup", map[string]interface{}{})
+	if err != nil || result.IsError {
+		t.Fatalf("调用工具失败：%+v，%v", result, err)
+	}
+	uri, _ := RootURI(dir)
+	want := fmt.Sprintf("%s %s accept demo", uri, filepath.Base(dir))
+	if result.Content[0].Text != want {
+		t.Errorf("服务收到的根目录或表单错误：%q，期望%q", result.Content[0].Text, want)
+	}
+	if received.Server != "fs" || received.Message != "请输入项目名称" || received.Schema["properties"] == nil {
+		t.Errorf("elicitation请求转换错误：%+v", received)
+	}
+}
+
+func TestClientLogsAndProgress(t *testing.T) {
+	server := mcp.NewServer(&mcp.Implementation{Name: "builder", Version: "test"}, nil)
+	mcp.AddTool(server, &mcp.Tool{Name: "build", Description: "构建"}, func(ctx context.Context, req *mcp.CallToolRequest, in struct{}) (*mcp.CallToolResult, any, error) {
+		token := req.Params.GetProgressToken()
+		for i := 1; i <= 2; i++ {
+			if err := req.Session.NotifyProgress(ctx, &mcp.ProgressNotificationParams{ProgressToken: token, Progress: float64(i), Total: 2, Message: "编译中"}); err != nil {
+				return nil, nil, err
+			}
+		}
+		req.Session.Log(ctx, &mcp.LoggingMessageParams{Level: "debug", Logger: "make", Data: "忽略的调试信息"})
+		req.Session.Log(ctx, &mcp.LoggingMessageParams{Level: "warning", Logger: "make", Data: map[string]any{"file": "main.go"}})
+		return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: "完成"}}}, nil, nil
+	})
+	httpServer := httptest.NewServer(mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server { return server }, nil))
+	defer httpServer.Close()
+
+	var mu sync.Mutex
+	var progress []float64
+	client := NewRemoteClient("builder", RemoteOptions{URL: httpServer.URL}, "")
+	client.SetLogOptions(LogOptions{BufferSize: 3, Level: "info"})
+	client.SetProgressHandler(func(server, tool string, done, total float64, message string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if server == "builder" && tool == "build" && total == 2 && message == "编译中" {
+			progress = append(progress, done)
+		}
+	})
+	ctx := context.Background()
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("Init失败：%v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.CallTool(ctx, "build", map[string]interface{}{}); err != nil {
+		t.Fatalf("调用工具失败：%v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(client.Logs(0)) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	if len(progress) != 2 || progress[0] != 1 || progress[1] != 2 {
+		t.Errorf("进度回调错误：%v", progress)
+	}
+	mu.Unlock()
+
+	logs := client.Logs(0)
+	if len(logs) != 3 {
+		t.Fatalf("日志条数错误：%+v", logs)
+	}
+	if logs[0].Source != "progress" || logs[1].Source != "progress" {
+		t.Errorf("进度未记录到日志：%+v", logs)
+	}
+	if last := logs[2]; last.Source != "log" || last.Level != "warning" || last.Logger != "make" || last.Message != `{"file":"main.go"}` {
+		t.Errorf("日志通知转换错误：%+v", last)
+	}
+	if got := client.Logs(1); len(got) != 1 || got[0].Source != "log" {
+		t.Errorf("Logs(1)应返回最近一条日志：%+v", got)
+	}
+
+	if err := client.SetLogLevel(ctx, "verbose"); err == nil {
+		t.Error("无效的日志级别应返回错误")
+	}
+}
+
+func TestLogBufferWritesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calc.log")
+	logs := newLogBuffer(2)
+	if err := logs.openFile(path); err != nil {
+		t.Fatalf("openFile失败：%v", err)
+	}
+	at := time.Date(2025, 1, 2, 3, 4, 5, 6_000_000, time.Local)
+	logs.add(types.MCPLogEntry{Time: at, Source: "stderr", Message: "启动"})
+	logs.add(types.MCPLogEntry{Time: at, Source: "log", Level: "warning", Logger: "make", Message: "缺少文件"})
+	logs.add(types.MCPLogEntry{Time: at, Source: "progress", Message: "1/2"})
+	logs.close()
+
+	//缓冲区只保留最近的日志，文件保留全部
+	if got := logs.last(0); len(got) != 2 || got[0].Source != "log" {
+		t.Errorf("缓冲区日志错误：%+v", got)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2025-01-02 03:04:05.006 [stderr] 启动\n" +
+		"2025-01-02 03:04:05.006 [log warning] make: 缺少文件\n" +
+		"2025-01-02 03:04:05.006 [progress] 1/2\n"
+	if string(data) != want {
+		t.Errorf("日志文件内容错误：\n%s", data)
+	}
+}
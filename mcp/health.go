@@ -0,0 +1,142 @@
+package mcp
+
+import (
+	"context"
+	"fmt"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/utils"
+	"time"
+)
+
+// 健康检查与自动重连选项
+type HealthOptions struct {
+	PingInterval   time.Duration // 心跳间隔，心跳失败视为连接断开；0 表示只依赖连接关闭事件
+	MaxRestarts    int           // 连续重连失败的最大次数，超过后进入 failed 状态
+	BaseBackoff    time.Duration // 首次重连前的等待时间，之后每次翻倍
+	MaxBackoff     time.Duration
+	ConnectTimeout time.Duration // 单次重连（建立连接并获取工具列表）的超时时间，避免服务无响应时重连一直挂起
+}
+
+func defaultHealthOptions() HealthOptions {
+	return HealthOptions{
+		PingInterval:   30 * time.Second,
+		MaxRestarts:    5,
+		BaseBackoff:    time.Second,
+		MaxBackoff:     30 * time.Second,
+		ConnectTimeout: 30 * time.Second,
+	}
+}
+
+// 设置健康检查选项，需在 Init 之前调用
+func (c *Client) SetHealthOptions(options HealthOptions) {
+	defaults := defaultHealthOptions()
+	if options.MaxRestarts < 0 {
+		options.MaxRestarts = 0
+	}
+	if options.BaseBackoff <= 0 {
+		options.BaseBackoff = defaults.BaseBackoff
+	}
+	if options.MaxBackoff < options.BaseBackoff {
+		options.MaxBackoff = defaults.MaxBackoff
+	}
+	if options.ConnectTimeout <= 0 {
+		options.ConnectTimeout = defaults.ConnectTimeout
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.health = options
+}
+
+// 返回当前连接状态
+func (c *Client) Status() types.MCPClientStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	status := types.MCPClientStatus{
+		State:    c.state,
+		Tools:    len(c.tools),
+		Restarts: c.restarts,
+	}
+	if c.lastErr != nil {
+		status.LastError = c.lastErr.Error()
+	}
+	return status
+}
+
+func (c *Client) setState(state types.MCPClientState, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+	if err != nil {
+		c.lastErr = err
+	}
+}
+
+// 等待会话结束，非主动关闭时自动重连
+func (c *Client) monitor(session *mcp.ClientSession) {
+	for {
+		err := session.Wait()
+		c.mu.RLock()
+		closed := c.closed
+		c.mu.RUnlock()
+		if closed {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("连接已断开")
+		}
+		utils.LogWarn(fmt.Sprintf("mcp client【%s】连接断开：%v，准备重连", c.name, err))
+		c.setState(types.MCPStateDegraded, err)
+
+		next, ok := c.reconnect()
+		if !ok {
+			return
+		}
+		session = next
+	}
+}
+
+// 按指数退避重连，成功后重新获取工具列表
+func (c *Client) reconnect() (*mcp.ClientSession, bool) {
+	c.mu.RLock()
+	options := c.health
+	lifetime := c.lifetime
+	c.mu.RUnlock()
+
+	wait := options.BaseBackoff
+	for attempt := 1; attempt <= options.MaxRestarts; attempt++ {
+		select {
+		case <-time.After(wait):
+		case <-lifetime.Done():
+			return nil, false
+		}
+		wait *= 2
+		if wait > options.MaxBackoff {
+			wait = options.MaxBackoff
+		}
+
+		attemptCtx, cancel := context.WithTimeout(lifetime, options.ConnectTimeout)
+		session, err := c.connect(attemptCtx)
+		cancel()
+		if err != nil {
+			utils.LogWarn(fmt.Sprintf("mcp client【%s】第%d次重连失败：%v", c.name, attempt, err))
+			c.setState(types.MCPStateDegraded, err)
+			continue
+		}
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			session.Close()
+			return nil, false
+		}
+		c.session = session
+		c.state = types.MCPStateReady
+		c.restarts++
+		c.mu.Unlock()
+		utils.LogInfo(fmt.Sprintf("mcp client【%s】已重连，发现%d个工具", c.name, len(c.GetTools())))
+		return session, true
+	}
+	utils.LogError(fmt.Sprintf("mcp client【%s】重连%d次均失败，已停止重试", c.name, options.MaxRestarts))
+	c.setState(types.MCPStateFailed, nil)
+	return nil, false
+}
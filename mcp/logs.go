@@ -0,0 +1,242 @@
+package mcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/utils"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 服务日志选项
+type LogOptions struct {
+	BufferSize int    // 内存中保留的日志条数，默认500
+	File       string // 不为空时同时追加写入该文件
+	Level      string // 服务发送日志通知的最低级别，为空时沿用服务配置
+}
+
+// 长时间工具调用的进度回调
+type ProgressFunc func(server, tool string, progress, total float64, message string)
+
+// 有效的日志级别，与 RFC 5424 一致
+var logLevels = []string{"debug", "info", "notice", "warning", "error", "critical", "alert", "emergency"}
+
+// 是否为有效的日志级别
+func ValidLogLevel(level string) bool {
+	for _, l := range logLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// 固定大小的日志环形缓冲区，可同时写入文件
+type logBuffer struct {
+	mu      sync.Mutex
+	entries []types.MCPLogEntry
+	start   int // 最早一条日志的位置
+	size    int
+	file    *os.File
+}
+
+func newLogBuffer(size int) *logBuffer {
+	if size <= 0 {
+		size = 500
+	}
+	return &logBuffer{entries: make([]types.MCPLogEntry, 0, size), size: size}
+}
+
+func (b *logBuffer) add(entry types.MCPLogEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) < b.size {
+		b.entries = append(b.entries, entry)
+	} else {
+		b.entries[b.start] = entry
+		b.start = (b.start + 1) % b.size
+	}
+	if b.file != nil {
+		fmt.Fprintln(b.file, entry)
+	}
+}
+
+// 返回最近的limit条日志，limit<=0时返回全部
+func (b *logBuffer) last(limit int) []types.MCPLogEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ordered := append(append([]types.MCPLogEntry{}, b.entries[b.start:]...), b.entries[:b.start]...)
+	if limit > 0 && len(ordered) > limit {
+		ordered = ordered[len(ordered)-limit:]
+	}
+	return ordered
+}
+
+func (b *logBuffer) openFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("打开日志文件失败：%w", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.file = file
+	return nil
+}
+
+func (b *logBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+}
+
+// 按行切分服务进程的stderr输出
+type lineWriter struct {
+	mu   sync.Mutex
+	buf  []byte
+	emit func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(w.buf[:i]), "\r")
+		w.buf = w.buf[i+1:]
+		if line != "" {
+			w.emit(line)
+		}
+	}
+	return len(p), nil
+}
+
+// 设置日志选项，需在 Init 之前调用
+func (c *Client) SetLogOptions(options LogOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logs = newLogBuffer(options.BufferSize)
+	c.logFile = options.File
+	if options.Level != "" {
+		c.logLevel = options.Level
+	}
+}
+
+// 设置工具调用进度回调
+func (c *Client) SetProgressHandler(handler ProgressFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.progress = handler
+}
+
+// 返回最近的日志
+func (c *Client) Logs(limit int) []types.MCPLogEntry {
+	return c.logs.last(limit)
+}
+
+// 设置服务发送日志通知的最低级别，重连后自动恢复
+func (c *Client) SetLogLevel(ctx context.Context, level string) error {
+	if !ValidLogLevel(level) {
+		return fmt.Errorf("无效的日志级别：%s（可选 %s）", level, strings.Join(logLevels, "、"))
+	}
+	session, err := c.currentSession()
+	if err != nil {
+		return err
+	}
+	if err := session.SetLoggingLevel(ctx, &mcp.SetLoggingLevelParams{Level: mcp.LoggingLevel(level)}); err != nil {
+		return fmt.Errorf("设置日志级别失败：%w", err)
+	}
+	c.mu.Lock()
+	c.logLevel = level
+	c.mu.Unlock()
+	return nil
+}
+
+// 在新会话上恢复日志级别
+func (c *Client) applyLogLevel(ctx context.Context, session *mcp.ClientSession) {
+	c.mu.RLock()
+	level := c.logLevel
+	c.mu.RUnlock()
+	if level == "" {
+		return
+	}
+	if err := session.SetLoggingLevel(ctx, &mcp.SetLoggingLevelParams{Level: mcp.LoggingLevel(level)}); err != nil {
+		utils.LogWarn(fmt.Sprintf("mcp client【%s】设置日志级别失败：%v", c.name, err))
+	}
+}
+
+// 记录一条日志
+func (c *Client) addLog(source, level, logger, message string) {
+	c.logs.add(types.MCPLogEntry{
+		Time:    time.Now(),
+		Source:  source,
+		Level:   level,
+		Logger:  logger,
+		Message: message,
+	})
+	utils.LogDebug(fmt.Sprintf("mcp client【%s】%s：%s", c.name, source, message))
+}
+
+// 服务的日志通知
+func (c *Client) onLoggingMessage(ctx context.Context, req *mcp.LoggingMessageRequest) {
+	if req.Params == nil {
+		return
+	}
+	message, ok := req.Params.Data.(string)
+	if !ok {
+		data, err := json.Marshal(req.Params.Data)
+		if err != nil {
+			message = fmt.Sprintf("%v", req.Params.Data)
+		} else {
+			message = string(data)
+		}
+	}
+	c.addLog("log", string(req.Params.Level), req.Params.Logger, message)
+}
+
+// 服务的进度通知。通知可能在工具调用返回后才被处理，工具名从令牌中解析而不是查表
+func (c *Client) onProgress(ctx context.Context, req *mcp.ProgressNotificationClientRequest) {
+	if req.Params == nil {
+		return
+	}
+	params := req.Params
+	token, ok := params.ProgressToken.(string)
+	if !ok {
+		return
+	}
+	_, tool, ok := strings.Cut(token, ":")
+	if !ok {
+		return
+	}
+	message := fmt.Sprintf("%s %v", tool, params.Progress)
+	if params.Total > 0 {
+		message += fmt.Sprintf("/%v", params.Total)
+	}
+	if params.Message != "" {
+		message += " " + params.Message
+	}
+	c.addLog("progress", "", "", message)
+	c.mu.RLock()
+	handler := c.progress
+	c.mu.RUnlock()
+	if handler != nil {
+		handler(c.name, tool, params.Progress, params.Total, params.Message)
+	}
+}
+
+// 为工具调用生成唯一的进度令牌，格式为 序号:工具名
+func (c *Client) progressToken(tool string) string {
+	return fmt.Sprintf("%d:%s", c.callSeq.Add(1), tool)
+}
@@ -0,0 +1,85 @@
+package mcp
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"llm-mcp-rag-simple/types"
+)
+
+// 分页获取全部提示词模板
+func (c *Client) ListPrompts(ctx context.Context) ([]types.MCPPrompt, error) {
+	session, err := c.currentSession()
+	if err != nil {
+		return nil, err
+	}
+	prompts := make([]types.MCPPrompt, 0)
+	for prompt, err := range session.Prompts(ctx, nil) {
+		if err != nil {
+			return nil, fmt.Errorf("获取提示词列表失败：%w", err)
+		}
+		item := types.MCPPrompt{
+			Name:        prompt.Name,
+			Title:       prompt.Title,
+			Description: prompt.Description,
+		}
+		for _, argument := range prompt.Arguments {
+			if argument == nil {
+				continue
+			}
+			item.Arguments = append(item.Arguments, types.MCPPromptArgument{
+				Name:        argument.Name,
+				Description: argument.Description,
+				Required:    argument.Required,
+			})
+		}
+		prompts = append(prompts, item)
+	}
+	return prompts, nil
+}
+
+// 获取渲染后的提示词消息
+func (c *Client) GetPrompt(ctx context.Context, name string, arguments map[string]string) ([]types.ChatMessage, error) {
+	session, err := c.currentSession()
+	if err != nil {
+		return nil, err
+	}
+	result, err := session.GetPrompt(ctx, &mcp.GetPromptParams{Name: name, Arguments: arguments})
+	if err != nil {
+		return nil, fmt.Errorf("获取提示词%s失败：%w", name, err)
+	}
+	messages := make([]types.ChatMessage, 0, len(result.Messages))
+	for _, message := range result.Messages {
+		if message == nil || message.Content == nil {
+			continue
+		}
+		messages = append(messages, contentMessage(string(message.Role), message.Content))
+	}
+	return messages, nil
+}
+
+// 提示词与采样消息只有一段内容，图片转为 data URL，其他非文本内容转为文本
+func contentMessage(role string, content mcp.Content) types.ChatMessage {
+	msg := types.ChatMessage{Role: role}
+	switch content := content.(type) {
+	case *mcp.TextContent:
+		msg.Content = content.Text
+	case *mcp.ImageContent:
+		msg.Parts = []types.ContentPart{{
+			Type:     types.ContentPartImage,
+			ImageURL: fmt.Sprintf("data:%s;base64,%s", content.MIMEType, base64.StdEncoding.EncodeToString(content.Data)),
+		}}
+	case *mcp.AudioContent:
+		msg.Content = fmt.Sprintf("[音频 %s，%d字节]", content.MIMEType, len(content.Data))
+	case *mcp.EmbeddedResource:
+		if content.Resource != nil {
+			msg.Content = fmt.Sprintf("资源 %s：\n%s", content.Resource.URI, content.Resource.Text)
+		}
+	case *mcp.ResourceLink:
+		msg.Content = fmt.Sprintf("资源链接 %s（%s）", content.URI, content.Name)
+	default:
+		msg.Content = fmt.Sprintf("%v", content)
+	}
+	return msg
+}
@@ -0,0 +1,170 @@
+package mcp
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/utils"
+)
+
+// 返回可用的会话
+func (c *Client) currentSession() (*mcp.ClientSession, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed || c.session == nil {
+		return nil, fmt.Errorf("mcp client 不可用")
+	}
+	if c.state != types.MCPStateReady {
+		return nil, fmt.Errorf("mcp client【%s】当前状态为%s", c.name, c.state)
+	}
+	return c.session, nil
+}
+
+// 分页获取全部资源
+func (c *Client) ListResources(ctx context.Context) ([]types.MCPResource, error) {
+	session, err := c.currentSession()
+	if err != nil {
+		return nil, err
+	}
+	resources := make([]types.MCPResource, 0)
+	for resource, err := range session.Resources(ctx, nil) {
+		if err != nil {
+			return nil, fmt.Errorf("获取资源列表失败：%w", err)
+		}
+		name := resource.Name
+		if resource.Title != "" {
+			name = resource.Title
+		}
+		resources = append(resources, types.MCPResource{
+			URI:         resource.URI,
+			Name:        name,
+			Description: resource.Description,
+			MIMEType:    resource.MIMEType,
+			Size:        resource.Size,
+		})
+	}
+	return resources, nil
+}
+
+// 分页获取全部资源模板
+func (c *Client) ListResourceTemplates(ctx context.Context) ([]types.MCPResourceTemplate, error) {
+	session, err := c.currentSession()
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]types.MCPResourceTemplate, 0)
+	for template, err := range session.ResourceTemplates(ctx, nil) {
+		if err != nil {
+			return nil, fmt.Errorf("获取资源模板失败：%w", err)
+		}
+		name := template.Name
+		if template.Title != "" {
+			name = template.Title
+		}
+		templates = append(templates, types.MCPResourceTemplate{
+			URITemplate: template.URITemplate,
+			Name:        name,
+			Description: template.Description,
+			MIMEType:    template.MIMEType,
+		})
+	}
+	return templates, nil
+}
+
+// 读取资源内容，二进制内容以base64保存在Data中
+func (c *Client) ReadResource(ctx context.Context, uri string) ([]types.MCPContent, error) {
+	session, err := c.currentSession()
+	if err != nil {
+		return nil, err
+	}
+	result, err := session.ReadResource(ctx, &mcp.ReadResourceParams{URI: uri})
+	if err != nil {
+		return nil, fmt.Errorf("读取资源%s失败：%w", uri, err)
+	}
+	contents := make([]types.MCPContent, 0, len(result.Contents))
+	for _, resource := range result.Contents {
+		if resource == nil {
+			continue
+		}
+		content := types.MCPContent{
+			Type:     types.MCPContentResource,
+			URI:      resource.URI,
+			MIMEType: resource.MIMEType,
+			Text:     resource.Text,
+		}
+		if resource.Blob != nil {
+			content.Data = base64.StdEncoding.EncodeToString(resource.Blob)
+		}
+		contents = append(contents, content)
+	}
+	return contents, nil
+}
+
+// 订阅资源更新，重连后自动重新订阅
+func (c *Client) Subscribe(ctx context.Context, uri string) error {
+	session, err := c.currentSession()
+	if err != nil {
+		return err
+	}
+	if err := session.Subscribe(ctx, &mcp.SubscribeParams{URI: uri}); err != nil {
+		return fmt.Errorf("订阅资源%s失败：%w", uri, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[string]bool)
+	}
+	c.subscriptions[uri] = true
+	return nil
+}
+
+// 取消订阅资源更新
+func (c *Client) Unsubscribe(ctx context.Context, uri string) error {
+	c.mu.Lock()
+	delete(c.subscriptions, uri)
+	c.mu.Unlock()
+	session, err := c.currentSession()
+	if err != nil {
+		return err
+	}
+	if err := session.Unsubscribe(ctx, &mcp.UnsubscribeParams{URI: uri}); err != nil {
+		return fmt.Errorf("取消订阅资源%s失败：%w", uri, err)
+	}
+	return nil
+}
+
+// 设置资源更新回调
+func (c *Client) OnResourceUpdated(handler func(uri string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resourceUpdated = handler
+}
+
+// 服务端通知资源已更新，在新协程中回调，避免阻塞会话的消息处理
+func (c *Client) onResourceUpdated(ctx context.Context, req *mcp.ResourceUpdatedNotificationRequest) {
+	c.mu.RLock()
+	handler := c.resourceUpdated
+	c.mu.RUnlock()
+	if handler == nil || req.Params == nil {
+		return
+	}
+	utils.LogDebug(fmt.Sprintf("mcp client【%s】资源已更新：%s", c.name, req.Params.URI))
+	go handler(req.Params.URI)
+}
+
+// 在新会话上恢复之前的订阅
+func (c *Client) resubscribe(ctx context.Context, session *mcp.ClientSession) {
+	c.mu.RLock()
+	uris := make([]string, 0, len(c.subscriptions))
+	for uri := range c.subscriptions {
+		uris = append(uris, uri)
+	}
+	c.mu.RUnlock()
+	for _, uri := range uris {
+		if err := session.Subscribe(ctx, &mcp.SubscribeParams{URI: uri}); err != nil {
+			utils.LogWarn(fmt.Sprintf("mcp client【%s】重新订阅资源%s失败：%v", c.name, uri, err))
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"llm-mcp-rag-simple/types"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// 向服务声明的根目录，服务只应访问这些目录
+type Root struct {
+	URI  string // file:// URI
+	Name string
+}
+
+// 将本地路径转换为 file:// URI，已是URI时原样返回
+func RootURI(path string) (string, error) {
+	if strings.HasPrefix(path, "file://") {
+		return path, nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	slashed := filepath.ToSlash(abs)
+	//Windows 盘符路径需要以 / 开头
+	if !strings.HasPrefix(slashed, "/") {
+		slashed = "/" + slashed
+	}
+	return (&url.URL{Scheme: "file", Path: slashed}).String(), nil
+}
+
+// 设置根目录，初始化后调用时通知服务根目录已变化
+func (c *Client) SetRoots(roots []Root) {
+	c.mu.Lock()
+	old := c.roots
+	c.roots = roots
+	client := c.client
+	c.mu.Unlock()
+	if client == nil {
+		return
+	}
+	uris := make([]string, len(old))
+	for i, root := range old {
+		uris[i] = root.URI
+	}
+	client.RemoveRoots(uris...)
+	client.AddRoots(toMCPRoots(roots)...)
+}
+
+func toMCPRoots(roots []Root) []*mcp.Root {
+	result := make([]*mcp.Root, len(roots))
+	for i, root := range roots {
+		result[i] = &mcp.Root{URI: root.URI, Name: root.Name}
+	}
+	return result
+}
+
+// 设置 elicitation 处理函数，需在 Init 之前调用；设置后客户端向服务声明 elicitation 能力
+func (c *Client) SetElicitationHandler(handler types.ElicitationHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.elicitation = handler
+}
+
+// 将服务端的 elicitation/create 请求转换后交给处理函数
+func (c *Client) elicit(ctx context.Context, req *mcp.ElicitRequest) (*mcp.ElicitResult, error) {
+	c.mu.RLock()
+	handler := c.elicitation
+	c.mu.RUnlock()
+	if handler == nil || req.Params == nil {
+		return nil, fmt.Errorf("不支持elicitation")
+	}
+	schema, err := schemaMap(req.Params.RequestedSchema)
+	if err != nil {
+		return nil, fmt.Errorf("解析表单schema失败：%w", err)
+	}
+	result, err := handler(ctx, types.ElicitationRequest{
+		Server:  c.name,
+		Message: req.Params.Message,
+		Schema:  schema,
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch result.Action {
+	case types.ElicitAccept:
+		return &mcp.ElicitResult{Action: result.Action, Content: result.Content}, nil
+	case types.ElicitDecline, types.ElicitCancel:
+		return &mcp.ElicitResult{Action: result.Action}, nil
+	default:
+		return nil, fmt.Errorf("无效的elicitation结果：%s", result.Action)
+	}
+}
+
+// 客户端收到的schema通常已是map，其他类型经JSON转换
+func schemaMap(schema any) (map[string]interface{}, error) {
+	if schema == nil {
+		return nil, nil
+	}
+	if m, ok := schema.(map[string]interface{}); ok {
+		return m, nil
+	}
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,61 @@
+package mcp
+
+import (
+	"context"
+	"fmt"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"llm-mcp-rag-simple/types"
+)
+
+// 设置模型采样处理函数，需在 Init 之前调用；设置后客户端向服务声明 sampling 能力
+func (c *Client) SetSamplingHandler(handler types.SamplingHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sampling = handler
+}
+
+// 将服务端的 sampling/createMessage 请求转换后交给处理函数
+func (c *Client) createMessage(ctx context.Context, req *mcp.CreateMessageRequest) (*mcp.CreateMessageResult, error) {
+	c.mu.RLock()
+	handler := c.sampling
+	c.mu.RUnlock()
+	if handler == nil || req.Params == nil {
+		return nil, fmt.Errorf("不支持模型采样")
+	}
+	params := req.Params
+	request := types.SamplingRequest{
+		Server:        c.name,
+		Messages:      make([]types.ChatMessage, 0, len(params.Messages)),
+		SystemPrompt:  params.SystemPrompt,
+		MaxTokens:     int(params.MaxTokens),
+		StopSequences: params.StopSequences,
+	}
+	for _, message := range params.Messages {
+		if message == nil || message.Content == nil {
+			continue
+		}
+		request.Messages = append(request.Messages, contentMessage(string(message.Role), message.Content))
+	}
+	//SDK 将 temperature 解码为 float64，无法区分未设置与显式的 0；
+	//始终传递该值，保证服务要求的 0 不会被替换为模型的默认温度（未设置时由客户端决定，使用 0 同样符合协议）
+	temperature := params.Temperature
+	request.Temperature = &temperature
+	if params.ModelPreferences != nil {
+		for _, hint := range params.ModelPreferences.Hints {
+			if hint != nil && hint.Name != "" {
+				request.ModelHints = append(request.ModelHints, hint.Name)
+			}
+		}
+	}
+
+	result, err := handler(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return &mcp.CreateMessageResult{
+		Content:    &mcp.TextContent{Text: result.Content},
+		Model:      result.Model,
+		Role:       "assistant",
+		StopReason: result.StopReason,
+	}, nil
+}
@@ -1,17 +1,64 @@
 package mcp
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"llm-mcp-rag-simple/utils"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 )
 
 type ServerConfig struct {
-	Name    string
-	Command string
-	Args    []string
+	Name         string
+	Command      string
+	Args         []string
+	Env          map[string]string // 追加到服务进程的环境变量
+	Cwd          string            // 服务进程的工作目录，相对路径相对于配置文件所在目录
+	Enabled      *bool             // 为 false 时跳过该服务，未设置时启用
+	Transport    string            // stdio（默认）、http（Streamable HTTP）或 sse；配置了URL时默认为 http
+	URL          string            // 远程服务端点
+	Headers      map[string]string // 远程服务请求头
+	BearerToken  string            // 远程服务的Bearer令牌
+	Approval     string            // 工具调用审批策略：allow（默认）、ask 或 deny
+	ToolApproval map[string]string // 按工具名覆盖审批策略
+	Resources    []string          // 启动时导入知识库的资源URI，资源更新后自动重新导入
+	Sampling     string            // 服务请求模型采样的策略：ask（默认）、allow 或 deny
+	Roots        []string          // 向服务声明的根目录，本地路径（相对于配置文件所在目录）或 file:// URI
+	LogLevel     string            // 服务发送日志通知的最低级别，为空时不设置
 }
 
+// Claude Desktop 等MCP宿主使用的配置格式：{"mcpServers": {"name": {...}}}
+type desktopConfig struct {
+	MCPServers map[string]desktopServer `json:"mcpServers"`
+}
+
+type desktopServer struct {
+	Command      string            `json:"command"`
+	Args         []string          `json:"args"`
+	Env          map[string]string `json:"env"`
+	Cwd          string            `json:"cwd"`
+	Enabled      *bool             `json:"enabled"`
+	Disabled     bool              `json:"disabled"`
+	Type         string            `json:"type"` // 部分宿主使用 type 表示传输方式
+	Transport    string            `json:"transport"`
+	URL          string            `json:"url"`
+	Headers      map[string]string `json:"headers"`
+	BearerToken  string            `json:"bearerToken"`
+	Approval     string            `json:"approval"`
+	ToolApproval map[string]string `json:"toolApproval"`
+	Resources    []string          `json:"resources"`
+	Sampling     string            `json:"sampling"`
+	Roots        []string          `json:"roots"`
+	LogLevel     string            `json:"logLevel"`
+}
+
+// 环境变量引用：${VAR} 或 ${env:VAR}
+var envPattern = regexp.MustCompile(`\$\{(?:env:)?([A-Za-z_][A-Za-z0-9_]*)\}`)
+
 // 默认mcp服务器列表
 //func DefaultServerConfigs() []ServerConfig {
 //	return []ServerConfig{
@@ -19,23 +66,241 @@ type ServerConfig struct {
 //	}
 //}
 
-// 从指定json文件路径加载
+// 从指定json文件路径加载，支持服务数组与 mcpServers 对象两种格式
 func LoadServerConfigFromJSON(path string) ([]ServerConfig, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("读取json配置失败：%w", err)
 	}
-	var configs []ServerConfig
-	if err := json.Unmarshal(data, &configs); err != nil {
+	configs, err := parseServerConfigs(data)
+	if err != nil {
 		return nil, fmt.Errorf("解析json配置失败：%w", err)
 	}
 
+	baseDir := filepath.Dir(path)
+	names := make(map[string]bool)
+	var problems []string
 	filtered := make([]ServerConfig, 0, len(configs))
-	for _, c := range configs {
-		if c.Name == "" || c.Command == "" {
+	for i, c := range configs {
+		if c.Name == "" {
+			problems = append(problems, fmt.Sprintf("第%d个服务缺少Name", i+1))
+			continue
+		}
+		if names[c.Name] {
+			problems = append(problems, fmt.Sprintf("服务名称重复：%s", c.Name))
+			continue
+		}
+		names[c.Name] = true
+		if c.Enabled != nil && !*c.Enabled {
+			utils.LogInfo(fmt.Sprintf("mcp服务%s已禁用，跳过", c.Name))
+			continue
+		}
+		if issues := c.resolve(baseDir); len(issues) > 0 {
+			problems = append(problems, fmt.Sprintf("服务%s：%s", c.Name, strings.Join(issues, "；")))
 			continue
 		}
 		filtered = append(filtered, c)
 	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("mcp服务配置%s无效：\n  %s", path, strings.Join(problems, "\n  "))
+	}
 	return filtered, nil
 }
+
+// 按JSON顶层类型选择格式
+func parseServerConfigs(data []byte) ([]ServerConfig, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var configs []ServerConfig
+		if err := json.Unmarshal(trimmed, &configs); err != nil {
+			return nil, err
+		}
+		return configs, nil
+	}
+
+	var desktop desktopConfig
+	if err := json.Unmarshal(trimmed, &desktop); err != nil {
+		return nil, err
+	}
+	if desktop.MCPServers == nil {
+		return nil, fmt.Errorf("缺少 mcpServers 字段")
+	}
+	names := make([]string, 0, len(desktop.MCPServers))
+	for name := range desktop.MCPServers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	configs := make([]ServerConfig, 0, len(names))
+	for _, name := range names {
+		server := desktop.MCPServers[name]
+		transport := server.Transport
+		if transport == "" {
+			transport = server.Type
+		}
+		//streamable-http 为部分宿主使用的名称
+		if transport == "streamable-http" || transport == "streamableHttp" {
+			transport = "http"
+		}
+		enabled := server.Enabled
+		if server.Disabled {
+			disabled := false
+			enabled = &disabled
+		}
+		configs = append(configs, ServerConfig{
+			Name:         name,
+			Command:      server.Command,
+			Args:         server.Args,
+			Env:          server.Env,
+			Cwd:          server.Cwd,
+			Enabled:      enabled,
+			Transport:    transport,
+			URL:          server.URL,
+			Headers:      server.Headers,
+			BearerToken:  server.BearerToken,
+			Approval:     server.Approval,
+			ToolApproval: server.ToolApproval,
+			Resources:    server.Resources,
+			Sampling:     server.Sampling,
+			Roots:        server.Roots,
+			LogLevel:     server.LogLevel,
+		})
+	}
+	return configs, nil
+}
+
+// 展开环境变量、补全默认值并校验，返回发现的所有问题
+func (c *ServerConfig) resolve(baseDir string) []string {
+	var issues []string
+	missing := make(map[string]bool)
+	expand := func(value string) string {
+		return envPattern.ReplaceAllStringFunc(value, func(ref string) string {
+			name := envPattern.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing[name] = true
+			}
+			return value
+		})
+	}
+	c.Command = expand(c.Command)
+	c.Cwd = expand(c.Cwd)
+	c.URL = expand(c.URL)
+	c.BearerToken = expand(c.BearerToken)
+	for i, arg := range c.Args {
+		c.Args[i] = expand(arg)
+	}
+	for key, value := range c.Env {
+		c.Env[key] = expand(value)
+	}
+	for key, value := range c.Headers {
+		c.Headers[key] = expand(value)
+	}
+	for i, root := range c.Roots {
+		c.Roots[i] = expand(root)
+	}
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		issues = append(issues, fmt.Sprintf("引用的环境变量未设置：%s", strings.Join(names, ", ")))
+	}
+
+	if c.Transport == "" && c.URL != "" {
+		c.Transport = "http"
+	}
+	switch c.Transport {
+	case "", "stdio":
+		c.Transport = "stdio"
+		if c.Command == "" {
+			issues = append(issues, "stdio传输需要command")
+		}
+		if c.Cwd != "" {
+			if !filepath.IsAbs(c.Cwd) {
+				c.Cwd = filepath.Join(baseDir, c.Cwd)
+			}
+			if info, err := os.Stat(c.Cwd); err != nil || !info.IsDir() {
+				issues = append(issues, fmt.Sprintf("工作目录不存在：%s", c.Cwd))
+			}
+		}
+	case "http", "sse":
+		if c.URL == "" {
+			issues = append(issues, fmt.Sprintf("%s传输需要url", c.Transport))
+		}
+		if c.Command != "" {
+			issues = append(issues, "不能同时配置command与url")
+		}
+	default:
+		issues = append(issues, fmt.Sprintf("传输方式无效：%s（可选 stdio、http、sse）", c.Transport))
+	}
+
+	if !validApproval(c.Approval) {
+		issues = append(issues, fmt.Sprintf("审批策略无效：%s", c.Approval))
+	}
+	for i, root := range c.Roots {
+		if strings.HasPrefix(root, "file://") {
+			continue
+		}
+		if !filepath.IsAbs(root) {
+			root = filepath.Join(baseDir, root)
+			c.Roots[i] = root
+		}
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			issues = append(issues, fmt.Sprintf("根目录不存在：%s", root))
+		}
+	}
+
+	if !validApproval(c.Sampling) {
+		issues = append(issues, fmt.Sprintf("采样策略无效：%s", c.Sampling))
+	}
+	if c.LogLevel != "" && !ValidLogLevel(c.LogLevel) {
+		issues = append(issues, fmt.Sprintf("日志级别无效：%s（可选 %s）", c.LogLevel, strings.Join(logLevels, "、")))
+	}
+	for tool, approval := range c.ToolApproval {
+		if !validApproval(approval) {
+			issues = append(issues, fmt.Sprintf("工具%s的审批策略无效：%s", tool, approval))
+		}
+	}
+	return issues
+}
+
+// 是否为远程服务
+func (c ServerConfig) IsRemote() bool {
+	return c.Transport == "http" || c.Transport == "sse"
+}
+
+// 根据配置创建客户端
+func (c ServerConfig) NewClient(version string) *Client {
+	var client *Client
+	if c.IsRemote() {
+		client = NewRemoteClient(c.Name, RemoteOptions{
+			Transport:   c.Transport,
+			URL:         c.URL,
+			Headers:     c.Headers,
+			BearerToken: c.BearerToken,
+		}, version)
+	} else {
+		client = NewClient(c.Name, c.Command, c.Args, version)
+		client.env = c.Env
+		client.dir = c.Cwd
+	}
+	client.logLevel = c.LogLevel
+	for _, root := range c.Roots {
+		uri, err := RootURI(root)
+		if err != nil {
+			utils.LogWarn(fmt.Sprintf("mcp服务%s的根目录%s无效：%v", c.Name, root, err))
+			continue
+		}
+		client.roots = append(client.roots, Root{URI: uri, Name: filepath.Base(strings.TrimPrefix(root, "file://"))})
+	}
+	return client
+}
+
+func validApproval(approval string) bool {
+	switch approval {
+	case "", "allow", "ask", "deny":
+		return true
+	}
+	return false
+}
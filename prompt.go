@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"llm-mcp-rag-simple/agent"
+	mcpClient "llm-mcp-rag-simple/mcp"
+	"llm-mcp-rag-simple/types"
+	"os"
+	"strings"
+	"sync"
+)
+
+// 交互会话的标准输入，命令输入与查询过程中的确认提示共用同一个读取协程
+type cliInput struct {
+	lines       chan string     // 读取协程逐行发送，输入结束时关闭
+	err         error           // 输入结束的原因，lines 关闭后可读
+	alwaysAllow map[string]bool // 本次运行中始终允许的工具
+	mu          sync.Mutex
+}
+
+func newCLIInput() *cliInput {
+	in := &cliInput{
+		lines:       make(chan string),
+		alwaysAllow: make(map[string]bool),
+	}
+	go in.scan(os.Stdin)
+	return in
+}
+
+// 唯一读取标准输入的协程
+func (in *cliInput) scan(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		in.lines <- scanner.Text()
+	}
+	in.err = scanner.Err()
+	close(in.lines)
+}
+
+// 显示提示并读取一行，输入结束时返回 false。
+// 持有 in.mu 直到读到输入，mcp服务异步发来的采样、elicitation 请求会等到这一行输入完成后再提问，
+// 避免同一行输入被两个提示争抢
+func (in *cliInput) readLine(prompt string) (string, bool, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.readLineContext(context.Background(), prompt)
+}
+
+// 显示提示并读取一行，ctx 被取消时立即返回 ctx.Err()；调用方需持有 in.mu
+func (in *cliInput) readLineContext(ctx context.Context, prompt string) (string, bool, error) {
+	fmt.Print(prompt)
+	select {
+	case line, ok := <-in.lines:
+		if !ok {
+			return "", false, in.err
+		}
+		return strings.TrimSpace(line), true, nil
+	case <-ctx.Done():
+		fmt.Println()
+		return "", false, ctx.Err()
+	}
+}
+
+// 工具调用审批：显示工具名称与参数，由用户确认
+func (in *cliInput) approve(ctx context.Context, request agent.ApprovalRequest) (bool, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	name := request.Server + "." + request.Tool
+	if in.alwaysAllow[name] {
+		return true, nil
+	}
+
+	arguments, err := json.MarshalIndent(request.Arguments, "  ", "  ")
+	if err != nil {
+		arguments = []byte(fmt.Sprintf("%v", request.Arguments))
+	}
+	fmt.Printf("\n模型请求调用工具 %s，参数：\n  %s\n", name, arguments)
+	for {
+		answer, ok, err := in.readLineContext(ctx, "允许执行？[y]允许 [n]拒绝 [a]本次运行始终允许：")
+		if err != nil || !ok {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no", "":
+			return false, nil
+		case "a", "always":
+			in.alwaysAllow[name] = true
+			return true, nil
+		}
+	}
+}
+
+// 模型采样审批：显示请求的服务、最后一条消息与token上限，由用户确认
+func (in *cliInput) approveSampling(ctx context.Context, request types.SamplingRequest) (bool, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	key := "sampling:" + request.Server
+	if in.alwaysAllow[key] {
+		return true, nil
+	}
+
+	fmt.Printf("\nmcp服务 %s 请求使用模型生成回复（%d条消息，最多%d个token）", request.Server, len(request.Messages), request.MaxTokens)
+	if len(request.ModelHints) > 0 {
+		fmt.Printf("，模型偏好：%s", strings.Join(request.ModelHints, ", "))
+	}
+	fmt.Println()
+	if request.SystemPrompt != "" {
+		fmt.Printf("  系统提示词：%s\n", preview(request.SystemPrompt))
+	}
+	if len(request.Messages) > 0 {
+		last := request.Messages[len(request.Messages)-1]
+		fmt.Printf("  %s：%s\n", last.Role, preview(last.Content))
+	}
+	for {
+		answer, ok, err := in.readLineContext(ctx, "允许？[y]允许 [n]拒绝 [a]本次运行始终允许该服务：")
+		if err != nil || !ok {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no", "":
+			return false, nil
+		case "a", "always":
+			in.alwaysAllow[key] = true
+			return true, nil
+		}
+	}
+}
+
+// 截取较长文本的开头用于显示
+func preview(text string) string {
+	runes := []rune(strings.TrimSpace(text))
+	if len(runes) > 200 {
+		return string(runes[:200]) + "..."
+	}
+	return string(runes)
+}
+
+// 将mcp_servers.json中的采样配置转换为Agent策略，未配置时为 ask
+func samplingPolicy(config mcpClient.ServerConfig) agent.ApprovalPolicy {
+	if config.Sampling == "" {
+		return agent.ApprovalAsk
+	}
+	return agent.ApprovalPolicy(config.Sampling)
+}
+
+// 将mcp_servers.json中的审批配置转换为Agent策略
+func toolPolicy(config mcpClient.ServerConfig) agent.ToolPolicy {
+	policy := agent.ToolPolicy{
+		Default: agent.ApprovalPolicy(config.Approval),
+		Tools:   make(map[string]agent.ApprovalPolicy, len(config.ToolApproval)),
+	}
+	for tool, approval := range config.ToolApproval {
+		policy.Tools[tool] = agent.ApprovalPolicy(approval)
+	}
+	return policy
+}
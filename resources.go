@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"llm-mcp-rag-simple/agent"
+	"llm-mcp-rag-simple/utils"
+)
+
+// 列出mcp服务的资源与资源模板
+func printResources(agent *agent.Agent, server string) {
+	ctx := context.Background()
+	resources, err := agent.ListResources(ctx, server)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("获取资源列表失败：%v", err))
+		return
+	}
+	if len(resources) == 0 {
+		fmt.Println("没有可用的资源")
+	} else {
+		fmt.Printf("\n%s 的资源:\n", server)
+		for i, resource := range resources {
+			fmt.Printf("%d. %s  %s", i+1, resource.URI, resource.Name)
+			if resource.MIMEType != "" {
+				fmt.Printf(" (%s)", resource.MIMEType)
+			}
+			fmt.Println()
+			if resource.Description != "" {
+				fmt.Printf("   %s\n", resource.Description)
+			}
+		}
+	}
+
+	templates, err := agent.ListResourceTemplates(ctx, server)
+	if err != nil {
+		utils.LogDebug(fmt.Sprintf("获取资源模板失败：%v", err))
+		return
+	}
+	if len(templates) > 0 {
+		fmt.Println("\n资源模板:")
+		for _, template := range templates {
+			fmt.Printf("  %s  %s\n", template.URITemplate, template.Name)
+		}
+	}
+}
+
+// 显示资源内容，二进制内容只显示大小
+func printResource(agent *agent.Agent, server, uri string) {
+	contents, err := agent.ReadResource(context.Background(), server, uri)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("读取资源失败：%v", err))
+		return
+	}
+	for _, content := range contents {
+		fmt.Printf("\n[%s %s]\n", content.URI, content.MIMEType)
+		if content.Data != "" {
+			fmt.Printf("二进制内容，base64长度%d\n", len(content.Data))
+			continue
+		}
+		fmt.Println(content.Text)
+	}
+}
+
+// 将资源导入知识库
+func ingestResources(agent *agent.Agent, server string, uris []string) {
+	for _, uri := range uris {
+		if err := agent.IngestResource(context.Background(), server, uri); err != nil {
+			utils.LogError(fmt.Sprintf("导入资源失败：%v", err))
+			continue
+		}
+		fmt.Printf("已导入资源 %s\n", uri)
+	}
+}
@@ -0,0 +1,182 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"llm-mcp-rag-simple/types"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 持久化的对话会话，包含完整消息历史（工具调用与工具结果）
+type Session struct {
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name"`
+	CreatedAt time.Time              `json:"createdAt"`
+	UpdatedAt time.Time              `json:"updatedAt"`
+	Messages  []types.ChatMessage    `json:"messages"`
+	Usage     map[string]types.Usage `json:"usage,omitempty"` // 会话累计的各模型用量
+}
+
+// 基于JSON文件的会话存储，每个会话一个文件：<dir>/<id>.json
+type Store struct {
+	dir string
+	mu  sync.Mutex
+}
+
+var validID = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+func NewStore(dir string) (*Store, error) {
+	if dir == "" {
+		dir = "sessions"
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("创建会话目录失败：%w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// 创建新会话（尚未保存）
+func New(name string) *Session {
+	now := time.Now()
+	return &Session{
+		ID:        newID(now),
+		Name:      name,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Messages:  make([]types.ChatMessage, 0),
+	}
+}
+
+// 保存会话，写入临时文件后重命名，避免中途退出导致文件损坏
+func (s *Store) Save(session *Session) error {
+	if !validID.MatchString(session.ID) {
+		return fmt.Errorf("无效的会话ID：%s", session.ID)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化会话失败：%w", err)
+	}
+	tmp := s.path(session.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("写入会话文件失败：%w", err)
+	}
+	if err := os.Rename(tmp, s.path(session.ID)); err != nil {
+		return fmt.Errorf("写入会话文件失败：%w", err)
+	}
+	return nil
+}
+
+// 按ID加载会话
+func (s *Store) Load(id string) (*Session, error) {
+	if !validID.MatchString(id) {
+		return nil, fmt.Errorf("无效的会话ID：%s", id)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(id)
+}
+
+func (s *Store) load(id string) (*Session, error) {
+	data, err := os.ReadFile(s.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("会话不存在：%s", id)
+		}
+		return nil, fmt.Errorf("读取会话文件失败：%w", err)
+	}
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("解析会话文件失败：%w", err)
+	}
+	return &session, nil
+}
+
+// 列出所有会话，按更新时间倒序
+func (s *Store) List() ([]*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("读取会话目录失败：%w", err)
+	}
+	sessions := make([]*Session, 0, len(files))
+	for _, file := range files {
+		id := filepath.Base(file[:len(file)-len(".json")])
+		session, err := s.load(id)
+		if err != nil {
+			//跳过损坏的会话文件
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].UpdatedAt.After(sessions[j].UpdatedAt)
+	})
+	return sessions, nil
+}
+
+// 重命名会话
+func (s *Store) Rename(id, name string) error {
+	session, err := s.Load(id)
+	if err != nil {
+		return err
+	}
+	session.Name = name
+	return s.Save(session)
+}
+
+// 复制会话的完整历史为新会话
+func (s *Store) Fork(id, name string) (*Session, error) {
+	source, err := s.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = source.Name + " (fork)"
+	}
+	forked := New(name)
+	forked.Messages = append(forked.Messages, source.Messages...)
+	if err := s.Save(forked); err != nil {
+		return nil, err
+	}
+	return forked, nil
+}
+
+// 删除会话
+func (s *Store) Delete(id string) error {
+	if !validID.MatchString(id) {
+		return fmt.Errorf("无效的会话ID：%s", id)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(id)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("会话不存在：%s", id)
+		}
+		return fmt.Errorf("删除会话失败：%w", err)
+	}
+	return nil
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// 生成会话ID：时间戳 + 随机后缀
+func newID(now time.Time) string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return now.Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
@@ -0,0 +1,179 @@
+package session
+
+import (
+	"llm-mcp-rag-simple/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := NewStore(filepath.Join(t.TempDir(), "sessions"))
+	if err != nil {
+		t.Fatalf("NewStore失败：%v", err)
+	}
+	return store
+}
+
+// 包含工具调用与工具结果的对话
+func toolConversation() []types.ChatMessage {
+	call := types.ToolCall{ID: "call_1"}
+	call.Function.Name = "calc__add"
+	call.Function.Arguments = `{"a":1,"b":2}`
+	return []types.ChatMessage{
+		{Role: "user", Content: "1加2等于几"},
+		{Role: "assistant", ToolCalls: []types.ToolCall{call}},
+		{Role: "tool", Content: "3", ToolCallID: "call_1"},
+		{Role: "assistant", Content: "等于3"},
+	}
+}
+
+func TestStoreSaveAndLoad(t *testing.T) {
+	store := newTestStore(t)
+	sess := New("计算")
+	sess.Messages = toolConversation()
+	sess.Usage = map[string]types.Usage{"gpt-test": {PromptTokens: 120, CompletionTokens: 30}}
+	if err := store.Save(sess); err != nil {
+		t.Fatalf("Save失败：%v", err)
+	}
+	if _, err := os.Stat(store.path(sess.ID) + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("保存后不应残留临时文件")
+	}
+
+	loaded, err := store.Load(sess.ID)
+	if err != nil {
+		t.Fatalf("Load失败：%v", err)
+	}
+	if loaded.ID != sess.ID || loaded.Name != "计算" || !loaded.UpdatedAt.Equal(sess.UpdatedAt) {
+		t.Errorf("会话信息错误：%+v", loaded)
+	}
+	if !reflect.DeepEqual(loaded.Messages, sess.Messages) {
+		t.Errorf("消息历史错误：\n期望%+v\n实际%+v", sess.Messages, loaded.Messages)
+	}
+	if !reflect.DeepEqual(loaded.Usage, sess.Usage) {
+		t.Errorf("会话用量错误：%+v", loaded.Usage)
+	}
+}
+
+func TestStoreList(t *testing.T) {
+	store := newTestStore(t)
+	older, newer := New("旧"), New("新")
+	if err := store.Save(older); err != nil {
+		t.Fatalf("Save失败：%v", err)
+	}
+	if err := store.Save(newer); err != nil {
+		t.Fatalf("Save失败：%v", err)
+	}
+	//重新保存后排到最前
+	time.Sleep(time.Millisecond)
+	if err := store.Save(older); err != nil {
+		t.Fatalf("Save失败：%v", err)
+	}
+	//损坏的会话文件与其他文件被跳过
+	if err := os.WriteFile(store.path("broken"), []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(store.dir, "notes.txt"), []byte("hi"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := store.List()
+	if err != nil {
+		t.Fatalf("List失败：%v", err)
+	}
+	var names []string
+	for _, sess := range sessions {
+		names = append(names, sess.Name)
+	}
+	if strings.Join(names, ",") != "旧,新" {
+		t.Errorf("会话列表错误：%v", names)
+	}
+}
+
+func TestStoreLoadErrors(t *testing.T) {
+	store := newTestStore(t)
+	if err := os.WriteFile(store.path("broken"), []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		id   string
+		want string
+	}{
+		{"会话不存在", "missing", "会话不存在"},
+		{"会话文件损坏", "broken", "解析会话文件失败"},
+		{"无效的ID", "../secret", "无效的会话ID"},
+		{"空ID", "", "无效的会话ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := store.Load(tt.id)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("期望错误包含%q，实际为%v", tt.want, err)
+			}
+		})
+	}
+	if err := store.Save(&Session{ID: "../secret"}); err == nil {
+		t.Errorf("无效的ID不应保存")
+	}
+}
+
+func TestStoreDelete(t *testing.T) {
+	store := newTestStore(t)
+	sess := New("")
+	if err := store.Save(sess); err != nil {
+		t.Fatalf("Save失败：%v", err)
+	}
+	if err := store.Delete(sess.ID); err != nil {
+		t.Fatalf("Delete失败：%v", err)
+	}
+	if _, err := store.Load(sess.ID); err == nil || !strings.Contains(err.Error(), "会话不存在") {
+		t.Errorf("删除后不应能加载：%v", err)
+	}
+	if err := store.Delete(sess.ID); err == nil || !strings.Contains(err.Error(), "会话不存在") {
+		t.Errorf("重复删除应返回会话不存在：%v", err)
+	}
+	if err := store.Delete("../secret"); err == nil || !strings.Contains(err.Error(), "无效的会话ID") {
+		t.Errorf("无效的ID不应删除：%v", err)
+	}
+}
+
+func TestStoreRenameAndFork(t *testing.T) {
+	store := newTestStore(t)
+	sess := New("原名")
+	sess.Messages = toolConversation()
+	if err := store.Save(sess); err != nil {
+		t.Fatalf("Save失败：%v", err)
+	}
+	if err := store.Rename(sess.ID, "新名"); err != nil {
+		t.Fatalf("Rename失败：%v", err)
+	}
+	if loaded, _ := store.Load(sess.ID); loaded.Name != "新名" {
+		t.Errorf("重命名未保存：%+v", loaded)
+	}
+	if err := store.Rename("missing", "x"); err == nil {
+		t.Errorf("重命名不存在的会话应失败")
+	}
+
+	forked, err := store.Fork(sess.ID, "")
+	if err != nil {
+		t.Fatalf("Fork失败：%v", err)
+	}
+	if forked.ID == sess.ID || forked.Name != "新名 (fork)" {
+		t.Errorf("副本信息错误：%+v", forked)
+	}
+	loaded, err := store.Load(forked.ID)
+	if err != nil {
+		t.Fatalf("Load失败：%v", err)
+	}
+	if !reflect.DeepEqual(loaded.Messages, sess.Messages) {
+		t.Errorf("副本应包含完整历史：%+v", loaded.Messages)
+	}
+	if _, err := store.Fork("missing", ""); err == nil {
+		t.Errorf("复制不存在的会话应失败")
+	}
+}
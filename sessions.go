@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"llm-mcp-rag-simple/agent"
+	"llm-mcp-rag-simple/session"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/utils"
+)
+
+// 交互会话使用的会话状态：存储、当前会话及其对应的Agent对话
+type cliSessions struct {
+	store        *session.Store
+	current      *session.Session
+	conversation *agent.Conversation
+	attachments  []types.ContentPart // 随下一条消息发送的图片
+}
+
+// 将当前对话历史保存到当前会话
+func (s *cliSessions) save() {
+	s.current.Messages = s.conversation.GetMessageHistory()
+	s.current.Usage = s.conversation.UsageByModel()
+	if err := s.store.Save(s.current); err != nil {
+		utils.LogWarn(fmt.Sprintf("保存会话失败：%v", err))
+	}
+}
+
+// 列出已保存的会话
+func (s *cliSessions) list() {
+	sessions, err := s.store.List()
+	if err != nil {
+		utils.LogError(fmt.Sprintf("读取会话列表失败：%v", err))
+		return
+	}
+	if len(sessions) == 0 {
+		fmt.Println("没有已保存的会话")
+		return
+	}
+	fmt.Println("\n已保存的会话:")
+	for _, sess := range sessions {
+		marker := " "
+		if sess.ID == s.current.ID {
+			marker = "*"
+		}
+		fmt.Printf("%s %s  %-20s  %d条消息  %s\n", marker, sess.ID, displayName(sess), len(sess.Messages), sess.UpdatedAt.Format("2006-01-02 15:04"))
+	}
+}
+
+// 恢复会话的完整历史
+func (s *cliSessions) resume(id string) {
+	sess, err := s.store.Load(id)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("恢复会话失败：%v", err))
+		return
+	}
+	s.switchTo(sess)
+	fmt.Printf("已恢复会话 %s（%s）\n", sess.ID, displayName(sess))
+}
+
+// 切换到已保存的会话，恢复其历史与用量
+func (s *cliSessions) switchTo(sess *session.Session) {
+	s.conversation.LoadHistory(sess.Messages)
+	s.conversation.LoadUsage(sess.Usage)
+	s.current = sess
+}
+
+// 清除对话历史与用量并开始新会话
+func (s *cliSessions) startNew() {
+	s.conversation.ClearHistory()
+	s.conversation.LoadUsage(nil)
+	s.current = session.New("")
+}
+
+// 重命名会话
+func (s *cliSessions) rename(id, name string) {
+	if err := s.store.Rename(id, name); err != nil {
+		utils.LogError(fmt.Sprintf("重命名会话失败：%v", err))
+		return
+	}
+	if s.current.ID == id {
+		s.current.Name = name
+	}
+	fmt.Printf("会话 %s 已重命名为 %s\n", id, name)
+}
+
+// 复制会话并切换到副本
+func (s *cliSessions) fork(id, name string) {
+	//先保存当前会话，确保复制到最新历史
+	if s.current.ID == id {
+		s.save()
+	}
+	forked, err := s.store.Fork(id, name)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("复制会话失败：%v", err))
+		return
+	}
+	s.switchTo(forked)
+	fmt.Printf("已从 %s 复制出会话 %s（%s）\n", id, forked.ID, displayName(forked))
+}
+
+// 删除会话；删除的是当前会话时同时清除对话历史并开始新会话，避免下次自动保存时以新ID重新写回
+func (s *cliSessions) delete(id string) {
+	if err := s.store.Delete(id); err != nil {
+		utils.LogError(fmt.Sprintf("删除会话失败：%v", err))
+		return
+	}
+	if s.current.ID == id {
+		s.startNew()
+		fmt.Printf("会话 %s 已删除，已开始新会话\n", id)
+		return
+	}
+	fmt.Printf("会话 %s 已删除\n", id)
+}
+
+func displayName(sess *session.Session) string {
+	if sess.Name == "" {
+		return "(未命名)"
+	}
+	return sess.Name
+}
+
+// 下一次查询的选项，携带已附加的图片
+func (s *cliSessions) queryOptions() *agent.QueryOptions {
+	if len(s.attachments) == 0 {
+		return nil
+	}
+	return &agent.QueryOptions{Images: s.attachments}
+}
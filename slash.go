@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"llm-mcp-rag-simple/agent"
+	"llm-mcp-rag-simple/types"
+	"llm-mcp-rag-simple/utils"
+	"strings"
+)
+
+// 处理以 / 开头的输入：/prompts 列出mcp提示词，/server:prompt 运行提示词
+func runSlashCommand(ctx context.Context, agent *agent.Agent, sessions *cliSessions, stdin *cliInput, input string) {
+	fields := strings.Fields(strings.TrimPrefix(input, "/"))
+	if len(fields) == 0 {
+		return
+	}
+	if fields[0] == "prompts" {
+		printPrompts(ctx, agent)
+		return
+	}
+
+	server, prompt, err := findPrompt(ctx, agent, fields[0])
+	if err != nil {
+		utils.LogError(err.Error())
+		return
+	}
+	arguments, err := collectPromptArguments(stdin, prompt, fields[1:])
+	if err != nil {
+		utils.LogError(err.Error())
+		return
+	}
+	response, err := agent.RunPrompt(ctx, sessions.conversation, server, prompt.Name, arguments, sessions.queryOptions())
+	if err != nil {
+		utils.LogError(fmt.Sprintf("运行提示词失败：%v", err))
+		return
+	}
+	if response == nil {
+		fmt.Println("已将提示词消息添加到对话")
+	} else {
+		sessions.attachments = nil
+		printResponse(response)
+	}
+	sessions.save()
+}
+
+// 列出所有mcp服务的提示词
+func printPrompts(ctx context.Context, agent *agent.Agent) {
+	found := false
+	for _, server := range agent.GetMCPClient() {
+		prompts, err := agent.ListPrompts(ctx, server)
+		if err != nil {
+			utils.LogDebug(fmt.Sprintf("获取mcp client【%s】的提示词失败：%v", server, err))
+			continue
+		}
+		for _, prompt := range prompts {
+			found = true
+			fmt.Printf("  /%s:%s", server, prompt.Name)
+			for _, argument := range prompt.Arguments {
+				if argument.Required {
+					fmt.Printf(" <%s>", argument.Name)
+				} else {
+					fmt.Printf(" [%s]", argument.Name)
+				}
+			}
+			if prompt.Description != "" {
+				fmt.Printf(" - %s", prompt.Description)
+			}
+			fmt.Println()
+		}
+	}
+	if !found {
+		fmt.Println("没有可用的MCP提示词")
+	}
+}
+
+// 按 server:prompt 或唯一的提示词名称查找提示词
+func findPrompt(ctx context.Context, agent *agent.Agent, command string) (string, types.MCPPrompt, error) {
+	server, name, qualified := strings.Cut(command, ":")
+	servers := []string{server}
+	if !qualified {
+		name = command
+		servers = agent.GetMCPClient()
+	}
+	var matches []string
+	var match types.MCPPrompt
+	for _, s := range servers {
+		prompts, err := agent.ListPrompts(ctx, s)
+		if err != nil {
+			if qualified {
+				return "", types.MCPPrompt{}, err
+			}
+			continue
+		}
+		for _, prompt := range prompts {
+			if prompt.Name == name {
+				matches = append(matches, s)
+				match = prompt
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", types.MCPPrompt{}, fmt.Errorf("未找到提示词：%s，输入 /prompts 查看可用提示词", command)
+	case 1:
+		return matches[0], match, nil
+	default:
+		return "", types.MCPPrompt{}, fmt.Errorf("多个mcp服务提供提示词%s，请使用 /<server>:%s：%s", name, name, strings.Join(matches, ", "))
+	}
+}
+
+// 收集提示词参数：命令行中的 name=value 或按声明顺序的位置参数，缺少的参数逐个询问
+func collectPromptArguments(stdin *cliInput, prompt types.MCPPrompt, tokens []string) (map[string]string, error) {
+	arguments := make(map[string]string)
+	declared := make(map[string]bool, len(prompt.Arguments))
+	for _, argument := range prompt.Arguments {
+		declared[argument.Name] = true
+	}
+	position := 0
+	for _, token := range tokens {
+		if name, value, ok := strings.Cut(token, "="); ok && declared[name] {
+			arguments[name] = value
+			continue
+		}
+		for position < len(prompt.Arguments) && arguments[prompt.Arguments[position].Name] != "" {
+			position++
+		}
+		if position >= len(prompt.Arguments) {
+			return nil, fmt.Errorf("提示词%s的参数过多：%s", prompt.Name, token)
+		}
+		arguments[prompt.Arguments[position].Name] = token
+	}
+
+	for _, argument := range prompt.Arguments {
+		if arguments[argument.Name] != "" {
+			continue
+		}
+		label := argument.Name
+		if argument.Description != "" {
+			label = fmt.Sprintf("%s（%s）", argument.Name, argument.Description)
+		}
+		if !argument.Required {
+			label += "，可留空"
+		}
+		for {
+			value, ok, err := stdin.readLine(label + "：")
+			if err != nil {
+				return nil, fmt.Errorf("读取参数失败：%w", err)
+			}
+			if !ok {
+				return nil, fmt.Errorf("输入已结束")
+			}
+			if value != "" {
+				arguments[argument.Name] = value
+			}
+			if value != "" || !argument.Required {
+				break
+			}
+			fmt.Println("该参数为必填项")
+		}
+	}
+	return arguments, nil
+}
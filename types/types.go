@@ -1,6 +1,10 @@
 package types
 
-import "context"
+import (
+	"context"
+	"strings"
+	"time"
+)
 
 // 向量存储
 type VectorStoreItem struct {
@@ -23,16 +27,105 @@ type Tool struct {
 	InputSchema map[string]interface{} `json:"inputSchema"` // 输入参数模式
 }
 
+// Parts 不为空时消息为多段内容（文本与图片），Content 为其中文本的拼接，用于显示与估算
 type ChatMessage struct {
-	Role       string     `json:"role"`
-	Content    string     `json:"content"`
-	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
-	ToolCallID string     `json:"tool_call_id,omitempty"`
+	Role       string        `json:"role"`
+	Content    string        `json:"content"`
+	Parts      []ContentPart `json:"parts,omitempty"`
+	ToolCalls  []ToolCall    `json:"tool_calls,omitempty"`
+	ToolCallID string        `json:"tool_call_id,omitempty"`
+}
+
+const (
+	ContentPartText  = "text"
+	ContentPartImage = "image_url"
+)
+
+// 多段消息中的一段
+type ContentPart struct {
+	Type     string `json:"type"`                // text 或 image_url
+	Text     string `json:"text,omitempty"`      // Type 为 text 时使用
+	ImageURL string `json:"image_url,omitempty"` // http(s) 地址或 data URL
+	Detail   string `json:"detail,omitempty"`    // 图片精度：auto、low、high
+}
+
+// 消息中图片的数量
+func (m ChatMessage) ImageCount() int {
+	count := 0
+	for _, part := range m.Parts {
+		if part.Type == ContentPartImage {
+			count++
+		}
+	}
+	return count
+}
+
+// 模型生成参数，零值字段表示使用服务端默认值
+type GenerationOptions struct {
+	Temperature    *float64          `json:"temperature,omitempty"`
+	TopP           *float64          `json:"top_p,omitempty"`
+	MaxTokens      int               `json:"max_tokens,omitempty"`
+	Stop           []string          `json:"stop,omitempty"`
+	Seed           *int              `json:"seed,omitempty"`
+	ResponseFormat string            `json:"response_format,omitempty"` // text、json_object 或 json_schema
+	JSONSchema     *JSONSchemaFormat `json:"json_schema,omitempty"`     // ResponseFormat 为 json_schema 时使用
+	ToolChoice     string            `json:"tool_choice,omitempty"`     // auto、none、required 或工具名称
+}
+
+// 结构化输出使用的JSON Schema
+type JSONSchemaFormat struct {
+	Name   string                 `json:"name"`
+	Schema map[string]interface{} `json:"schema"`
+	Strict bool                   `json:"strict"`
+}
+
+// 用override中已设置的字段覆盖当前参数
+func (o GenerationOptions) Merge(override GenerationOptions) GenerationOptions {
+	if override.Temperature != nil {
+		o.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		o.TopP = override.TopP
+	}
+	if override.MaxTokens > 0 {
+		o.MaxTokens = override.MaxTokens
+	}
+	if len(override.Stop) > 0 {
+		o.Stop = override.Stop
+	}
+	if override.Seed != nil {
+		o.Seed = override.Seed
+	}
+	if override.ResponseFormat != "" {
+		o.ResponseFormat = override.ResponseFormat
+	}
+	if override.JSONSchema != nil {
+		o.JSONSchema = override.JSONSchema
+	}
+	if override.ToolChoice != "" {
+		o.ToolChoice = override.ToolChoice
+	}
+	return o
 }
 
 type ChatResponse struct {
-	Content   string     `json:"content"`
-	ToolCalls []ToolCall `json:"toolCalls"`
+	Content      string     `json:"content"`
+	ToolCalls    []ToolCall `json:"toolCalls"`
+	Model        string     `json:"model,omitempty"`        // 实际响应的模型
+	FinishReason string     `json:"finishReason,omitempty"` // 结束原因，如 stop、length、tool_calls，服务商未返回时为空
+	Usage        *Usage     `json:"usage,omitempty"`        // 由Agent汇总的本次查询用量
+}
+
+// token用量与费用
+type Usage struct {
+	PromptTokens     int     `json:"promptTokens"`
+	CompletionTokens int     `json:"completionTokens"`
+	EmbeddingTokens  int     `json:"embeddingTokens"`
+	Cost             float64 `json:"cost"`
+}
+
+func (u Usage) TotalTokens() int {
+	return u.PromptTokens + u.CompletionTokens + u.EmbeddingTokens
 }
 
 // 嵌入
@@ -46,25 +139,55 @@ type EmbeddingResponse struct {
 	Data []struct {
 		Embedding []float64 `json:"embedding"` //嵌入后向量结果
 	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
 }
 
 // mcpTool
 type MCPToolResult struct {
-	Content []struct {
-		Type string `json:"type"`
-		Text string `json:"text"`
-	} `json:"content"`
-	IsError bool `json:"isError,omitempty"`
+	Content []MCPContent `json:"content"`
+	IsError bool         `json:"isError,omitempty"`
+}
+
+const (
+	MCPContentText         = "text"
+	MCPContentImage        = "image"
+	MCPContentAudio        = "audio"
+	MCPContentResourceLink = "resource_link"
+	MCPContentResource     = "resource" // 内嵌资源
+)
+
+// 工具结果中的一段内容
+type MCPContent struct {
+	Type        string `json:"type"`
+	Text        string `json:"text,omitempty"`     // 文本内容，或内嵌文本资源的内容
+	Data        string `json:"data,omitempty"`     // 图片、音频或内嵌二进制资源的base64数据
+	MIMEType    string `json:"mimeType,omitempty"` // 图片、音频与资源的类型
+	URI         string `json:"uri,omitempty"`      // 资源链接与内嵌资源的地址
+	Name        string `json:"name,omitempty"`     // 资源链接名称
+	Description string `json:"description,omitempty"`
+}
+
+// 只包含一段文本的工具结果
+func NewTextToolResult(text string, isError bool) *MCPToolResult {
+	return &MCPToolResult{
+		Content: []MCPContent{{Type: MCPContentText, Text: text}},
+		IsError: isError,
+	}
 }
 
 type VectorStore interface {
 	AddEmbedding(ctx context.Context, embedding []float64, document string, metadata map[string]interface{}) error
 	Search(ctx context.Context, queryEmbedding []float64, limit int) ([]string, error)
+	DeleteByMetadata(ctx context.Context, key string, value interface{}) (int, error) // 删除元数据匹配的项，返回删除数量
 	Size() int
 }
 
 type EmbeddingRetriever interface {
 	EmbedDocument(ctx context.Context, document string) ([]float64, error)
+	EmbedDocumentWithMetadata(ctx context.Context, document string, metadata map[string]interface{}) ([]float64, error)
 	EmbedQuery(ctx context.Context, query string) ([]float64, error)
 	Retrieve(ctx context.Context, query string, limit int) ([]string, error)
 }
@@ -74,14 +197,165 @@ type MCPClient interface {
 	Close() error
 	GetTools() []Tool
 	CallTool(ctx context.Context, name string, params map[string]interface{}) (*MCPToolResult, error)
+	Status() MCPClientStatus
+}
+
+// mcp客户端连接状态
+type MCPClientState string
+
+const (
+	MCPStateStarting MCPClientState = "starting" // 正在连接
+	MCPStateReady    MCPClientState = "ready"    // 已连接，可以调用工具
+	MCPStateDegraded MCPClientState = "degraded" // 连接断开，正在重连
+	MCPStateFailed   MCPClientState = "failed"   // 连接失败且已停止重试
+)
+
+type MCPClientStatus struct {
+	State     MCPClientState `json:"state"`
+	Tools     int            `json:"tools"`
+	Restarts  int            `json:"restarts"` // 成功重连次数
+	LastError string         `json:"lastError,omitempty"`
+}
+
+// 记录服务日志的mcp客户端
+type MCPLogClient interface {
+	Logs(limit int) []MCPLogEntry                        // 最近的日志，按时间顺序
+	SetLogLevel(ctx context.Context, level string) error // 设置服务发送日志通知的最低级别
+}
+
+// mcp服务的一条日志
+type MCPLogEntry struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`           // stderr、log 或 progress
+	Level   string    `json:"level,omitempty"`  // 日志通知的级别
+	Logger  string    `json:"logger,omitempty"` // 日志通知的记录器名称
+	Message string    `json:"message"`
+}
+
+// 格式化为一行文本，用于日志文件与命令行显示
+func (e MCPLogEntry) String() string {
+	var builder strings.Builder
+	builder.WriteString(e.Time.Format("2006-01-02 15:04:05.000"))
+	builder.WriteString(" [" + e.Source)
+	if e.Level != "" {
+		builder.WriteString(" " + e.Level)
+	}
+	builder.WriteString("]")
+	if e.Logger != "" {
+		builder.WriteString(" " + e.Logger + ":")
+	}
+	builder.WriteString(" " + e.Message)
+	return builder.String()
+}
+
+// 支持资源的mcp客户端
+type MCPResourceClient interface {
+	ListResources(ctx context.Context) ([]MCPResource, error)
+	ListResourceTemplates(ctx context.Context) ([]MCPResourceTemplate, error)
+	ReadResource(ctx context.Context, uri string) ([]MCPContent, error)
+	Subscribe(ctx context.Context, uri string) error
+	Unsubscribe(ctx context.Context, uri string) error
+	OnResourceUpdated(handler func(uri string)) // 订阅的资源更新时调用
+}
+
+// 支持提示词模板的mcp客户端
+type MCPPromptClient interface {
+	ListPrompts(ctx context.Context) ([]MCPPrompt, error)
+	GetPrompt(ctx context.Context, name string, arguments map[string]string) ([]ChatMessage, error) // 返回渲染后的消息
+}
+
+// 支持模型采样（sampling/createMessage）的mcp客户端
+type MCPSamplingClient interface {
+	SetSamplingHandler(handler SamplingHandler) // 需在 Init 之前调用
+}
+
+// mcp服务请求由宿主运行的模型补全
+type SamplingRequest struct {
+	Server        string        `json:"server"`
+	Messages      []ChatMessage `json:"messages"`
+	SystemPrompt  string        `json:"systemPrompt,omitempty"`
+	MaxTokens     int           `json:"maxTokens"`
+	Temperature   *float64      `json:"temperature,omitempty"`
+	StopSequences []string      `json:"stopSequences,omitempty"`
+	ModelHints    []string      `json:"modelHints,omitempty"` // 模型偏好，按优先级排列，作为模型名称的子串匹配
+}
+
+type SamplingResult struct {
+	Content    string `json:"content"`
+	Model      string `json:"model"`
+	StopReason string `json:"stopReason,omitempty"` // endTurn、maxTokens 或 stopSequence
+}
+
+// 处理mcp服务的模型采样请求
+type SamplingHandler func(ctx context.Context, request SamplingRequest) (*SamplingResult, error)
+
+// 支持 elicitation（服务向用户请求输入）的mcp客户端
+type MCPElicitationClient interface {
+	SetElicitationHandler(handler ElicitationHandler) // 需在 Init 之前调用
+}
+
+// 用户对 elicitation 请求的处理结果
+const (
+	ElicitAccept  = "accept"  // 用户提交了表单
+	ElicitDecline = "decline" // 用户明确拒绝
+	ElicitCancel  = "cancel"  // 用户未作选择即关闭
+)
+
+// mcp服务请求用户填写的表单，Schema 为只包含顶层基础类型属性的 JSON Schema
+type ElicitationRequest struct {
+	Server  string                 `json:"server"`
+	Message string                 `json:"message"`
+	Schema  map[string]interface{} `json:"schema,omitempty"`
+}
+
+type ElicitationResult struct {
+	Action  string                 `json:"action"`            // accept、decline 或 cancel
+	Content map[string]interface{} `json:"content,omitempty"` // Action 为 accept 时的表单数据
+}
+
+// 处理mcp服务的 elicitation 请求，非交互式宿主可自行实现
+type ElicitationHandler func(ctx context.Context, request ElicitationRequest) (*ElicitationResult, error)
+
+// mcp服务提供的提示词模板
+type MCPPrompt struct {
+	Name        string              `json:"name"`
+	Title       string              `json:"title,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Arguments   []MCPPromptArgument `json:"arguments,omitempty"`
+}
+
+type MCPPromptArgument struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+// mcp服务提供的资源
+type MCPResource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MIMEType    string `json:"mimeType,omitempty"`
+	Size        int64  `json:"size,omitempty"` // 字节数，0 表示未知
+}
+
+// 资源模板，URITemplate 遵循 RFC 6570
+type MCPResourceTemplate struct {
+	URITemplate string `json:"uriTemplate"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MIMEType    string `json:"mimeType,omitempty"`
 }
 
 type ChatClient interface {
-	Chat(ctx context.Context, prompt string) (*ChatResponse, error)
+	Chat(ctx context.Context, prompt string, options GenerationOptions) (*ChatResponse, error)
+	SetTools(tools []Tool)
+	AttachParts(parts []ContentPart) // 附加到下一条用户消息的内容（如图片），发送后清空
 	AppendToolResult(toolCallID, toolOutput string)
 	SetSystemPrompt(context string)
 	SetContext(context string)
 	GetMessageHistory() []ChatMessage
+	SetMessageHistory(messages []ChatMessage)
 	ClearHistory()
 }
 
@@ -0,0 +1,197 @@
+package usage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"llm-mcp-rag-simple/types"
+	"os"
+	"sort"
+	"sync"
+)
+
+// 超出用量预算
+var ErrBudgetExceeded = errors.New("超出用量预算")
+
+// 按模型累计token用量，并发安全
+type Meter struct {
+	mu     sync.Mutex
+	models map[string]*types.Usage
+}
+
+func NewMeter() *Meter {
+	return &Meter{models: make(map[string]*types.Usage)}
+}
+
+// 记录对话用量
+func (m *Meter) AddChat(model string, promptTokens, completionTokens int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.model(model)
+	u.PromptTokens += promptTokens
+	u.CompletionTokens += completionTokens
+}
+
+// 记录嵌入用量
+func (m *Meter) AddEmbedding(model string, tokens int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.model(model).EmbeddingTokens += tokens
+}
+
+// 合并另一个计量器的用量
+func (m *Meter) Merge(other *Meter) {
+	for model, u := range other.ByModel() {
+		m.mu.Lock()
+		target := m.model(model)
+		target.PromptTokens += u.PromptTokens
+		target.CompletionTokens += u.CompletionTokens
+		target.EmbeddingTokens += u.EmbeddingTokens
+		m.mu.Unlock()
+	}
+}
+
+// 用给定的各模型用量替换当前用量，nil 表示清零
+func (m *Meter) Reset(byModel map[string]types.Usage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.models = make(map[string]*types.Usage, len(byModel))
+	for model, u := range byModel {
+		u := u
+		m.models[model] = &u
+	}
+}
+
+// 返回各模型用量的副本
+func (m *Meter) ByModel() map[string]types.Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make(map[string]types.Usage, len(m.models))
+	for model, u := range m.models {
+		result[model] = *u
+	}
+	return result
+}
+
+func (m *Meter) model(model string) *types.Usage {
+	u, exists := m.models[model]
+	if !exists {
+		u = &types.Usage{}
+		m.models[model] = u
+	}
+	return u
+}
+
+type meterKey struct{}
+
+// 返回携带计量器的context，对话与嵌入客户端通过它上报用量
+func WithMeter(ctx context.Context, meter *Meter) context.Context {
+	return context.WithValue(ctx, meterKey{}, meter)
+}
+
+// 返回context中的计量器，不存在时返回nil
+func FromContext(ctx context.Context) *Meter {
+	meter, _ := ctx.Value(meterKey{}).(*Meter)
+	return meter
+}
+
+// 向context中的计量器上报对话用量
+func RecordChat(ctx context.Context, model string, promptTokens, completionTokens int) {
+	if meter := FromContext(ctx); meter != nil {
+		meter.AddChat(model, promptTokens, completionTokens)
+	}
+}
+
+// 向context中的计量器上报嵌入用量
+func RecordEmbedding(ctx context.Context, model string, tokens int) {
+	if meter := FromContext(ctx); meter != nil {
+		meter.AddEmbedding(model, tokens)
+	}
+}
+
+// 每百万token价格，嵌入按Input计价
+type Price struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// 模型价格表
+type PriceTable map[string]Price
+
+// 从JSON文件加载价格表，格式：{"model": {"input": 0.5, "output": 1.5}}
+func LoadPriceTable(path string) (PriceTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取价格表失败：%w", err)
+	}
+	var table PriceTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("解析价格表失败：%w", err)
+	}
+	return table, nil
+}
+
+// 计算单个模型用量的费用
+func (p PriceTable) Cost(model string, u types.Usage) float64 {
+	price, exists := p[model]
+	if !exists {
+		return 0
+	}
+	input := float64(u.PromptTokens + u.EmbeddingTokens)
+	output := float64(u.CompletionTokens)
+	return (input*price.Input + output*price.Output) / 1e6
+}
+
+// 汇总计量器中所有模型的用量与费用
+func (p PriceTable) Total(meters ...*Meter) types.Usage {
+	var total types.Usage
+	for _, meter := range meters {
+		if meter == nil {
+			continue
+		}
+		for model, u := range meter.ByModel() {
+			total.PromptTokens += u.PromptTokens
+			total.CompletionTokens += u.CompletionTokens
+			total.EmbeddingTokens += u.EmbeddingTokens
+			total.Cost += p.Cost(model, u)
+		}
+	}
+	return total
+}
+
+// 按模型返回用量与费用，按模型名排序
+func (p PriceTable) Report(meter *Meter) []ModelUsage {
+	byModel := meter.ByModel()
+	report := make([]ModelUsage, 0, len(byModel))
+	for model, u := range byModel {
+		u.Cost = p.Cost(model, u)
+		report = append(report, ModelUsage{Model: model, Usage: u})
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Model < report[j].Model
+	})
+	return report
+}
+
+type ModelUsage struct {
+	Model string
+	types.Usage
+}
+
+// 硬性用量预算，零值表示不限制
+type Budget struct {
+	MaxCost   float64
+	MaxTokens int
+}
+
+// 检查用量是否超出预算
+func (b Budget) Check(u types.Usage) error {
+	if b.MaxCost > 0 && u.Cost >= b.MaxCost {
+		return fmt.Errorf("%w：费用%.4f已达到上限%.4f", ErrBudgetExceeded, u.Cost, b.MaxCost)
+	}
+	if b.MaxTokens > 0 && u.TotalTokens() >= b.MaxTokens {
+		return fmt.Errorf("%w：token用量%d已达到上限%d", ErrBudgetExceeded, u.TotalTokens(), b.MaxTokens)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"llm-mcp-rag-simple/types"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var testPrices = PriceTable{
+	"gpt-test":   {Input: 2, Output: 8},
+	"embed-test": {Input: 0.1},
+}
+
+func TestPriceTableCost(t *testing.T) {
+	tests := []struct {
+		name  string
+		model string
+		usage types.Usage
+		want  float64
+	}{
+		{"输入与输出分别计价", "gpt-test", types.Usage{PromptTokens: 1_000_000, CompletionTokens: 500_000}, 6},
+		{"嵌入按输入计价", "embed-test", types.Usage{EmbeddingTokens: 2_000_000}, 0.2},
+		{"未知模型不计费", "other", types.Usage{PromptTokens: 1_000_000}, 0},
+		{"零用量", "gpt-test", types.Usage{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testPrices.Cost(tt.model, tt.usage); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("期望%v，实际%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPriceTableTotalAndReport(t *testing.T) {
+	query := NewMeter()
+	query.AddChat("gpt-test", 1_000_000, 0)
+	query.AddEmbedding("embed-test", 1_000_000)
+	process := NewMeter()
+	process.AddChat("gpt-test", 0, 1_000_000)
+	process.AddChat("other", 10, 10)
+
+	total := testPrices.Total(query, nil, process)
+	if total.PromptTokens != 1_000_010 || total.CompletionTokens != 1_000_010 || total.EmbeddingTokens != 1_000_000 {
+		t.Errorf("用量汇总错误：%+v", total)
+	}
+	if math.Abs(total.Cost-10.1) > 1e-9 {
+		t.Errorf("费用汇总错误：%v", total.Cost)
+	}
+
+	process.Merge(query)
+	report := testPrices.Report(process)
+	if len(report) != 3 || report[0].Model != "embed-test" || report[1].Model != "gpt-test" || report[2].Model != "other" {
+		t.Fatalf("明细应按模型名排序：%+v", report)
+	}
+	if gpt := report[1]; gpt.PromptTokens != 1_000_000 || gpt.CompletionTokens != 1_000_000 || math.Abs(gpt.Cost-10) > 1e-9 {
+		t.Errorf("gpt-test明细错误：%+v", gpt)
+	}
+	if report[2].Cost != 0 {
+		t.Errorf("未知模型不应计费：%+v", report[2])
+	}
+}
+
+func TestLoadPriceTable(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "prices.json")
+	if err := os.WriteFile(valid, []byte(`{"gpt-test": {"input": 2, "output": 8}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	table, err := LoadPriceTable(valid)
+	if err != nil {
+		t.Fatalf("LoadPriceTable失败：%v", err)
+	}
+	if price := table["gpt-test"]; price.Input != 2 || price.Output != 8 {
+		t.Errorf("价格表错误：%+v", table)
+	}
+
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`{"gpt-test": 2}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPriceTable(invalid); err == nil {
+		t.Errorf("格式错误的价格表应加载失败")
+	}
+	if _, err := LoadPriceTable(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("不存在的价格表应加载失败")
+	}
+}
+
+func TestBudgetCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		budget   Budget
+		usage    types.Usage
+		exceeded bool
+	}{
+		{"不限制", Budget{}, types.Usage{PromptTokens: 1 << 30, Cost: 1000}, false},
+		{"token未达上限", Budget{MaxTokens: 100}, types.Usage{PromptTokens: 50, CompletionTokens: 49}, false},
+		{"token达到上限", Budget{MaxTokens: 100}, types.Usage{PromptTokens: 50, CompletionTokens: 50}, true},
+		{"嵌入token计入上限", Budget{MaxTokens: 100}, types.Usage{PromptTokens: 50, EmbeddingTokens: 60}, true},
+		{"费用未达上限", Budget{MaxCost: 1}, types.Usage{Cost: 0.9999}, false},
+		{"费用达到上限", Budget{MaxCost: 1}, types.Usage{Cost: 1}, true},
+		{"费用超出上限", Budget{MaxCost: 1, MaxTokens: 1000}, types.Usage{Cost: 1.5, PromptTokens: 10}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.budget.Check(tt.usage)
+			if tt.exceeded != (err != nil) {
+				t.Fatalf("期望超出预算=%v，实际错误为%v", tt.exceeded, err)
+			}
+			if err != nil && !errors.Is(err, ErrBudgetExceeded) {
+				t.Errorf("错误应包装ErrBudgetExceeded：%v", err)
+			}
+		})
+	}
+}
+
+func TestMeterFromContext(t *testing.T) {
+	//没有计量器时上报被忽略
+	RecordChat(context.Background(), "gpt-test", 1, 1)
+	if FromContext(context.Background()) != nil {
+		t.Errorf("空context不应有计量器")
+	}
+
+	meter := NewMeter()
+	ctx := WithMeter(context.Background(), meter)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			RecordChat(ctx, "gpt-test", 2, 1)
+			RecordEmbedding(ctx, "embed-test", 3)
+		}()
+	}
+	wg.Wait()
+	byModel := meter.ByModel()
+	if got := byModel["gpt-test"]; got.PromptTokens != 20 || got.CompletionTokens != 10 {
+		t.Errorf("对话用量错误：%+v", got)
+	}
+	if got := byModel["embed-test"]; got.EmbeddingTokens != 30 {
+		t.Errorf("嵌入用量错误：%+v", got)
+	}
+}
+
+func TestMeterReset(t *testing.T) {
+	meter := NewMeter()
+	meter.AddChat("gpt-test", 5, 5)
+	saved := map[string]types.Usage{"other": {PromptTokens: 3, CompletionTokens: 2}}
+	meter.Reset(saved)
+	meter.AddChat("other", 1, 1)
+	byModel := meter.ByModel()
+	if len(byModel) != 1 || byModel["other"].PromptTokens != 4 || byModel["other"].CompletionTokens != 3 {
+		t.Errorf("恢复后的用量错误：%+v", byModel)
+	}
+	if saved["other"].PromptTokens != 3 {
+		t.Errorf("不应修改传入的用量：%+v", saved)
+	}
+	meter.Reset(nil)
+	if len(meter.ByModel()) != 0 {
+		t.Errorf("nil应清零用量：%+v", meter.ByModel())
+	}
+}
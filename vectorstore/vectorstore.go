@@ -94,6 +94,22 @@ func (vs *InMemoryVectorStore) Search(ctx context.Context, queryEmbedding []floa
 	return result, nil
 }
 
+// 删除元数据中 key 等于 value 的向量项，用于文档更新后重新导入
+func (vs *InMemoryVectorStore) DeleteByMetadata(ctx context.Context, key string, value interface{}) (int, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	kept := vs.items[:0]
+	for _, item := range vs.items {
+		if v, ok := item.Metadata[key]; ok && v == value {
+			continue
+		}
+		kept = append(kept, item)
+	}
+	removed := len(vs.items) - len(kept)
+	vs.items = kept
+	return removed, nil
+}
+
 // 返回存储中向量项总数
 func (vs *InMemoryVectorStore) Size() int {
 	vs.mu.RLock()